@@ -0,0 +1,608 @@
+// Package client talks to the server's /yamux endpoint. It performs the
+// HTTP upgrade, applies the XOR key and frames commands and replies, so
+// callers only see typed methods.
+package client
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"file-sharing-utility/internal/common"
+	"file-sharing-utility/internal/protocol"
+	"file-sharing-utility/internal/xorrw"
+	"file-sharing-utility/internal/yamux"
+)
+
+// Types of the protocol shared with the server
+type (
+	// Command is a request sent to the server
+	Command = protocol.Command
+
+	// FileEntry describes one entry of a directory listing
+	FileEntry = protocol.FileEntry
+
+	// TransferStatus reports what a streaming transfer moved
+	TransferStatus = protocol.TransferStatus
+
+	// StatResult describes a file on the server
+	StatResult = protocol.StatResult
+
+	// Response is a reply from the server, as found in BatchResult
+	Response = protocol.Response
+
+	// BatchResult holds the reply to each operation of a batch
+	BatchResult = protocol.BatchResult
+
+	// HashResult is the checksum of a file or part of one
+	HashResult = protocol.HashResult
+
+	// ManifestResult lists the files below a directory with checksums
+	ManifestResult = protocol.ManifestResult
+
+	// Info holds the server's system information
+	Info = common.Info
+)
+
+// Location selects the directory a command operates on
+type Location string
+
+const (
+	// Downloads is the directory files are served from
+	Downloads Location = "download"
+
+	// Uploads is the directory uploaded files are stored in
+	Uploads Location = "upload"
+)
+
+// ErrChecksumMismatch is returned when the data received does not match the
+// checksum the server reported
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Error is a failed reply from the server
+type Error struct {
+	Status  int    // HTTP style status code
+	Code    string // Machine-readable error code, e.g. "not_found"
+	Message string // Human-readable message
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// IsNotFound reports whether err is a server reply saying the file does
+// not exist
+func IsNotFound(err error) bool {
+	var serverErr *Error
+	return errors.As(err, &serverErr) && serverErr.Code == protocol.CodeNotFound
+}
+
+// Client is a connection to the server. Each call runs on its own yamux
+// stream, so a Client can be used from several goroutines at once.
+type Client struct {
+	session *yamux.Session
+}
+
+// Dial connects to the server at addr and upgrades the connection to
+// yamux. xorKey must match the server's key, or be empty if it has none.
+func Dial(addr, xorKey string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(conn, addr, xorKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClient upgrades an established connection to yamux. host is sent in
+// the upgrade request's Host header.
+func NewClient(conn net.Conn, host, xorKey string) (*Client, error) {
+	req := "GET /yamux HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: yamux\r\n" +
+		"Connection: Upgrade\r\n" +
+		"\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, fmt.Errorf("sending upgrade request: %w", err)
+	}
+
+	// The reader may hold bytes past the response, so the session keeps
+	// reading through it
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading upgrade response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("upgrade refused: %s", resp.Status)
+	}
+
+	var rw io.ReadWriter = &bufferedConn{Reader: br, Conn: conn}
+	if xorKey != "" {
+		rw = xorrw.NewXorReaderWriter(rw, []byte(xorKey))
+	}
+
+	config := yamux.NewConfig()
+	config.Logger = nil
+
+	session, err := yamux.Client(&sessionConn{ReadWriter: rw, conn: conn}, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{session: session}, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.session.Close()
+}
+
+// List returns the entries of a directory under the download path. An
+// empty path lists the top level.
+func (c *Client) List(path string) ([]FileEntry, error) {
+	var result protocol.ListResult
+	if err := c.call(&Command{Type: "list", Path: path}, &result); err != nil {
+		return nil, err
+	}
+	return result.Entries, nil
+}
+
+// ListOptions select, order and page the entries ListPage returns. The
+// zero value lists one directory level of the download path by name.
+type ListOptions struct {
+	Location     Location // Directory to list in, Downloads if empty
+	Recursive    bool     // List every level below the directory
+	Depth        int      // Levels to list, overrides Recursive if set
+	Include      string   // Glob an entry must match
+	Exclude      string   // Glob of entries to leave out
+	IncludeRegex string   // Regular expression an entry's path must match
+	ExcludeRegex string   // Regular expression of paths to leave out
+	Sort         string   // "name", "size" or "mtime"
+	Descending   bool     // Reverse the order
+	Limit        int      // Entries per page, the server's default if zero
+	Cursor       string   // Cursor returned with the previous page
+}
+
+// params returns the options as command parameters
+func (o *ListOptions) params() map[string]string {
+	params := map[string]string{}
+	set := func(key, value string) {
+		if value != "" {
+			params[key] = value
+		}
+	}
+
+	set("location", string(o.Location))
+	if o.Recursive {
+		params["recursive"] = "true"
+	}
+	if o.Depth > 0 {
+		params["depth"] = strconv.Itoa(o.Depth)
+	}
+	set("include", o.Include)
+	set("exclude", o.Exclude)
+	set("include_regex", o.IncludeRegex)
+	set("exclude_regex", o.ExcludeRegex)
+	set("sort", o.Sort)
+	if o.Descending {
+		params["order"] = "desc"
+	}
+	if o.Limit > 0 {
+		params["limit"] = strconv.Itoa(o.Limit)
+	}
+	set("cursor", o.Cursor)
+	return params
+}
+
+// ListPage returns one page of the entries below path and the cursor for
+// the next page, which is empty after the last one
+func (c *Client) ListPage(path string, opts ListOptions) ([]FileEntry, string, error) {
+	var result protocol.ListResult
+	if err := c.call(&Command{Type: "list", Path: path, Params: opts.params()}, &result); err != nil {
+		return nil, "", err
+	}
+	return result.Entries, result.NextCursor, nil
+}
+
+// Upload stores the contents of r at path under the upload path. The size
+// is taken from r if it can tell it; otherwise r is first copied to a
+// temporary file, since the server needs the size up front.
+func (c *Client) Upload(path string, r io.Reader) (*TransferStatus, error) {
+	size, ok, err := readerSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		spool, err := os.CreateTemp("", "upload-*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		if size, err = io.Copy(spool, r); err != nil {
+			return nil, err
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		r = spool
+	}
+
+	return c.UploadN(path, r, size)
+}
+
+// UploadN stores exactly size bytes read from r at path under the upload
+// path
+func (c *Client) UploadN(path string, r io.Reader, size int64) (*TransferStatus, error) {
+	return c.upload(path, r, size, nil)
+}
+
+// ResumeUpload uploads r to path, continuing an earlier upload that was
+// interrupted. The data the server already holds is checked against the
+// start of r and only the rest is sent; the file is committed once the
+// server's checksum matches r.
+func (c *Client) ResumeUpload(path string, r io.ReadSeeker) (*TransferStatus, error) {
+	total, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	hash := sha256.New()
+	part, err := c.StatPart(path)
+	switch {
+	case err == nil && part.Size <= total:
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(hash, r, part.Size); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(hash.Sum(nil)) == part.SHA256 {
+			offset = part.Size
+		} else {
+			// Not a prefix of r, start over
+			hash.Reset()
+		}
+	case err != nil && !IsNotFound(err):
+		return nil, err
+	}
+
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	params := map[string]string{"offset": strconv.FormatInt(offset, 10)}
+	status, err := c.upload(path, io.TeeReader(r, hash), total-offset, params)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if status.SHA256 != sum {
+		return nil, ErrChecksumMismatch
+	}
+
+	// Nothing more to send, just commit what the server holds
+	return c.upload(path, nil, 0, map[string]string{"commit": "true", "sha256": sum})
+}
+
+// upload sends size bytes from r with the upload_stream command. Unless
+// params make it a resumed upload, the reply's checksum is checked against
+// the data sent.
+func (c *Client) upload(path string, r io.Reader, size int64, params map[string]string) (*TransferStatus, error) {
+	stream, err := c.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	cmd := &Command{
+		Type:   "upload_stream",
+		Path:   path,
+		Params: map[string]string{"size": strconv.FormatInt(size, 10)},
+	}
+	for key, value := range params {
+		cmd.Params[key] = value
+	}
+	if err := protocol.WriteFrame(stream, cmd); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if size > 0 {
+		if _, err := io.CopyN(stream, io.TeeReader(r, hash), size); err != nil {
+			// The server is still waiting for the rest of the data
+			stream.Reset()
+			return nil, fmt.Errorf("sending %s: %w", path, err)
+		}
+	}
+
+	var status TransferStatus
+	if err := readReply(stream, &status); err != nil {
+		return nil, err
+	}
+	if params == nil && status.SHA256 != hex.EncodeToString(hash.Sum(nil)) {
+		return nil, ErrChecksumMismatch
+	}
+	return &status, nil
+}
+
+// Download writes the file at path under the download path to w and checks
+// it against the checksum the server reports
+func (c *Client) Download(path string, w io.Writer) (*TransferStatus, error) {
+	return c.DownloadRange(path, w, 0, -1)
+}
+
+// DownloadRange writes length bytes of the file at path, starting at
+// offset, to w. A negative length reads to the end of the file.
+func (c *Client) DownloadRange(path string, w io.Writer, offset, length int64) (*TransferStatus, error) {
+	stream, err := c.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	cmd := &Command{
+		Type:   "download_stream",
+		Path:   path,
+		Params: map[string]string{"offset": strconv.FormatInt(offset, 10)},
+	}
+	if length >= 0 {
+		cmd.Params["length"] = strconv.FormatInt(length, 10)
+	}
+	if err := protocol.WriteFrame(stream, cmd); err != nil {
+		return nil, err
+	}
+
+	var header protocol.TransferHeader
+	if err := readReply(stream, &header); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(w, hash), stream, header.Size); err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("receiving %s: %w", path, err)
+	}
+
+	var status TransferStatus
+	if err := readReply(stream, &status); err != nil {
+		return nil, err
+	}
+	if status.SHA256 != hex.EncodeToString(hash.Sum(nil)) {
+		return nil, ErrChecksumMismatch
+	}
+	return &status, nil
+}
+
+// Stat returns the size and SHA-256 of the file at path in the given
+// location
+func (c *Client) Stat(location Location, path string) (*StatResult, error) {
+	return c.stat(path, locationParams(location))
+}
+
+// StatPart describes the unfinished upload to path
+func (c *Client) StatPart(path string) (*StatResult, error) {
+	return c.stat(path, locationParams(Uploads, "partial", "true"))
+}
+
+// stat runs the stat command
+func (c *Client) stat(path string, params map[string]string) (*StatResult, error) {
+	var result StatResult
+	if err := c.call(&Command{Type: "stat", Path: path, Params: params}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Delete removes the file at path in the given location
+func (c *Client) Delete(location Location, path string) error {
+	return c.call(&Command{Type: "delete", Path: path, Params: locationParams(location)}, nil)
+}
+
+// Mkdir creates a directory and any missing parents
+func (c *Client) Mkdir(location Location, path string) error {
+	return c.call(&Command{Type: "mkdir", Path: path, Params: locationParams(location, "parents", "true")}, nil)
+}
+
+// Rename moves a file or directory within a location. It fails if to
+// already exists.
+func (c *Client) Rename(location Location, from, to string) error {
+	return c.call(&Command{Type: "rename", Path: from, Params: locationParams(location, "to", to)}, nil)
+}
+
+// Copy copies a file or a whole directory within a location. It fails if
+// to already exists.
+func (c *Client) Copy(location Location, from, to string) error {
+	params := locationParams(location, "to", to)
+	params["recursive"] = "true"
+	return c.call(&Command{Type: "copy", Path: from, Params: params}, nil)
+}
+
+// Rmdir removes a directory. Unless recursive is set it must be empty.
+func (c *Client) Rmdir(location Location, path string, recursive bool) error {
+	params := locationParams(location)
+	if recursive {
+		params["recursive"] = "true"
+	}
+	return c.call(&Command{Type: "rmdir", Path: path, Params: params}, nil)
+}
+
+// Touch creates an empty file if there is none and sets its modification
+// time, to now if mtime is zero
+func (c *Client) Touch(location Location, path string, mtime time.Time) error {
+	params := locationParams(location)
+	if !mtime.IsZero() {
+		params["mtime"] = mtime.Format(time.RFC3339)
+	}
+	return c.call(&Command{Type: "touch", Path: path, Params: params}, nil)
+}
+
+// locationParams returns command parameters selecting the location, plus
+// the given key/value pairs
+func locationParams(location Location, pairs ...string) map[string]string {
+	params := map[string]string{"location": string(location)}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		params[pairs[i]] = pairs[i+1]
+	}
+	return params
+}
+
+// Batch runs the commands in order on the server. With atomic set, either
+// all of them are applied or none are, and only upload, delete and mkdir
+// commands are allowed. Failed operations are reported in the result's
+// replies rather than as an error.
+func (c *Client) Batch(cmds []Command, atomic bool) (*BatchResult, error) {
+	cmd := &Command{Type: "batch", Commands: cmds}
+	if atomic {
+		cmd.Params = map[string]string{"atomic": "true"}
+	}
+
+	var result BatchResult
+	if err := c.call(cmd, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Hash returns the checksum of a file, computed with algorithm: "md5",
+// "sha1", "sha256" or "blake2b". An empty algorithm means SHA-256.
+func (c *Client) Hash(location Location, path, algorithm string) (*HashResult, error) {
+	var result HashResult
+	params := locationParams(location, "algorithm", algorithm)
+	if err := c.call(&Command{Type: "hash", Path: path, Params: params}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Manifest returns the size, modification time and checksum of every file
+// below a directory, "" for the whole location
+func (c *Client) Manifest(location Location, path, algorithm string) (*ManifestResult, error) {
+	var result ManifestResult
+	params := locationParams(location, "algorithm", algorithm)
+	if err := c.call(&Command{Type: "manifest", Path: path, Params: params}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Info returns the server's system information
+func (c *Client) Info() (*Info, error) {
+	var info Info
+	if err := c.call(&Command{Type: "info"}, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// call sends a command on a new stream and decodes the reply's data into v
+func (c *Client) call(cmd *Command, v interface{}) error {
+	stream, err := c.session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := protocol.WriteFrame(stream, cmd); err != nil {
+		return err
+	}
+	return readReply(stream, v)
+}
+
+// readerSize returns how many bytes are left in r, if r can tell
+func readerSize(r io.Reader) (int64, bool, error) {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		// bytes.Buffer, bytes.Reader and strings.Reader
+		return int64(r.Len()), true, nil
+	case io.Seeker:
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			// Not really seekable, such as a pipe
+			return 0, false, nil
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false, err
+		}
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return 0, false, err
+		}
+		return end - pos, true, nil
+	}
+	return 0, false, nil
+}
+
+// readReply reads a reply envelope and decodes its data into v, or returns
+// the server's error
+func readReply(r io.Reader, v interface{}) error {
+	data, err := protocol.ReadFrame(r)
+	if err != nil {
+		return fmt.Errorf("reading reply: %w", err)
+	}
+
+	var reply struct {
+		protocol.Response
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return fmt.Errorf("decoding reply: %w", err)
+	}
+	if reply.Failed() {
+		return &Error{Status: reply.Status, Code: reply.Code, Message: reply.Error}
+	}
+
+	if v == nil || len(reply.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(reply.Data, v)
+}
+
+// bufferedConn reads through the reader that parsed the upgrade response
+type bufferedConn struct {
+	*bufio.Reader
+	net.Conn
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.Reader.Read(p)
+}
+
+// sessionConn gives the yamux session the connection's addresses and a
+// way to close it
+type sessionConn struct {
+	io.ReadWriter
+	conn net.Conn
+}
+
+// Close closes the underlying connection
+func (s *sessionConn) Close() error {
+	return s.conn.Close()
+}
+
+// LocalAddr returns the local network address
+func (s *sessionConn) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address
+func (s *sessionConn) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
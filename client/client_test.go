@@ -0,0 +1,355 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"file-sharing-utility/internal/httpserver"
+	"file-sharing-utility/internal/protocol"
+)
+
+// newTestClient starts an in-process server sharing one directory for
+// uploads and downloads and connects a client to it
+func newTestClient(t *testing.T, xorKey string) (*Client, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	server := httpserver.NewServer(dir, dir, xorKey)
+	server.SetupYamux()
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	client, err := Dial(ts.Listener.Addr().String(), xorKey)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client, dir
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, key := range []string{"", "secretkey"} {
+		t.Run(fmt.Sprintf("key=%q", key), func(t *testing.T) {
+			client, dir := newTestClient(t, key)
+
+			payload := bytes.Repeat([]byte("client round trip "), 64*1024)
+			status, err := client.Upload("docs/big.bin", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			if status.Size != int64(len(payload)) {
+				t.Errorf("Expected size %d, got %d", len(payload), status.Size)
+			}
+
+			entries, err := client.List("docs")
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Name != "big.bin" || entries[0].Size != int64(len(payload)) {
+				t.Errorf("Unexpected entries %+v", entries)
+			}
+
+			var downloaded bytes.Buffer
+			if _, err := client.Download("docs/big.bin", &downloaded); err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+			if !bytes.Equal(downloaded.Bytes(), payload) {
+				t.Error("Downloaded data does not match the upload")
+			}
+
+			if err := client.Delete(Uploads, "docs/big.bin"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "docs", "big.bin")); !os.IsNotExist(err) {
+				t.Errorf("Expected the file to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUploadUnsizedReader(t *testing.T) {
+	client, dir := newTestClient(t, "")
+
+	// A pipe cannot tell its size, so the client spools it first
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, "streamed ")
+		io.WriteString(pw, "through a pipe")
+		pw.Close()
+	}()
+
+	status, err := client.Upload("pipe.txt", pr)
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if status.Size != 23 {
+		t.Errorf("Expected size 23, got %d", status.Size)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "pipe.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read uploaded file: %v", err)
+	}
+	if string(data) != "streamed through a pipe" {
+		t.Errorf("Unexpected content %q", data)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	client, _ := newTestClient(t, "secretkey")
+
+	_, err := client.Download("missing.bin", io.Discard)
+	if !IsNotFound(err) {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+
+	err = client.Delete(Downloads, "../outside")
+	serverErr, ok := err.(*Error)
+	if !ok || serverErr.Code != protocol.CodeInvalidPath {
+		t.Errorf("Expected an invalid path error, got %v", err)
+	}
+
+	// Failed calls leave the connection usable
+	info, err := client.Info()
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	if hostname, _ := os.Hostname(); info.Hostname != hostname {
+		t.Errorf("Expected hostname %q, got %q", hostname, info.Hostname)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	client, _ := newTestClient(t, "secretkey")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("file%d.txt", i)
+			content := strings.Repeat(name, 10000)
+			if _, err := client.Upload(name, strings.NewReader(content)); err != nil {
+				errs <- err
+				return
+			}
+
+			var buf bytes.Buffer
+			if _, err := client.Download(name, &buf); err != nil {
+				errs <- err
+				return
+			}
+			if buf.String() != content {
+				errs <- fmt.Errorf("%s came back different", name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	client, dir := newTestClient(t, "secretkey")
+	payload := bytes.Repeat([]byte("resumable "), 10000)
+
+	tests := []struct {
+		name string
+		part []byte
+	}{
+		{"fresh", nil},
+		{"prefix", payload[:12345]},
+		{"stale", []byte("not a prefix of the payload")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(dir, tt.name+".bin")
+			if tt.part != nil {
+				// Leave an unfinished upload behind
+				params := map[string]string{"offset": "0"}
+				if _, err := client.upload(tt.name+".bin", bytes.NewReader(tt.part), int64(len(tt.part)), params); err != nil {
+					t.Fatalf("Failed to create part: %v", err)
+				}
+			}
+
+			status, err := client.ResumeUpload(tt.name+".bin", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			if !status.Committed || status.Size != int64(len(payload)) {
+				t.Errorf("Unexpected status %+v", status)
+			}
+
+			data, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatalf("Failed to read file: %v", err)
+			}
+			if !bytes.Equal(data, payload) {
+				t.Error("Uploaded file does not match the payload")
+			}
+		})
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	client, dir := newTestClient(t, "")
+	if err := os.WriteFile(filepath.Join(dir, "digits.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := client.DownloadRange("digits.txt", &buf, 2, 5); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if buf.String() != "23456" {
+		t.Errorf("Expected %q, got %q", "23456", buf.String())
+	}
+
+	stat, err := client.Stat(Downloads, "digits.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if stat.Size != 10 || stat.SHA256 == "" {
+		t.Errorf("Unexpected stat %+v", stat)
+	}
+}
+
+func TestFilesystemCommands(t *testing.T) {
+	client, dir := newTestClient(t, "")
+
+	if err := client.Mkdir(Uploads, "a/b"); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	mtime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	if err := client.Touch(Uploads, "a/b/file.txt", mtime); err != nil {
+		t.Fatalf("Touch failed: %v", err)
+	}
+	if err := client.Copy(Uploads, "a", "copy"); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if err := client.Rename(Uploads, "copy", "moved"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+
+	stat, err := client.Stat(Uploads, "moved/b/file.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if stat.Size != 0 || stat.IsDir {
+		t.Errorf("Unexpected stat %+v", stat)
+	}
+
+	var serverErr *Error
+	if err := client.Rmdir(Uploads, "moved", false); !errors.As(err, &serverErr) || serverErr.Code != protocol.CodeNotEmpty {
+		t.Errorf("Expected a not empty error, got %v", err)
+	}
+	if err := client.Rmdir(Uploads, "moved", true); err != nil {
+		t.Fatalf("Rmdir failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved")); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory to be removed, got %v", err)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	client, dir := newTestClient(t, "")
+	for _, name := range []string{"a.txt", "b.txt", "sub/c.txt", "sub/d.log"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	opts := ListOptions{Recursive: true, Include: "*.txt", Limit: 2}
+	var names []string
+	for {
+		entries, next, err := client.ListPage("", opts)
+		if err != nil {
+			t.Fatalf("ListPage failed: %v", err)
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		if next == "" {
+			break
+		}
+		opts.Cursor = next
+	}
+
+	if got := strings.Join(names, ","); got != "a.txt,b.txt,sub/c.txt" {
+		t.Errorf("Expected a.txt,b.txt,sub/c.txt, got %s", got)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	client, dir := newTestClient(t, "")
+
+	cmds := []Command{
+		{Type: "upload", Path: "one.txt", Content: []byte("1")},
+		{Type: "upload", Path: "two.txt", Content: []byte("2")},
+		{Type: "delete", Path: "missing.txt"},
+	}
+	result, err := client.Batch(cmds, true)
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	if result.Completed || result.Results[2].Code != "not_found" {
+		t.Fatalf("Expected the batch to fail on missing.txt, got %+v", result.Results)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "one.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected one.txt to be rolled back, got %v", err)
+	}
+
+	result, err = client.Batch(cmds[:2], true)
+	if err != nil || !result.Completed {
+		t.Fatalf("Expected the batch to complete, got %+v, %v", result, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "two.txt")); string(data) != "2" {
+		t.Errorf("Expected two.txt to be uploaded, got %q", data)
+	}
+}
+
+func TestHashAndManifest(t *testing.T) {
+	client, dir := newTestClient(t, "")
+	payload := []byte("mirror me")
+	if err := os.WriteFile(filepath.Join(dir, "file.bin"), payload, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	sum := sha256.Sum256(payload)
+	want := hex.EncodeToString(sum[:])
+
+	result, err := client.Hash(Downloads, "file.bin", "")
+	if err != nil {
+		t.Fatalf("Hash failed: %v", err)
+	}
+	if result.Algorithm != "sha256" || result.Hash != want {
+		t.Errorf("Expected SHA-256 %s, got %+v", want, result)
+	}
+
+	manifest, err := client.Manifest(Uploads, "", "sha256")
+	if err != nil {
+		t.Fatalf("Manifest failed: %v", err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Hash != want || manifest.Cached != 1 {
+		t.Errorf("Expected file.bin from the cache, got %+v", manifest)
+	}
+}
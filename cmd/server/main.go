@@ -21,6 +21,11 @@ type Config struct {
 	XorKey          string
 	DownloadPath    string
 	UploadPath      string
+	PipelineLimit   int
+	MaxUploadSize   int64
+	TusDir          string
+	MaxWatchers     int
+	EnableAdmin     bool
 }
 
 func main() {
@@ -58,6 +63,11 @@ func parseFlags() *Config {
 	flag.StringVar(&config.XorKey, "xor-key", "", "XOR key for encoding/decoding")
 	flag.StringVar(&config.DownloadPath, "download-path", "./downloads", "Path to download files")
 	flag.StringVar(&config.UploadPath, "upload-path", "./uploads", "Path to upload files")
+	flag.IntVar(&config.PipelineLimit, "pipeline-limit", httpserver.DefaultPipelineLimit, "Commands a pipelined yamux stream runs at once")
+	flag.Int64Var(&config.MaxUploadSize, "max-upload-size", 0, "Largest upload request in bytes, 0 for no limit")
+	flag.StringVar(&config.TusDir, "tus-dir", "", "Path to keep resumable uploads in progress (default the upload path with .tus appended)")
+	flag.IntVar(&config.MaxWatchers, "max-watchers", httpserver.DefaultMaxWatchers, "Watches the server runs at once")
+	flag.BoolVar(&config.EnableAdmin, "enable-admin", false, "Enable the /admin endpoints, which list connected clients")
 	
 	flag.Parse()
 	
@@ -91,6 +101,15 @@ func startHTTPServer(config *Config) {
 	)
 	
 	// Setup yamux support
+	server.SetPipelineLimit(config.PipelineLimit)
+	server.SetMaxUploadSize(config.MaxUploadSize)
+	if config.TusDir != "" {
+		if err := server.SetTusDir(config.TusDir); err != nil {
+			log.Fatalf("Invalid -tus-dir: %v", err)
+		}
+	}
+	server.SetMaxWatchers(config.MaxWatchers)
+	server.SetAdminEnabled(config.EnableAdmin)
 	server.SetupYamux()
 	
 	// Start the server in a goroutine
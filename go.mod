@@ -5,6 +5,10 @@ go 1.19
 require (
 	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
 	github.com/hashicorp/yamux v0.1.2
+	golang.org/x/crypto v0.14.0
 )
 
-require golang.org/x/net v0.15.0 // indirect
+require (
+	golang.org/x/net v0.15.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
@@ -257,4 +257,57 @@ func (e *errorReadWriter) Write(p []byte) (int, error) {
 		return 0, e.writeErr
 	}
 	return len(p), nil
-} 
\ No newline at end of file
+}
+
+func TestCopyFile(t *testing.T) {
+	testData := []byte("test data for CopyFile")
+	srcPath, cleanup := setupTempFile(t, testData)
+	defer cleanup()
+
+	dstPath := filepath.Join(t.TempDir(), "copy.txt")
+	n, err := CopyFile(dstPath, srcPath)
+	if err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+	if n != int64(len(testData)) {
+		t.Errorf("Expected %d bytes copied, got %d", len(testData), n)
+	}
+
+	data, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatalf("Failed to read copy: %v", err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Errorf("Content mismatch. Got %v, want %v", data, testData)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "a", "b"), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a", "b", "file.txt"), []byte("nested"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "empty"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "copy")
+	n, err := CopyTree(dst, src)
+	if err != nil {
+		t.Fatalf("CopyTree failed: %v", err)
+	}
+	if n != 6 {
+		t.Errorf("Expected 6 bytes copied, got %d", n)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dst, "a", "b", "file.txt"))
+	if err != nil || string(data) != "nested" {
+		t.Errorf("Expected nested file to be copied, got %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "empty")); err != nil || !info.IsDir() {
+		t.Errorf("Expected empty directory to be copied, got %v", err)
+	}
+}
@@ -2,7 +2,9 @@ package common
 
 import (
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 )
 
 // WriteBlob copies data from a reader to a writer and returns the number of bytes copied
@@ -36,4 +38,62 @@ func AppendToFile(path string, data []byte) error {
 	
 	_, err = f.Write(data)
 	return err
-} 
\ No newline at end of file
+}
+
+// CopyFile copies the file at src to dst, keeping its permissions, and
+// returns the number of bytes copied
+func CopyFile(dst, src string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// CopyTree copies the directory at src and everything below it to dst and
+// returns the number of bytes copied. Symbolic links are skipped.
+func CopyTree(dst, src string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case entry.IsDir():
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			return os.MkdirAll(target, info.Mode().Perm())
+		case entry.Type().IsRegular():
+			n, err := CopyFile(target, path)
+			total += n
+			return err
+		}
+		return nil
+	})
+	return total, err
+}
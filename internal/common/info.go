@@ -10,14 +10,14 @@ import (
 
 // Info holds system and application information
 type Info struct {
-	Hostname      string
-	OS            string
-	Version       string
-	GoVersion     string
-	NumCPU        int
-	StartTime     time.Time
-	UploadCount   int
-	DownloadCount int
+	Hostname      string    `json:"hostname"`
+	OS            string    `json:"os"`
+	Version       string    `json:"version"`
+	GoVersion     string    `json:"go_version"`
+	NumCPU        int       `json:"num_cpu"`
+	StartTime     time.Time `json:"start_time"`
+	UploadCount   int       `json:"uploads"`
+	DownloadCount int       `json:"downloads"`
 }
 
 // GetInfo returns system and application information
@@ -0,0 +1,247 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"file-sharing-utility/internal/protocol"
+	"file-sharing-utility/internal/xorrw"
+)
+
+// REST API. /api/v1/files/{path} is a file or directory below the download
+// directory, or below the upload directory with ?location=upload:
+//
+//	GET     the file, or the directory's listing as /list returns it,
+//	        taking the same listing options
+//	HEAD    the headers of GET, with the size, modification time and
+//	        ETag of a file
+//	PUT     stores the request body as the file, creating its parent
+//	        directories
+//	DELETE  removes the file, or the directory: an empty one, or any with
+//	        ?recursive=true
+//	POST    runs the FileAction in the JSON body
+//
+// Files are stored XOR-encoded like /upload stores them and decoded like
+// /download serves them. Successes are answered with the bare payload of
+// the matching command, failures with the command reply envelope.
+
+// apiFilesPath is the prefix of the file resources
+const apiFilesPath = "/api/v1/files/"
+
+// FileAction is the body of a POST to a file resource. Action is "move"
+// (or "rename") or "copy", to the path To in the same directory tree with
+// Overwrite replacing a file there, or "mkdir", creating the directory and
+// its parents with Parents set.
+type FileAction struct {
+	Action    string `json:"action"`
+	To        string `json:"to,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+	Parents   bool   `json:"parents,omitempty"`
+}
+
+// setupAPI registers the REST API routes
+func (s *Server) setupAPI() {
+	pattern := apiFilesPath + "{path...}"
+	s.mux.HandleFunc("GET "+pattern, s.handleGetFile)
+	s.mux.HandleFunc("PUT "+pattern, s.handlePutFile)
+	s.mux.HandleFunc("DELETE "+pattern, s.handleDeleteFile)
+	s.mux.HandleFunc("POST "+pattern, s.handleFileAction)
+
+	// Other methods get the JSON error too
+	s.mux.HandleFunc(pattern, s.handleFileMethod)
+}
+
+// apiCommand builds the command a request to a file resource maps to,
+// with the query parameters as its parameters
+func apiCommand(r *http.Request, commandType string) *protocol.Command {
+	params := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		params[key] = values[0]
+	}
+	return &protocol.Command{Type: commandType, Path: PathParam(r, "path"), Params: params}
+}
+
+// writeAPIResponse answers with the payload of a successful reply, or
+// with the envelope of a failed one
+func writeAPIResponse(w http.ResponseWriter, response *protocol.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.Status)
+
+	var body interface{} = response
+	if !response.Failed() {
+		body = response.Data
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding reply: %v", err)
+	}
+}
+
+// handleGetFile serves a file, or lists a directory
+func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
+	cmd := apiCommand(r, "list")
+
+	target := s.basePath(cmd)
+	if cmd.Path != "" {
+		resolved, failure := s.resolvePath(cmd, cmd.Path)
+		if failure != nil {
+			writeAPIResponse(w, failure)
+			return
+		}
+		target = resolved
+	}
+
+	file, err := os.Open(target)
+	if err != nil {
+		writeAPIResponse(w, fileErrorResponse("reading file", err))
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeAPIResponse(w, fileErrorResponse("reading file", err))
+		return
+	}
+
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if info.IsDir() {
+		w.Header().Set("X-File-Type", "directory")
+		writeAPIResponse(w, s.handleListCommand(r.Context(), cmd))
+		return
+	}
+
+	w.Header().Set("X-File-Type", "file")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", s.downloadETag(info))
+
+	var content io.ReadSeeker = file
+	if s.xorKey != "" {
+		content = xorrw.NewXorReadSeeker(file, []byte(s.xorKey))
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+}
+
+// handlePutFile stores the request body as a file, answering 201 if the
+// file is new and 200 if it replaced one
+func (s *Server) handlePutFile(w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
+	cmd := apiCommand(r, "upload")
+	target, failure := s.resolveEntry(cmd, cmd.Path)
+	if failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+
+	info, err := os.Stat(target)
+	switch {
+	case err == nil && info.IsDir():
+		writeAPIResponse(w, errorResponse(http.StatusConflict, protocol.CodeAlreadyExists,
+			"Error: %s is a directory", cmd.Path))
+		return
+	case err != nil && !os.IsNotExist(err):
+		writeAPIResponse(w, fileErrorResponse("reading file", err))
+		return
+	}
+	created := err != nil
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		writeAPIResponse(w, fileErrorResponse("creating directory", err))
+		return
+	}
+
+	// The file is only replaced once the whole body has arrived
+	body := &readErrorReader{r: r.Body}
+	staged, failure := s.stageFile(filepath.Dir(target), body, nil)
+	if body.err != nil {
+		failure = uploadReadError(body.err)
+	}
+	if failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+	defer staged.discard()
+	if _, failure := staged.commit(target, overwriteReplace); failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+
+	response := newResponse(protocol.TypeUpload, &protocol.FileResult{Path: cmd.Path, Size: staged.size, SHA256: staged.sha256})
+	if created {
+		response.Status = http.StatusCreated
+	}
+	writeAPIResponse(w, response)
+}
+
+// handleDeleteFile removes a file or a directory
+func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	cmd := apiCommand(r, "delete")
+	target, failure := s.resolveEntry(cmd, cmd.Path)
+	if failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		writeAPIResponse(w, fileErrorResponse("deleting file", err))
+		return
+	}
+	if info.IsDir() {
+		writeAPIResponse(w, s.handleRmdirCommand(cmd))
+		return
+	}
+	writeAPIResponse(w, s.handleDeleteCommand(cmd))
+}
+
+// handleFileAction runs the FileAction in the request body
+func (s *Server) handleFileAction(w http.ResponseWriter, r *http.Request) {
+	var action FileAction
+	if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+		writeAPIResponse(w, errorResponse(http.StatusBadRequest, protocol.CodeInvalidCommand,
+			"Error: Invalid action: %v", err))
+		return
+	}
+
+	cmd := apiCommand(r, action.Action)
+	if action.To != "" {
+		cmd.Params["to"] = action.To
+	}
+	if action.Overwrite {
+		cmd.Params["overwrite"] = "true"
+	}
+	if action.Parents {
+		cmd.Params["parents"] = "true"
+	}
+
+	var response *protocol.Response
+	switch action.Action {
+	case "move", "rename":
+		response = s.handleRenameCommand(cmd)
+	case "copy":
+		response = s.handleCopyCommand(cmd)
+	case "mkdir":
+		response = s.handleMkdirCommand(cmd)
+		if !response.Failed() {
+			response.Status = http.StatusCreated
+		}
+	default:
+		response = errorResponse(http.StatusBadRequest, protocol.CodeInvalidCommand,
+			"Error: Unknown action %q", action.Action)
+	}
+	writeAPIResponse(w, response)
+}
+
+// handleFileMethod answers the methods a file resource does not support
+func (s *Server) handleFileMethod(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "DELETE, GET, HEAD, OPTIONS, POST, PUT")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeAPIResponse(w, errorResponse(http.StatusMethodNotAllowed, protocol.CodeInvalidCommand,
+		"Error: Method %s not allowed", r.Method))
+}
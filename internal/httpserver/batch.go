@@ -0,0 +1,378 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"file-sharing-utility/internal/protocol"
+)
+
+// Batches. A batch command carries its operations in Commands and runs
+// them in order. The reply's data holds the reply to each operation, and
+// completed is set if all of them succeeded. Params:
+//
+//	atomic         "true" applies all of the operations or none of them
+//	stop_on_error  "true" skips the operations after the first failure;
+//	               atomic batches always stop there
+//
+// Atomic batches may only hold upload, delete and mkdir commands. Their
+// uploads are first written to a staging directory of the upload
+// directory. Once everything is staged, the operations are applied in
+// order: staged files are renamed into place, and deleted or replaced
+// entries are renamed into a staging directory of their location. If an
+// operation fails, the ones before it are undone in reverse order and
+// reply rolled_back. Entries moved aside are only removed once the whole
+// batch has been applied.
+//
+// Staging directories live next to their location, with stagingSuffix
+// appended to its name, so clients cannot see or reach them and renames
+// stay on one filesystem. Whatever a batch left there when the server
+// stopped is removed when the next one starts.
+
+const (
+	// maxBatchCommands caps the operations in one batch
+	maxBatchCommands = 1000
+
+	// stagingSuffix names the directory next to a location that holds
+	// its staging directories
+	stagingSuffix = ".batch"
+)
+
+// handleBatchCommand runs the operations of a batch
+func (s *Server) handleBatchCommand(ctx context.Context, cmd *protocol.Command) *protocol.Response {
+	if len(cmd.Commands) == 0 {
+		return errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Empty batch")
+	}
+	if len(cmd.Commands) > maxBatchCommands {
+		return errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: More than %d commands in batch", maxBatchCommands)
+	}
+	for i := range cmd.Commands {
+		if cmd.Commands[i].Type == "batch" {
+			return errorResponse(http.StatusBadRequest, protocol.CodeInvalidCommand, "Error: Batches cannot be nested")
+		}
+	}
+
+	result := &protocol.BatchResult{Atomic: cmd.Params["atomic"] == "true", Completed: true}
+	if result.Atomic {
+		result.Results = s.runAtomicBatch(ctx, cmd.Commands)
+	} else {
+		result.Results = s.runBatch(ctx, cmd.Commands, cmd.Params["stop_on_error"] == "true")
+	}
+	for _, response := range result.Results {
+		if response.Failed() {
+			result.Completed = false
+		}
+	}
+
+	return newResponse(protocol.TypeBatch, result)
+}
+
+// runBatch runs the operations one after the other
+func (s *Server) runBatch(ctx context.Context, cmds []protocol.Command, stopOnError bool) []*protocol.Response {
+	results := make([]*protocol.Response, len(cmds))
+	stopped := false
+	for i := range cmds {
+		switch {
+		case stopped:
+			results[i] = skippedResponse(&cmds[i])
+		case ctx.Err() != nil:
+			results[i] = cancelledResponse(&cmds[i])
+			stopped = true
+		default:
+			results[i] = s.processCommand(ctx, &cmds[i])
+			stopped = stopOnError && results[i].Failed()
+		}
+	}
+	return results
+}
+
+// runAtomicBatch stages and then applies the operations, undoing them all
+// if one fails
+func (s *Server) runAtomicBatch(ctx context.Context, cmds []protocol.Command) []*protocol.Response {
+	tx := &transaction{server: s, staging: make(map[string]string)}
+	defer tx.close()
+
+	results := make([]*protocol.Response, len(cmds))
+
+	// Nothing is changed until every upload is staged
+	staged := make([]string, len(cmds))
+	for i := range cmds {
+		if ctx.Err() != nil {
+			return abandonBatch(cmds, results, i, cancelledResponse(&cmds[i]))
+		}
+		path, failure := tx.stage(&cmds[i])
+		if failure != nil {
+			return abandonBatch(cmds, results, i, failure)
+		}
+		staged[i] = path
+	}
+
+	for i := range cmds {
+		response := tx.apply(&cmds[i], staged[i])
+		if response.Failed() {
+			tx.rollback()
+			return abandonBatch(cmds, results, i, response)
+		}
+		results[i] = response.WithID(cmds[i].ID)
+	}
+	return results
+}
+
+// abandonBatch fills in the replies of an atomic batch whose operation i
+// failed. The operations before it that were applied have been undone.
+func abandonBatch(cmds []protocol.Command, results []*protocol.Response, i int, failure *protocol.Response) []*protocol.Response {
+	for j := range cmds {
+		switch {
+		case j == i:
+			results[j] = failure.WithID(cmds[j].ID)
+		case results[j] != nil:
+			results[j] = errorResponse(http.StatusFailedDependency, protocol.CodeRolledBack,
+				"Error: Rolled back after operation %d failed", i).WithID(cmds[j].ID)
+		default:
+			results[j] = skippedResponse(&cmds[j])
+		}
+	}
+	return results
+}
+
+// skippedResponse is the reply to a batch operation that was not run
+func skippedResponse(cmd *protocol.Command) *protocol.Response {
+	return errorResponse(http.StatusFailedDependency, protocol.CodeSkipped, "Error: Skipped after an earlier failure").WithID(cmd.ID)
+}
+
+// cancelledResponse is the reply to a batch operation that was not run
+// because the batch was cancelled
+func cancelledResponse(cmd *protocol.Command) *protocol.Response {
+	return errorResponse(protocol.StatusCancelled, protocol.CodeCancelled, "Error: Batch was cancelled").WithID(cmd.ID)
+}
+
+// transaction applies the operations of an atomic batch and remembers how
+// to undo them
+type transaction struct {
+	server *Server
+
+	// Staging directory of each location, by location directory
+	staging map[string]string
+	names   int
+
+	undo []func() error
+}
+
+// stage writes an upload to the staging directory and returns where, and
+// checks the other operations as far as possible without applying them
+func (tx *transaction) stage(cmd *protocol.Command) (string, *protocol.Response) {
+	switch cmd.Type {
+	case "upload":
+		if _, failure := cleanCommandPath(cmd.Path); failure != nil {
+			return "", failure
+		}
+		rng, failure := parseTransferRange(cmd.Params)
+		if failure != nil {
+			return "", failure
+		}
+		if rng.resumable() {
+			return "", errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Resumable uploads cannot be part of an atomic batch")
+		}
+
+		staged, err := tx.stagingPath(tx.server.uploadPath)
+		if err == nil {
+			err = os.WriteFile(staged, cmd.Content, 0644)
+		}
+		if err != nil {
+			return "", fileErrorResponse("staging upload", err)
+		}
+		return staged, nil
+	case "delete", "mkdir":
+		_, failure := tx.server.resolveEntry(cmd, cmd.Path)
+		return "", failure
+	default:
+		return "", errorResponse(http.StatusBadRequest, protocol.CodeInvalidCommand, "Error: %s cannot be part of an atomic batch", cmd.Type)
+	}
+}
+
+// apply carries out a staged operation
+func (tx *transaction) apply(cmd *protocol.Command, staged string) *protocol.Response {
+	switch cmd.Type {
+	case "upload":
+		return tx.upload(cmd, staged)
+	case "delete":
+		return tx.delete(cmd)
+	default:
+		return tx.mkdir(cmd)
+	}
+}
+
+// upload renames a staged upload into place, moving aside any file it
+// replaces
+func (tx *transaction) upload(cmd *protocol.Command, staged string) *protocol.Response {
+	cleanPath, _ := cleanCommandPath(cmd.Path)
+	target := filepath.Join(tx.server.uploadPath, cleanPath)
+
+	if err := tx.mkdirAll(filepath.Dir(target)); err != nil {
+		return fileErrorResponse("creating directory", err)
+	}
+	if info, err := os.Lstat(target); err == nil {
+		if info.IsDir() {
+			return errorResponse(http.StatusConflict, protocol.CodeAlreadyExists, "Error writing file: %s is a directory", cmd.Path)
+		}
+		if err := tx.moveAside(tx.server.uploadPath, target); err != nil {
+			return fileErrorResponse("replacing file", err)
+		}
+	}
+
+	if err := os.Rename(staged, target); err != nil {
+		return fileErrorResponse("writing file", err)
+	}
+	tx.undo = append(tx.undo, func() error { return os.Remove(target) })
+
+	return newResponse(protocol.TypeUpload, &protocol.FileResult{Path: cmd.Path, Size: int64(len(cmd.Content))})
+}
+
+// delete moves a file or empty directory aside
+func (tx *transaction) delete(cmd *protocol.Command) *protocol.Response {
+	target, _ := tx.server.resolveEntry(cmd, cmd.Path)
+
+	info, err := os.Lstat(target)
+	if err != nil {
+		return fileErrorResponse("deleting file", err)
+	}
+	// Like a plain delete, only empty directories go
+	if info.IsDir() {
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			return fileErrorResponse("deleting file", err)
+		}
+		if len(entries) > 0 {
+			return errorResponse(http.StatusConflict, protocol.CodeNotEmpty, "Error deleting file: %s is not empty", cmd.Path)
+		}
+	}
+
+	if err := tx.moveAside(tx.server.basePath(cmd), target); err != nil {
+		return fileErrorResponse("deleting file", err)
+	}
+
+	return newResponse(protocol.TypeDelete, &protocol.FileResult{Path: cmd.Path})
+}
+
+// mkdir creates a directory, and its parents with Params["parents"] set
+func (tx *transaction) mkdir(cmd *protocol.Command) *protocol.Response {
+	target, _ := tx.server.resolveEntry(cmd, cmd.Path)
+
+	var err error
+	if cmd.Params["parents"] == "true" {
+		err = tx.mkdirAll(target)
+	} else {
+		err = tx.mkdirOne(target)
+	}
+	if err != nil {
+		return fileErrorResponse("creating directory", err)
+	}
+
+	return newResponse(protocol.TypeMkdir, &protocol.FileResult{Path: cmd.Path})
+}
+
+// mkdirAll creates dir and its missing parents
+func (tx *transaction) mkdirAll(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		_, err := os.Lstat(d)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) || filepath.Dir(d) == d {
+			return err
+		}
+		missing = append(missing, d)
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := tx.mkdirOne(missing[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdirOne creates a directory whose parent exists
+func (tx *transaction) mkdirOne(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() error { return os.Remove(dir) })
+	return nil
+}
+
+// moveAside renames an entry into the staging directory of its location
+func (tx *transaction) moveAside(base, target string) error {
+	aside, err := tx.stagingPath(base)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(target, aside); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() error { return os.Rename(aside, target) })
+	return nil
+}
+
+// stagingPath returns an unused name in the staging directory of the
+// location at base, creating the directory on first use
+func (tx *transaction) stagingPath(base string) (string, error) {
+	dir, ok := tx.staging[base]
+	if !ok {
+		root := stagingRoot(base)
+		if err := os.MkdirAll(root, 0700); err != nil {
+			return "", err
+		}
+		var err error
+		if dir, err = os.MkdirTemp(root, ""); err != nil {
+			return "", err
+		}
+		tx.staging[base] = dir
+	}
+
+	tx.names++
+	return filepath.Join(dir, strconv.Itoa(tx.names)), nil
+}
+
+// stagingRoot returns the directory holding the staging directories of
+// the location at base
+func stagingRoot(base string) string {
+	return filepath.Clean(base) + stagingSuffix
+}
+
+// removeStaging removes whatever batches left staged when the server
+// last stopped in the middle of them
+func (s *Server) removeStaging() {
+	for _, base := range []string{s.downloadPath, s.uploadPath} {
+		if err := os.RemoveAll(stagingRoot(base)); err != nil {
+			log.Printf("Failed to remove staging directory: %v", err)
+		}
+	}
+}
+
+// rollback undoes the applied operations, newest first
+func (tx *transaction) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if err := tx.undo[i](); err != nil {
+			log.Printf("Failed to roll back batch operation: %v", err)
+		}
+	}
+	tx.undo = nil
+}
+
+// close removes the staging directories, and with them whatever a
+// committed batch deleted or replaced
+func (tx *transaction) close() {
+	for _, dir := range tx.staging {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove staging directory: %v", err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package httpserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"file-sharing-utility/internal/common"
+	"file-sharing-utility/internal/protocol"
+)
+
+// Filesystem commands. Each works in the directory chosen by
+// Params["location"], like delete, and resolves every path it is given
+// through resolvePath. rename (or move) and copy take the destination in
+// Params["to"] and refuse to replace an existing file unless
+// Params["overwrite"] is "true".
+
+// resolvePath validates a path sent with a command and returns it joined
+// to the command's base directory
+func (s *Server) resolvePath(cmd *protocol.Command, path string) (string, *protocol.Response) {
+	cleanPath, failure := cleanCommandPath(path)
+	if failure != nil {
+		return "", failure
+	}
+	return filepath.Join(s.basePath(cmd), cleanPath), nil
+}
+
+// resolveEntry is resolvePath for commands that must not touch the base
+// directory itself
+func (s *Server) resolveEntry(cmd *protocol.Command, path string) (string, *protocol.Response) {
+	target, failure := s.resolvePath(cmd, path)
+	if failure != nil {
+		return "", failure
+	}
+	if target == filepath.Clean(s.basePath(cmd)) {
+		return "", errInvalidPath
+	}
+	return target, nil
+}
+
+// handleMkdirCommand creates a directory, and its parents with
+// Params["parents"] set
+func (s *Server) handleMkdirCommand(cmd *protocol.Command) *protocol.Response {
+	target, failure := s.resolveEntry(cmd, cmd.Path)
+	if failure != nil {
+		return failure
+	}
+
+	var err error
+	if cmd.Params["parents"] == "true" {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		err = os.Mkdir(target, 0755)
+	}
+	if err != nil {
+		return fileErrorResponse("creating directory", err)
+	}
+
+	return newResponse(protocol.TypeMkdir, &protocol.FileResult{Path: cmd.Path})
+}
+
+// handleRenameCommand moves a file or directory to Params["to"]
+func (s *Server) handleRenameCommand(cmd *protocol.Command) *protocol.Response {
+	from, to, failure := s.resolveMove(cmd)
+	if failure != nil {
+		return failure
+	}
+
+	if err := os.Rename(from, to); err != nil {
+		return fileErrorResponse("renaming file", err)
+	}
+
+	return newResponse(protocol.TypeRename, &protocol.MoveResult{From: cmd.Path, To: cmd.Params["to"]})
+}
+
+// handleCopyCommand copies a file to Params["to"]. Directories are copied
+// with everything below them when Params["recursive"] is "true".
+func (s *Server) handleCopyCommand(cmd *protocol.Command) *protocol.Response {
+	from, to, failure := s.resolveMove(cmd)
+	if failure != nil {
+		return failure
+	}
+
+	info, err := os.Stat(from)
+	if err != nil {
+		return fileErrorResponse("copying file", err)
+	}
+
+	var size int64
+	if info.IsDir() {
+		if cmd.Params["recursive"] != "true" {
+			return errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams,
+				"Error: %s is a directory, set recursive to copy it", cmd.Path)
+		}
+		size, err = common.CopyTree(to, from)
+	} else {
+		size, err = common.CopyFile(to, from)
+	}
+	if err != nil {
+		return fileErrorResponse("copying file", err)
+	}
+
+	return newResponse(protocol.TypeCopy, &protocol.MoveResult{From: cmd.Path, To: cmd.Params["to"], Size: size})
+}
+
+// resolveMove resolves the source and destination of a rename or copy and
+// checks the destination may be written
+func (s *Server) resolveMove(cmd *protocol.Command) (string, string, *protocol.Response) {
+	from, failure := s.resolveEntry(cmd, cmd.Path)
+	if failure != nil {
+		return "", "", failure
+	}
+	if cmd.Params["to"] == "" {
+		return "", "", errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Destination not specified")
+	}
+	to, failure := s.resolveEntry(cmd, cmd.Params["to"])
+	if failure != nil {
+		return "", "", failure
+	}
+
+	// A directory cannot go inside itself
+	if to == from || strings.HasPrefix(to, from+string(filepath.Separator)) {
+		return "", "", errorResponse(http.StatusBadRequest, protocol.CodeInvalidPath,
+			"Error: Cannot move %s into itself", cmd.Path)
+	}
+
+	info, err := os.Stat(to)
+	switch {
+	case os.IsNotExist(err):
+		return from, to, nil
+	case err != nil:
+		return "", "", fileErrorResponse("reading file", err)
+	case info.IsDir() || cmd.Params["overwrite"] != "true":
+		return "", "", errorResponse(http.StatusConflict, protocol.CodeAlreadyExists,
+			"Error: %s already exists", cmd.Params["to"])
+	}
+	return from, to, nil
+}
+
+// handleRmdirCommand removes an empty directory, or a directory and
+// everything in it when Params["recursive"] is "true"
+func (s *Server) handleRmdirCommand(cmd *protocol.Command) *protocol.Response {
+	target, failure := s.resolveEntry(cmd, cmd.Path)
+	if failure != nil {
+		return failure
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return fileErrorResponse("removing directory", err)
+	}
+	if !info.IsDir() {
+		return errorResponse(http.StatusBadRequest, protocol.CodeInvalidPath, "Error: %s is not a directory", cmd.Path)
+	}
+
+	if cmd.Params["recursive"] == "true" {
+		err = os.RemoveAll(target)
+	} else {
+		entries, readErr := os.ReadDir(target)
+		if readErr != nil {
+			return fileErrorResponse("removing directory", readErr)
+		}
+		if len(entries) > 0 {
+			return errorResponse(http.StatusConflict, protocol.CodeNotEmpty,
+				"Error: %s is not empty, set recursive to remove it", cmd.Path)
+		}
+		err = os.Remove(target)
+	}
+	if err != nil {
+		return fileErrorResponse("removing directory", err)
+	}
+
+	return newResponse(protocol.TypeRmdir, &protocol.FileResult{Path: cmd.Path})
+}
+
+// handleTouchCommand creates an empty file if there is none and sets its
+// modification time to Params["mtime"] (RFC 3339), or to now
+func (s *Server) handleTouchCommand(cmd *protocol.Command) *protocol.Response {
+	target, failure := s.resolveEntry(cmd, cmd.Path)
+	if failure != nil {
+		return failure
+	}
+
+	mtime := time.Now()
+	if value := cmd.Params["mtime"]; value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid mtime")
+		}
+		mtime = parsed
+	}
+
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fileErrorResponse("creating file", err)
+	}
+	file.Close()
+
+	if err := os.Chtimes(target, mtime, mtime); err != nil {
+		return fileErrorResponse("touching file", err)
+	}
+
+	return newResponse(protocol.TypeTouch, &protocol.FileResult{Path: cmd.Path})
+}
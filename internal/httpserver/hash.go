@@ -0,0 +1,270 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"file-sharing-utility/internal/protocol"
+)
+
+// Checksums. The hash command returns the checksum of a file, or of the
+// part of it selected by Params["offset"] and Params["length"]. The
+// manifest command returns the size, modification time and checksum of
+// every file below a directory. Both use Params["location"] like delete
+// and take Params["algorithm"]: md5, sha1, sha256 (the default) or blake2b
+// (BLAKE2b-512).
+//
+// Checksums of whole files are cached by path and algorithm, and reused
+// as long as the file's size and modification time are unchanged, so
+// asking for the manifest of a large tree again is cheap.
+
+const (
+	// defaultHashAlgorithm is used when a command names none
+	defaultHashAlgorithm = "sha256"
+
+	// maxHashCacheEntries caps the checksums kept in the cache
+	maxHashCacheEntries = 100000
+)
+
+// hashAlgorithms are the checksums the commands compute
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha1":    sha1.New,
+	"sha256":  sha256.New,
+	"blake2b": newBLAKE2b512,
+}
+
+// newBLAKE2b512 returns an unkeyed BLAKE2b-512 hash, which cannot fail
+func newBLAKE2b512() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+// hashCache remembers the checksums of whole files
+type hashCache struct {
+	lock    sync.Mutex
+	entries map[hashKey]hashEntry
+}
+
+type hashKey struct {
+	path      string
+	algorithm string
+}
+
+type hashEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// newHashCache creates an empty cache
+func newHashCache() *hashCache {
+	return &hashCache{entries: make(map[hashKey]hashEntry)}
+}
+
+// get returns the cached checksum of a file, if it has not changed since
+func (c *hashCache) get(path, algorithm string, info fs.FileInfo) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[hashKey{path, algorithm}]
+	if !ok || entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	return entry.sum, true
+}
+
+// put caches the checksum of a file as it was when info was taken
+func (c *hashCache) put(path, algorithm string, info fs.FileInfo, sum string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.entries) >= maxHashCacheEntries {
+		// Make room by dropping arbitrary entries
+		for key := range c.entries {
+			delete(c.entries, key)
+			if len(c.entries) < maxHashCacheEntries/2 {
+				break
+			}
+		}
+	}
+	c.entries[hashKey{path, algorithm}] = hashEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+}
+
+// hashAlgorithm returns the algorithm a command asks for
+func hashAlgorithm(params map[string]string) (string, *protocol.Response) {
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = defaultHashAlgorithm
+	}
+	if _, ok := hashAlgorithms[algorithm]; !ok {
+		return "", errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Unsupported algorithm %q", algorithm)
+	}
+	return algorithm, nil
+}
+
+// hashFile returns the checksum of length bytes of a file starting at
+// offset, giving up if ctx is cancelled
+func hashFile(ctx context.Context, path, algorithm string, offset, length int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := hashAlgorithms[algorithm]()
+	if _, err := io.Copy(h, contextReader(ctx, io.NewSectionReader(file, offset, length))); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// wholeFileHash returns the checksum of a whole file, from the cache if
+// the file is unchanged. It reports whether the cache was used.
+func (s *Server) wholeFileHash(ctx context.Context, path, algorithm string, info fs.FileInfo) (string, bool, error) {
+	if sum, ok := s.hashes.get(path, algorithm, info); ok {
+		return sum, true, nil
+	}
+
+	sum, err := hashFile(ctx, path, algorithm, 0, info.Size())
+	if err != nil {
+		return "", false, err
+	}
+	s.hashes.put(path, algorithm, info, sum)
+	return sum, false, nil
+}
+
+// handleHashCommand returns the checksum of a file or a part of it
+func (s *Server) handleHashCommand(ctx context.Context, cmd *protocol.Command) *protocol.Response {
+	algorithm, failure := hashAlgorithm(cmd.Params)
+	if failure != nil {
+		return failure
+	}
+	rng, failure := parseTransferRange(cmd.Params)
+	if failure != nil {
+		return failure
+	}
+	target, failure := s.resolvePath(cmd, cmd.Path)
+	if failure != nil {
+		return failure
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return fileErrorResponse("reading file", err)
+	}
+	if info.IsDir() {
+		return errorResponse(http.StatusBadRequest, protocol.CodeInvalidPath, "Error reading file: %s is a directory", cmd.Path)
+	}
+
+	offset, length, failure := rng.section(info.Size())
+	if failure != nil {
+		return failure
+	}
+
+	var sum string
+	if offset == 0 && length == info.Size() {
+		sum, _, err = s.wholeFileHash(ctx, target, algorithm, info)
+	} else {
+		sum, err = hashFile(ctx, target, algorithm, offset, length)
+	}
+	if err != nil {
+		return fileErrorResponse("reading file", err)
+	}
+
+	return newResponse(protocol.TypeHash, &protocol.HashResult{
+		Path:      cmd.Path,
+		Algorithm: algorithm,
+		Hash:      sum,
+		Offset:    offset,
+		Length:    length,
+		Size:      info.Size(),
+	})
+}
+
+// handleManifestCommand lists every file below a directory with its
+// checksum
+func (s *Server) handleManifestCommand(ctx context.Context, cmd *protocol.Command) *protocol.Response {
+	algorithm, failure := hashAlgorithm(cmd.Params)
+	if failure != nil {
+		return failure
+	}
+
+	dir := s.basePath(cmd)
+	if cmd.Path != "" {
+		resolved, failure := s.resolvePath(cmd, cmd.Path)
+		if failure != nil {
+			return failure
+		}
+		dir = resolved
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fileErrorResponse("reading directory", err)
+	}
+	if !info.IsDir() {
+		return errorResponse(http.StatusBadRequest, protocol.CodeInvalidPath, "Error reading directory: %s is not a directory", cmd.Path)
+	}
+
+	result := &protocol.ManifestResult{Path: cmd.Path, Algorithm: algorithm, Files: []protocol.ManifestEntry{}}
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if p == dir {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil || !d.Type().IsRegular() {
+			// Skip unreadable directories, and anything but plain files
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		sum, cached, err := s.wholeFileHash(ctx, p, algorithm, info)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since it was listed
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		result.Files = append(result.Files, protocol.ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Hash:    sum,
+		})
+		if cached {
+			result.Cached++
+		}
+		return nil
+	})
+	if err != nil {
+		return fileErrorResponse("reading directory", err)
+	}
+
+	return newResponse(protocol.TypeManifest, result)
+}
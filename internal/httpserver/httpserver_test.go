@@ -1,16 +1,33 @@
 package httpserver
 
 import (
+	"bufio"
 	"bytes"
-	"file-sharing-utility/internal/common"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"io"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"file-sharing-utility/internal/common"
+	"file-sharing-utility/internal/protocol"
+	"file-sharing-utility/internal/watch"
+	"file-sharing-utility/internal/xorrw"
+	"file-sharing-utility/internal/yamux"
 )
 
 func TestNewServer(t *testing.T) {
@@ -143,6 +160,109 @@ func TestDownloadHandler(t *testing.T) {
 	}
 }
 
+func TestDownloadRanges(t *testing.T) {
+	downloadDir := t.TempDir()
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	key := "secretkey"
+
+	// Store the file XOR encoded, the way the server expects it
+	encoded := &bytes.Buffer{}
+	xorrw.NewXorReaderWriter(encoded, []byte(key)).Write(content)
+	if err := os.WriteFile(filepath.Join(downloadDir, "file.bin"), encoded.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	server := NewServer(downloadDir, t.TempDir(), key)
+	get := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/download?file=file.bin", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		server.handleDownload(rr, req)
+		return rr
+	}
+
+	rr := get("GET", nil)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Fatalf("Expected the decoded file, got %d %q", rr.Code, rr.Body.Bytes())
+	}
+	etag := rr.Header().Get("ETag")
+	lastModified := rr.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" || rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Expected validators and Accept-Ranges, got %v", rr.Header())
+	}
+
+	// A range starting mid-key decodes correctly
+	rr = get("GET", map[string]string{"Range": "bytes=11-20"})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "bcdefghijk" {
+		t.Errorf("Expected 206 with bcdefghijk, got %d %q", rr.Code, rr.Body.String())
+	}
+	if cr := rr.Header().Get("Content-Range"); cr != "bytes 11-20/36" {
+		t.Errorf("Expected Content-Range bytes 11-20/36, got %s", cr)
+	}
+
+	rr = get("GET", map[string]string{"Range": "bytes=-3"})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "xyz" {
+		t.Errorf("Expected the last 3 bytes, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// Several ranges come back as multipart/byteranges
+	rr = get("GET", map[string]string{"Range": "bytes=0-2,30-32"})
+	mediaType, params, _ := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	if rr.Code != http.StatusPartialContent || mediaType != "multipart/byteranges" {
+		t.Fatalf("Expected a multipart reply, got %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	reader := multipart.NewReader(rr.Body, params["boundary"])
+	for _, want := range []struct{ rng, body string }{{"bytes 0-2/36", "012"}, {"bytes 30-32/36", "uvw"}} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("Failed to read part: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != want.rng || string(body) != want.body {
+			t.Errorf("Expected %s %q, got %s %q", want.rng, want.body, part.Header.Get("Content-Range"), body)
+		}
+	}
+
+	rr = get("GET", map[string]string{"Range": "bytes=100-"})
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected 416 for a range past the end, got %d", rr.Code)
+	}
+
+	// Validators that still match get a 304
+	for _, headers := range []map[string]string{
+		{"If-None-Match": etag},
+		{"If-Modified-Since": lastModified},
+	} {
+		if rr = get("GET", headers); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+			t.Errorf("%v: expected 304, got %d", headers, rr.Code)
+		}
+	}
+	if rr = get("GET", map[string]string{"If-None-Match": `"other"`}); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a stale ETag, got %d", rr.Code)
+	}
+
+	// If-Range with a stale ETag ignores the range
+	rr = get("GET", map[string]string{"Range": "bytes=0-2", "If-Range": `"other"`})
+	if rr.Code != http.StatusOK || rr.Body.Len() != len(content) {
+		t.Errorf("Expected the whole file for a stale If-Range, got %d", rr.Code)
+	}
+
+	rr = get("HEAD", nil)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 || rr.Header().Get("Content-Length") != "36" {
+		t.Errorf("Expected headers only for HEAD, got %d %v", rr.Code, rr.Header())
+	}
+
+	// A different key means different bytes, so a different ETag
+	other := NewServer(downloadDir, t.TempDir(), "otherkey")
+	rr = httptest.NewRecorder()
+	other.handleDownload(rr, httptest.NewRequest("GET", "/download?file=file.bin", nil))
+	if rr.Header().Get("ETag") == etag {
+		t.Errorf("Expected the ETag to depend on the key")
+	}
+}
+
 func createMultipartRequest(t *testing.T, fieldName, fileName string, fileContent []byte) (*http.Request, string) {
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
@@ -235,7 +355,1786 @@ func TestUploadHandler(t *testing.T) {
 }
 
 // Skip TestListFilesHandler as it's not implemented in the server
-// Skip TestYamuxHandler as it requires yamux package which might not be properly set up
+
+// dialYamux performs the yamux upgrade against a test server and returns
+// a client session on the hijacked connection
+func dialYamux(t *testing.T, addr string) *yamux.Session {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+
+	req := "GET /yamux HTTP/1.1\r\nHost: " + addr + "\r\nUpgrade: yamux\r\nConnection: Upgrade\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("Failed to send upgrade request: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Failed to read upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status %d, got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	rwc := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{br, conn, conn}
+
+	config := yamux.NewConfig()
+	config.EnableKeepAlive = false
+	session, err := yamux.Client(rwc, config)
+	if err != nil {
+		t.Fatalf("Failed to create yamux client: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	return session
+}
+
+// writeCommand sends a length-prefixed command on a yamux stream
+func writeCommand(t *testing.T, w io.Writer, cmd *protocol.Command) {
+	t.Helper()
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("Failed to encode command: %v", err)
+	}
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(data)))
+	if _, err := w.Write(append(length[:], data...)); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+}
+
+func TestYamuxHandler(t *testing.T) {
+	server := NewServer(t.TempDir(), t.TempDir(), "")
+	server.SetupYamux()
+
+	ts := httptest.NewServer(server.mux)
+	defer ts.Close()
+
+	session := dialYamux(t, ts.Listener.Addr().String())
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer stream.Close()
+
+	writeCommand(t, stream, &protocol.Command{Type: "info"})
+
+	var info common.Info
+	resp := readResponse(t, stream, &info)
+	if resp.Status != http.StatusOK || resp.Type != protocol.TypeInfo {
+		t.Fatalf("Expected info reply, got %+v", resp)
+	}
+	if hostname, _ := os.Hostname(); info.Hostname != hostname {
+		t.Errorf("Expected hostname %q, got %q", hostname, info.Hostname)
+	}
+}
+
+func TestStatusReportsYamuxRTT(t *testing.T) {
+	server := NewServer(t.TempDir(), t.TempDir(), "")
+	server.SetupYamux()
+
+	ts := httptest.NewServer(server.mux)
+	defer ts.Close()
+
+	dialYamux(t, ts.Listener.Addr().String())
+
+	// The server's keep-alive measures the RTT as soon as the session starts
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		server.handleStatus(rr, httptest.NewRequest("GET", "/status", nil))
+		body := rr.Body.String()
+
+		if strings.Contains(body, "Yamux Sessions: 1") &&
+			strings.Contains(body, "Yamux RTT (") && !strings.Contains(body, "unknown") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Status never reported the session RTT:\n%s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionsHandler(t *testing.T) {
+	server := NewServer(t.TempDir(), t.TempDir(), "")
+	server.SetupYamux()
+
+	ts := httptest.NewServer(server.mux)
+	defer ts.Close()
+
+	// The endpoint is off by default
+	resp, err := http.Get(ts.URL + "/admin/sessions")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status %d while disabled, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	server.SetAdminEnabled(true)
+
+	session := dialYamux(t, ts.Listener.Addr().String())
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer stream.Close()
+
+	resp, err = http.Get(ts.URL + "/admin/sessions")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var sessions []sessionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(sessions))
+	}
+	if sessions[0].Stats.TotalStreams != 1 || len(sessions[0].Streams) != 1 {
+		t.Errorf("Expected the open stream to be listed, got %+v", sessions[0])
+	}
+	if !strings.HasPrefix(sessions[0].RemoteAddr, "127.0.0.1:") {
+		t.Errorf("Expected the client's TCP address, got %s", sessions[0].RemoteAddr)
+	}
+}
+
+// readFrame reads a length-prefixed JSON frame into v
+func readFrame(t *testing.T, r io.Reader, v interface{}) {
+	t.Helper()
+
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		t.Fatalf("Failed to read frame length: %v", err)
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("Failed to decode frame %q: %v", data, err)
+	}
+}
+
+// readResponse reads a reply envelope, decoding its payload into data
+func readResponse(t *testing.T, r io.Reader, data interface{}) *protocol.Response {
+	t.Helper()
+
+	resp := &protocol.Response{Data: data}
+	readFrame(t, r, resp)
+	return resp
+}
+
+// openCommandStream starts a yamux test server and opens a stream on it
+func openCommandStream(t *testing.T, server *Server) *yamux.Stream {
+	t.Helper()
+
+	server.SetupYamux()
+	ts := httptest.NewServer(server.mux)
+	t.Cleanup(ts.Close)
+
+	session := dialYamux(t, ts.Listener.Addr().String())
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	t.Cleanup(func() { stream.Close() })
+	return stream
+}
+
+func TestYamuxUploadStream(t *testing.T) {
+	uploadDir := t.TempDir()
+	stream := openCommandStream(t, NewServer(t.TempDir(), uploadDir, ""))
+
+	// Several megabytes so the data spans many frames and windows
+	payload := bytes.Repeat([]byte("streamed upload "), 256*1024)
+	sum := sha256.Sum256(payload)
+
+	writeCommand(t, stream, &protocol.Command{
+		Type:   "upload_stream",
+		Path:   "nested/big.bin",
+		Params: map[string]string{"size": strconv.Itoa(len(payload))},
+	})
+	if _, err := stream.Write(payload); err != nil {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+
+	var status protocol.TransferStatus
+	if resp := readResponse(t, stream, &status); resp.Type != protocol.TypeTransferStatus {
+		t.Fatalf("Upload failed: %+v", resp)
+	}
+	if status.Size != int64(len(payload)) || status.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	data, err := os.ReadFile(filepath.Join(uploadDir, "nested", "big.bin"))
+	if err != nil {
+		t.Fatalf("Failed to read uploaded file: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Error("Uploaded file does not match the data sent")
+	}
+}
+
+func TestYamuxUploadStreamErrorKeepsStream(t *testing.T) {
+	stream := openCommandStream(t, NewServer(t.TempDir(), t.TempDir(), ""))
+
+	writeCommand(t, stream, &protocol.Command{
+		Type:   "upload_stream",
+		Path:   "../escape.bin",
+		Params: map[string]string{"size": "5"},
+	})
+	stream.Write([]byte("hello"))
+
+	resp := readResponse(t, stream, nil)
+	if resp.Status != http.StatusBadRequest || resp.Code != protocol.CodeInvalidPath {
+		t.Errorf("Expected invalid path error, got %+v", resp)
+	}
+
+	// The announced bytes were skipped, so the next command is understood
+	writeCommand(t, stream, &protocol.Command{Type: "info"})
+	if resp := readResponse(t, stream, nil); resp.Type != protocol.TypeInfo {
+		t.Errorf("Expected info reply, got %+v", resp)
+	}
+}
+
+func TestYamuxDownloadStream(t *testing.T) {
+	downloadDir := t.TempDir()
+	payload := bytes.Repeat([]byte("streamed download "), 256*1024)
+	if err := os.WriteFile(filepath.Join(downloadDir, "big.bin"), payload, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	stream := openCommandStream(t, NewServer(downloadDir, t.TempDir(), ""))
+
+	writeCommand(t, stream, &protocol.Command{Type: "download_stream", Path: "big.bin"})
+
+	var header protocol.TransferHeader
+	resp := readResponse(t, stream, &header)
+	if resp.Type != protocol.TypeTransferHeader || header.Size != int64(len(payload)) {
+		t.Fatalf("Unexpected header %+v", resp)
+	}
+
+	hash := sha256.New()
+	data := make([]byte, header.Size)
+	if _, err := io.ReadFull(io.TeeReader(stream, hash), data); err != nil {
+		t.Fatalf("Failed to read data: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Error("Downloaded data does not match the file")
+	}
+
+	var status protocol.TransferStatus
+	readResponse(t, stream, &status)
+	if status.SHA256 != hex.EncodeToString(hash.Sum(nil)) {
+		t.Errorf("Checksum %s does not match the data received", status.SHA256)
+	}
+
+	// A missing file only fails the header
+	writeCommand(t, stream, &protocol.Command{Type: "download_stream", Path: "missing.bin"})
+	resp = readResponse(t, stream, nil)
+	if resp.Code != protocol.CodeNotFound || !strings.HasPrefix(resp.Error, "Error reading file") {
+		t.Errorf("Expected a not found error, got %+v", resp)
+	}
+}
+
+func TestYamuxListCommand(t *testing.T) {
+	downloadDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(downloadDir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(downloadDir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	stream := openCommandStream(t, NewServer(downloadDir, t.TempDir(), ""))
+
+	writeCommand(t, stream, &protocol.Command{ID: "req-1", Type: "list"})
+
+	var list protocol.ListResult
+	resp := readResponse(t, stream, &list)
+	if resp.ID != "req-1" || resp.Status != http.StatusOK || resp.Type != protocol.TypeList {
+		t.Fatalf("Unexpected reply %+v", resp)
+	}
+	if len(list.Entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", list.Entries)
+	}
+	file, dir := list.Entries[0], list.Entries[1]
+	if file.Name != "a.txt" || file.IsDir || file.Size != 5 || file.ModTime.IsZero() {
+		t.Errorf("Unexpected file entry %+v", file)
+	}
+	if dir.Name != "sub" || !dir.IsDir {
+		t.Errorf("Unexpected directory entry %+v", dir)
+	}
+}
+
+func TestYamuxCommandErrors(t *testing.T) {
+	stream := openCommandStream(t, NewServer(t.TempDir(), t.TempDir(), ""))
+
+	tests := []struct {
+		cmd    *protocol.Command
+		status int
+		code   string
+	}{
+		{&protocol.Command{ID: "1", Type: "download", Path: "missing.txt"}, http.StatusNotFound, protocol.CodeNotFound},
+		{&protocol.Command{ID: "2", Type: "download"}, http.StatusBadRequest, protocol.CodeMissingPath},
+		{&protocol.Command{ID: "3", Type: "delete", Path: "../outside"}, http.StatusBadRequest, protocol.CodeInvalidPath},
+		{&protocol.Command{ID: "4", Type: "bogus"}, http.StatusBadRequest, protocol.CodeInvalidCommand},
+	}
+
+	for _, tt := range tests {
+		writeCommand(t, stream, tt.cmd)
+		resp := readResponse(t, stream, nil)
+		if resp.ID != tt.cmd.ID || resp.Status != tt.status || resp.Code != tt.code || resp.Error == "" {
+			t.Errorf("%s: expected %d %s, got %+v", tt.cmd.Type, tt.status, tt.code, resp)
+		}
+	}
+
+	// A frame that is not JSON is answered and the stream stays usable
+	stream.Write([]byte{5, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'})
+	if resp := readResponse(t, stream, nil); resp.Code != protocol.CodeInvalidCommand {
+		t.Errorf("Expected invalid command error, got %+v", resp)
+	}
+	writeCommand(t, stream, &protocol.Command{Type: "info"})
+	if resp := readResponse(t, stream, nil); resp.Type != protocol.TypeInfo {
+		t.Errorf("Expected info reply, got %+v", resp)
+	}
+}
+
+func TestYamuxResumableUpload(t *testing.T) {
+	uploadDir := t.TempDir()
+	server := NewServer(t.TempDir(), uploadDir, "")
+	stream := openCommandStream(t, server)
+	target := filepath.Join(uploadDir, "resume.bin")
+	sum := sha256.Sum256([]byte("hello world"))
+
+	upload := func(content string, params map[string]string) (*protocol.Response, *protocol.FileResult) {
+		t.Helper()
+		writeCommand(t, stream, &protocol.Command{Type: "upload", Path: "resume.bin", Content: []byte(content), Params: params})
+		var result protocol.FileResult
+		return readResponse(t, stream, &result), &result
+	}
+
+	upload("hello", map[string]string{"offset": "0"})
+
+	// A gap after the data received is refused
+	if resp, _ := upload("xyz", map[string]string{"offset": "9"}); resp.Code != protocol.CodeOffsetMismatch {
+		t.Errorf("Expected offset mismatch, got %+v", resp)
+	}
+
+	// Resending from an earlier offset overwrites the tail
+	resp, result := upload(" worXX", map[string]string{"offset": "5"})
+	if resp.Status != http.StatusOK || result.Size != 11 {
+		t.Fatalf("Unexpected reply %+v %+v", resp, result)
+	}
+	upload("ld", map[string]string{"offset": "9"})
+
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("Expected no file before the commit, got %v", err)
+	}
+
+	writeCommand(t, stream, &protocol.Command{Type: "stat", Path: "resume.bin", Params: map[string]string{"location": "upload", "partial": "true"}})
+	var stat protocol.StatResult
+	readResponse(t, stream, &stat)
+	if !stat.Partial || stat.Size != 11 || stat.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected stat %+v", stat)
+	}
+
+	// A wrong checksum keeps the part
+	if resp, _ := upload("", map[string]string{"commit": "true", "sha256": "00"}); resp.Code != protocol.CodeChecksumMismatch {
+		t.Errorf("Expected checksum mismatch, got %+v", resp)
+	}
+
+	resp, result = upload("", map[string]string{"commit": "true", "sha256": hex.EncodeToString(sum[:])})
+	if resp.Status != http.StatusOK || !result.Committed {
+		t.Fatalf("Commit failed: %+v", resp)
+	}
+
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("Expected %q, got %q", "hello world", data)
+	}
+	if _, err := os.Stat(server.partPath("resume.bin")); !os.IsNotExist(err) {
+		t.Errorf("Expected the part to be gone, got %v", err)
+	}
+}
+
+func TestYamuxPartFilesOutsideUploads(t *testing.T) {
+	uploadDir := t.TempDir()
+	stream := openCommandStream(t, NewServer(t.TempDir(), uploadDir, ""))
+
+	upload := func(path, content string, params map[string]string) *protocol.Response {
+		t.Helper()
+		writeCommand(t, stream, &protocol.Command{Type: "upload", Path: path, Content: []byte(content), Params: params})
+		return readResponse(t, stream, nil)
+	}
+
+	// A file named like a part file does not touch the upload in progress
+	upload("data.bin", "resumed", map[string]string{"offset": "0"})
+	if resp := upload("data.bin.part", "other", nil); resp.Status != http.StatusOK {
+		t.Fatalf("Upload failed: %+v", resp)
+	}
+	if resp := upload("data.bin", "", map[string]string{"commit": "true"}); resp.Status != http.StatusOK {
+		t.Fatalf("Commit failed: %+v", resp)
+	}
+
+	for name, expected := range map[string]string{"data.bin": "resumed", "data.bin.part": "other"} {
+		data, err := os.ReadFile(filepath.Join(uploadDir, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		if string(data) != expected {
+			t.Errorf("Expected %s to hold %q, got %q", name, expected, data)
+		}
+	}
+}
+
+func TestYamuxPartFileLocked(t *testing.T) {
+	server := NewServer(t.TempDir(), t.TempDir(), "")
+	stream := openCommandStream(t, server)
+
+	// Another request is writing to the part file
+	key := filepath.Base(server.partPath("data.bin"))
+	server.tus.acquire(key)
+
+	cmd := &protocol.Command{Type: "upload", Path: "data.bin", Content: []byte("chunk"), Params: map[string]string{"offset": "0"}}
+	writeCommand(t, stream, cmd)
+	if resp := readResponse(t, stream, nil); resp.Status != http.StatusLocked || resp.Code != protocol.CodeLocked {
+		t.Fatalf("Expected the part file to be locked, got %+v", resp)
+	}
+
+	server.tus.release(key)
+	writeCommand(t, stream, cmd)
+	if resp := readResponse(t, stream, nil); resp.Status != http.StatusOK {
+		t.Errorf("Expected the upload to succeed, got %+v", resp)
+	}
+}
+
+func TestYamuxResumableUploadStream(t *testing.T) {
+	uploadDir := t.TempDir()
+	server := NewServer(t.TempDir(), uploadDir, "")
+	part := server.partPath("big.bin")
+	if err := os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+		t.Fatalf("Failed to create parts directory: %v", err)
+	}
+	if err := os.WriteFile(part, []byte("first half,"), 0644); err != nil {
+		t.Fatalf("Failed to create part: %v", err)
+	}
+	stream := openCommandStream(t, server)
+
+	rest := []byte(" second half")
+	writeCommand(t, stream, &protocol.Command{
+		Type:   "upload_stream",
+		Path:   "big.bin",
+		Params: map[string]string{"size": strconv.Itoa(len(rest)), "offset": "11", "commit": "true"},
+	})
+	stream.Write(rest)
+
+	var status protocol.TransferStatus
+	if resp := readResponse(t, stream, &status); resp.Status != http.StatusOK {
+		t.Fatalf("Upload failed: %+v", resp)
+	}
+	sum := sha256.Sum256([]byte("first half, second half"))
+	if !status.Committed || status.Size != 23 || status.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestYamuxDownloadRange(t *testing.T) {
+	downloadDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(downloadDir, "file.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	stream := openCommandStream(t, NewServer(downloadDir, t.TempDir(), ""))
+
+	writeCommand(t, stream, &protocol.Command{Type: "download", Path: "file.txt", Params: map[string]string{"offset": "3", "length": "4"}})
+	var data protocol.FileData
+	readResponse(t, stream, &data)
+	if string(data.Content) != "3456" || data.Offset != 3 || data.Size != 10 {
+		t.Errorf("Unexpected data %+v", data)
+	}
+
+	writeCommand(t, stream, &protocol.Command{Type: "download_stream", Path: "file.txt", Params: map[string]string{"offset": "6"}})
+	var header protocol.TransferHeader
+	readResponse(t, stream, &header)
+	if header.Size != 4 || header.Offset != 6 {
+		t.Fatalf("Unexpected header %+v", header)
+	}
+	rest := make([]byte, header.Size)
+	if _, err := io.ReadFull(stream, rest); err != nil {
+		t.Fatalf("Failed to read data: %v", err)
+	}
+	if string(rest) != "6789" {
+		t.Errorf("Expected %q, got %q", "6789", rest)
+	}
+	readResponse(t, stream, nil)
+
+	writeCommand(t, stream, &protocol.Command{Type: "download", Path: "file.txt", Params: map[string]string{"offset": "11"}})
+	if resp := readResponse(t, stream, nil); resp.Code != protocol.CodeInvalidRange {
+		t.Errorf("Expected invalid range, got %+v", resp)
+	}
+}
+
+func TestYamuxFilesystemCommands(t *testing.T) {
+	uploadDir := t.TempDir()
+	stream := openCommandStream(t, NewServer(t.TempDir(), uploadDir, ""))
+
+	run := func(cmdType, path string, params map[string]string) *protocol.Response {
+		t.Helper()
+		if params == nil {
+			params = map[string]string{}
+		}
+		params["location"] = "upload"
+		writeCommand(t, stream, &protocol.Command{Type: cmdType, Path: path, Params: params})
+		return readResponse(t, stream, nil)
+	}
+	expect := func(resp *protocol.Response, code string) {
+		t.Helper()
+		if resp.Code != code {
+			t.Errorf("Expected code %q, got %+v", code, resp)
+		}
+	}
+
+	expect(run("mkdir", "a/b", nil), protocol.CodeNotFound)
+	expect(run("mkdir", "a/b", map[string]string{"parents": "true"}), "")
+	expect(run("mkdir", "a", nil), protocol.CodeAlreadyExists)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	expect(run("touch", "a/b/file.txt", map[string]string{"mtime": mtime.Format(time.RFC3339)}), "")
+	info, err := os.Stat(filepath.Join(uploadDir, "a", "b", "file.txt"))
+	if err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("Expected touched file with mtime %v, got %v", mtime, err)
+	}
+
+	expect(run("copy", "a", map[string]string{"to": "c"}), protocol.CodeInvalidParams)
+	expect(run("copy", "a", map[string]string{"to": "a/b/inside", "recursive": "true"}), protocol.CodeInvalidPath)
+	expect(run("copy", "a", map[string]string{"to": "c", "recursive": "true"}), "")
+	if _, err := os.Stat(filepath.Join(uploadDir, "c", "b", "file.txt")); err != nil {
+		t.Errorf("Expected the tree to be copied: %v", err)
+	}
+
+	expect(run("touch", "d.txt", nil), "")
+	expect(run("rename", "d.txt", map[string]string{"to": "c/b/file.txt"}), protocol.CodeAlreadyExists)
+	expect(run("move", "d.txt", map[string]string{"to": "c/b/file.txt", "overwrite": "true"}), "")
+	expect(run("rename", "c", map[string]string{"to": "e"}), "")
+
+	expect(run("rmdir", "e/b/file.txt", nil), protocol.CodeInvalidPath)
+	expect(run("rmdir", "e", nil), protocol.CodeNotEmpty)
+	expect(run("rmdir", "e", map[string]string{"recursive": "true"}), "")
+	expect(run("rmdir", ".", map[string]string{"recursive": "true"}), protocol.CodeInvalidPath)
+	expect(run("rename", "../x", map[string]string{"to": "y"}), protocol.CodeInvalidPath)
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "a" {
+		t.Errorf("Expected only a to remain, got %v", entries)
+	}
+
+	writeCommand(t, stream, &protocol.Command{Type: "stat", Path: "a", Params: map[string]string{"location": "upload"}})
+	var stat protocol.StatResult
+	readResponse(t, stream, &stat)
+	if !stat.IsDir || !strings.HasPrefix(stat.Mode, "d") || stat.SHA256 != "" {
+		t.Errorf("Unexpected stat %+v", stat)
+	}
+}
+
+// listTree creates a small directory tree for the listing tests
+func listTree(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	base := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []struct {
+		path  string
+		size  int
+		mtime int
+	}{
+		{"a.txt", 1, 3},
+		{"b.log", 3, 1},
+		{"sub/c.txt", 2, 2},
+		{"sub/deep/d.txt", 4, 4},
+		{"skip/e.txt", 5, 5},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, bytes.Repeat([]byte("x"), f.size), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		mtime := base.Add(time.Duration(f.mtime) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("Failed to set mtime: %v", err)
+		}
+	}
+	return dir
+}
+
+// getListing requests /list with the given query and decodes the reply
+func getListing(t *testing.T, server *Server, query string) (int, *protocol.ListResult, *protocol.Response) {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/list?"+query, nil))
+
+	if rr.Code != http.StatusOK {
+		var resp protocol.Response
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode error %q: %v", rr.Body.String(), err)
+		}
+		return rr.Code, nil, &resp
+	}
+
+	var result protocol.ListResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode listing %q: %v", rr.Body.String(), err)
+	}
+	return rr.Code, &result, nil
+}
+
+func entryNames(entries []protocol.FileEntry) string {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestListHandlerOptions(t *testing.T) {
+	server := NewServer(listTree(t), t.TempDir(), "")
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"", "a.txt,b.log,skip,sub"},
+		{"recursive=true&include=*.txt", "a.txt,skip/e.txt,sub/c.txt,sub/deep/d.txt"},
+		{"depth=2&include=*.txt&exclude=skip", "a.txt,sub/c.txt"},
+		{"recursive=true&include=sub/*", "sub/c.txt,sub/deep"},
+		{"recursive=true&include_regex=\\.(txt|log)$&exclude_regex=^skip/&sort=size&order=desc", "sub/deep/d.txt,b.log,sub/c.txt,a.txt"},
+		{"recursive=true&exclude_regex=^skip&include=*.*&sort=mtime", "b.log,sub/c.txt,a.txt,sub/deep/d.txt"},
+		{"path=sub&sort=name&order=desc", "deep,c.txt"},
+	}
+	for _, tt := range tests {
+		status, result, resp := getListing(t, server, tt.query)
+		if status != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %+v", tt.query, http.StatusOK, resp)
+			continue
+		}
+		if names := entryNames(result.Entries); names != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.query, tt.expected, names)
+		}
+	}
+
+	for _, query := range []string{"sort=bogus", "depth=0", "include=[", "include_regex=(", "cursor=nonsense", "path=a.txt"} {
+		status, _, resp := getListing(t, server, query)
+		if status != http.StatusBadRequest || resp.Code == "" {
+			t.Errorf("%s: expected a bad request, got %d %+v", query, status, resp)
+		}
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	server := NewServer(listTree(t), t.TempDir(), "")
+
+	for _, order := range []string{"sort=name", "sort=size&order=desc", "sort=mtime"} {
+		_, all, _ := getListing(t, server, "recursive=true&"+order)
+
+		var paged []protocol.FileEntry
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(all.Entries) {
+				t.Fatalf("%s: pagination does not end", order)
+			}
+			_, page, resp := getListing(t, server, "recursive=true&limit=3&"+order+"&cursor="+cursor)
+			if page == nil {
+				t.Fatalf("%s: page failed: %+v", order, resp)
+			}
+			paged = append(paged, page.Entries...)
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+
+		if entryNames(paged) != entryNames(all.Entries) {
+			t.Errorf("%s: expected %s, got %s", order, entryNames(all.Entries), entryNames(paged))
+		}
+	}
+
+	// A cursor only fits the order it was made for
+	_, page, _ := getListing(t, server, "recursive=true&limit=1")
+	if status, _, _ := getListing(t, server, "sort=size&cursor="+page.NextCursor); status != http.StatusBadRequest {
+		t.Errorf("Expected a cursor for another order to be refused, got %d", status)
+	}
+}
+
+func TestPageHeapKeepsFirstEntries(t *testing.T) {
+	// Sizes descending, names breaking the tie between the two 9s
+	opts := &listOptions{sortBy: "size", desc: true}
+	page := &pageHeap{opts: opts}
+	for i, size := range []int64{5, 9, 1, 7, 9, 3, 8, 2} {
+		page.add(protocol.FileEntry{Name: strconv.Itoa(i), Size: size}, 4)
+	}
+
+	entries := page.entries
+	sort.Slice(entries, func(i, j int) bool { return opts.less(entries[i], entries[j]) })
+	if names := entryNames(entries); names != "4,1,6,3" {
+		t.Errorf("Expected the first four entries 4,1,6,3, got %s", names)
+	}
+}
+
+func TestYamuxListRecursive(t *testing.T) {
+	stream := openCommandStream(t, NewServer(listTree(t), t.TempDir(), ""))
+
+	writeCommand(t, stream, &protocol.Command{Type: "list", Path: "sub", Params: map[string]string{"recursive": "true", "limit": "2"}})
+
+	var list protocol.ListResult
+	readResponse(t, stream, &list)
+	if names := entryNames(list.Entries); names != "c.txt,deep" || list.NextCursor == "" {
+		t.Fatalf("Unexpected first page %s (cursor %q)", names, list.NextCursor)
+	}
+
+	writeCommand(t, stream, &protocol.Command{Type: "list", Path: "sub", Params: map[string]string{"recursive": "true", "cursor": list.NextCursor}})
+	list = protocol.ListResult{}
+	readResponse(t, stream, &list)
+	if names := entryNames(list.Entries); names != "deep/d.txt" || list.NextCursor != "" {
+		t.Errorf("Unexpected last page %s (cursor %q)", names, list.NextCursor)
+	}
+}
+
+func TestPipelineErrors(t *testing.T) {
+	stream := openCommandStream(t, NewServer(t.TempDir(), t.TempDir(), ""))
+
+	writeCommand(t, stream, &protocol.Command{ID: "p", Type: "pipeline"})
+	if resp := readResponse(t, stream, nil); resp.ID != "p" || resp.Type != protocol.TypePipeline {
+		t.Fatalf("Expected pipelined mode, got %+v", resp)
+	}
+
+	tests := []struct {
+		cmd  *protocol.Command
+		code string
+	}{
+		{&protocol.Command{Type: "info"}, protocol.CodeInvalidCommand},
+		{&protocol.Command{ID: "1", Type: "download_stream", Path: "file"}, protocol.CodeInvalidCommand},
+		{&protocol.Command{ID: "2", Type: "cancel", Params: map[string]string{"id": "missing"}}, protocol.CodeNotFound},
+		{&protocol.Command{ID: "3", Type: "stat", Path: "missing"}, protocol.CodeNotFound},
+		{&protocol.Command{ID: "4", Type: "watch"}, protocol.CodeInvalidCommand},
+	}
+	for _, tt := range tests {
+		writeCommand(t, stream, tt.cmd)
+		if resp := readResponse(t, stream, nil); resp.ID != tt.cmd.ID || resp.Code != tt.code {
+			t.Errorf("%s: expected code %s, got %+v", tt.cmd.Type, tt.code, resp)
+		}
+	}
+
+	// Everything in flight is answered before the stream closes
+	for i := 0; i < 20; i++ {
+		writeCommand(t, stream, &protocol.Command{ID: strconv.Itoa(i), Type: "info"})
+	}
+	stream.CloseWrite()
+
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		resp := readResponse(t, stream, nil)
+		if resp.Type != protocol.TypeInfo || seen[resp.ID] {
+			t.Fatalf("Unexpected reply %+v", resp)
+		}
+		seen[resp.ID] = true
+	}
+}
+
+func TestYamuxWatch(t *testing.T) {
+	dir := t.TempDir()
+	stream := openCommandStream(t, NewServer(dir, t.TempDir(), ""))
+
+	// A refused watch leaves the stream usable
+	writeCommand(t, stream, &protocol.Command{ID: "bad", Type: "watch", Path: "missing"})
+	if resp := readResponse(t, stream, nil); resp.ID != "bad" || resp.Code != protocol.CodeNotFound {
+		t.Fatalf("Expected not_found, got %+v", resp)
+	}
+
+	var result protocol.WatchResult
+	writeCommand(t, stream, &protocol.Command{ID: "w", Type: "watch", Params: map[string]string{"debounce": "20"}})
+	if resp := readResponse(t, stream, &result); resp.ID != "w" || resp.Type != protocol.TypeWatch || result.Backend == "" {
+		t.Fatalf("Expected a watch reply, got %+v", resp)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "new.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var event watch.Event
+	resp := readResponse(t, stream, &event)
+	if resp.ID != "w" || resp.Type != protocol.TypeWatchEvent {
+		t.Fatalf("Expected a watch event, got %+v", resp)
+	}
+	if event.Op != watch.Create || event.Path != "new.txt" || event.Size != 5 {
+		t.Errorf("Expected creation of new.txt with 5 bytes, got %+v", event)
+	}
+
+	// Closing our side ends the feed
+	stream.CloseWrite()
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(stream); err != nil {
+		t.Errorf("Expected the server to close the stream, got %v", err)
+	}
+}
+
+func TestWatchLimit(t *testing.T) {
+	server := NewServer(t.TempDir(), t.TempDir(), "")
+	server.SetMaxWatchers(1)
+
+	first := openCommandStream(t, server)
+	writeCommand(t, first, &protocol.Command{ID: "1", Type: "watch"})
+	if resp := readResponse(t, first, nil); resp.Type != protocol.TypeWatch {
+		t.Fatalf("Expected a watch reply, got %+v", resp)
+	}
+
+	ts := httptest.NewServer(server.mux)
+	defer ts.Close()
+	second, err := dialYamux(t, ts.Listener.Addr().String()).OpenStream()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer second.Close()
+	writeCommand(t, second, &protocol.Command{ID: "2", Type: "watch"})
+	resp := readResponse(t, second, nil)
+	if resp.Status != http.StatusTooManyRequests || resp.Code != protocol.CodeTooManyWatches {
+		t.Fatalf("Expected too_many_watches, got %+v", resp)
+	}
+
+	// Ending the first watch makes room for another
+	first.CloseWrite()
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.ReadAll(first)
+
+	writeCommand(t, second, &protocol.Command{ID: "3", Type: "watch"})
+	if resp := readResponse(t, second, nil); resp.Type != protocol.TypeWatch {
+		t.Errorf("Expected a watch reply, got %+v", resp)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	dir := t.TempDir()
+	server := NewServer(dir, t.TempDir(), "")
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events?path=missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing directory, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/events?debounce=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", ct)
+	}
+
+	// readEvent returns the name and data of the next event
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() (string, string) {
+		var name, data string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read event: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && name != "":
+				return name, data
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+
+	if name, _ := readEvent(); name != protocol.TypeWatch {
+		t.Fatalf("Expected the watch event first, got %s", name)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	name, data := readEvent()
+	var event watch.Event
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		t.Fatalf("Failed to decode event %q: %v", data, err)
+	}
+	if name != watch.Create || event.Path != "sub" || !event.IsDir {
+		t.Errorf("Expected creation of directory sub, got %s %+v", name, event)
+	}
+}
+
+// batchCodes returns the status and code of each operation's reply
+func batchCodes(result *protocol.BatchResult) string {
+	var codes []string
+	for _, r := range result.Results {
+		codes = append(codes, strconv.Itoa(r.Status)+" "+r.Code)
+	}
+	return strings.Join(codes, ", ")
+}
+
+// stagingDirs returns the staging directories left for the location dir
+func stagingDirs(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(stagingRoot(dir), "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestYamuxBatch(t *testing.T) {
+	uploadDir := t.TempDir()
+	stream := openCommandStream(t, NewServer(t.TempDir(), uploadDir, ""))
+
+	cmds := []protocol.Command{
+		{ID: "a", Type: "upload", Path: "a.txt", Content: []byte("a")},
+		{ID: "b", Type: "delete", Path: "missing"},
+		{ID: "c", Type: "info"},
+	}
+
+	var result protocol.BatchResult
+	writeCommand(t, stream, &protocol.Command{ID: "batch", Type: "batch", Commands: cmds})
+	if resp := readResponse(t, stream, &result); resp.ID != "batch" || resp.Type != protocol.TypeBatch {
+		t.Fatalf("Expected a batch reply, got %+v", resp)
+	}
+	if codes := batchCodes(&result); codes != "200 , 404 not_found, 200 " || result.Completed {
+		t.Errorf("Expected every operation to run, got %s", codes)
+	}
+	if result.Results[0].ID != "a" || result.Results[2].Type != protocol.TypeInfo {
+		t.Errorf("Expected replies in order, got %+v", result.Results)
+	}
+
+	result = protocol.BatchResult{}
+	writeCommand(t, stream, &protocol.Command{Type: "batch", Commands: cmds, Params: map[string]string{"stop_on_error": "true"}})
+	readResponse(t, stream, &result)
+	if codes := batchCodes(&result); codes != "200 , 404 not_found, 424 skipped" {
+		t.Errorf("Expected the batch to stop at the failure, got %s", codes)
+	}
+
+	tests := []struct {
+		cmd  *protocol.Command
+		code string
+	}{
+		{&protocol.Command{Type: "batch"}, protocol.CodeInvalidParams},
+		{&protocol.Command{Type: "batch", Commands: []protocol.Command{{Type: "batch"}}}, protocol.CodeInvalidCommand},
+	}
+	for _, tt := range tests {
+		writeCommand(t, stream, tt.cmd)
+		if resp := readResponse(t, stream, nil); resp.Code != tt.code {
+			t.Errorf("Expected code %s, got %+v", tt.code, resp)
+		}
+	}
+}
+
+func TestYamuxAtomicBatch(t *testing.T) {
+	uploadDir := t.TempDir()
+	stream := openCommandStream(t, NewServer(t.TempDir(), uploadDir, ""))
+
+	os.WriteFile(filepath.Join(uploadDir, "a.txt"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(uploadDir, "b.txt"), []byte("b"), 0644)
+
+	upload := map[string]string{"location": "upload"}
+	cmds := []protocol.Command{
+		{Type: "upload", Path: "a.txt", Content: []byte("new")},
+		{Type: "delete", Path: "b.txt", Params: upload},
+		{Type: "mkdir", Path: "dir", Params: upload},
+		{Type: "upload", Path: "sub/c.txt", Content: []byte("c")},
+	}
+	atomic := map[string]string{"atomic": "true"}
+
+	// A failing operation undoes the ones before it
+	var result protocol.BatchResult
+	failing := append(append([]protocol.Command{}, cmds...), protocol.Command{Type: "delete", Path: "missing", Params: upload})
+	writeCommand(t, stream, &protocol.Command{Type: "batch", Commands: failing, Params: atomic})
+	readResponse(t, stream, &result)
+	want := "424 rolled_back, 424 rolled_back, 424 rolled_back, 424 rolled_back, 404 not_found"
+	if codes := batchCodes(&result); codes != want || result.Completed || !result.Atomic {
+		t.Errorf("Expected %s, got %s", want, codes)
+	}
+	if data, _ := os.ReadFile(filepath.Join(uploadDir, "a.txt")); string(data) != "old" {
+		t.Errorf("Expected a.txt to be restored, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "b.txt")); err != nil {
+		t.Errorf("Expected b.txt to be restored: %v", err)
+	}
+	for _, name := range []string{"dir", "sub"} {
+		if _, err := os.Stat(filepath.Join(uploadDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+
+	// Commands that cannot be staged fail before anything changes
+	result = protocol.BatchResult{}
+	unstageable := append(append([]protocol.Command{}, cmds...), protocol.Command{Type: "list"})
+	writeCommand(t, stream, &protocol.Command{Type: "batch", Commands: unstageable, Params: atomic})
+	readResponse(t, stream, &result)
+	want = "424 skipped, 424 skipped, 424 skipped, 424 skipped, 400 invalid_command"
+	if codes := batchCodes(&result); codes != want {
+		t.Errorf("Expected %s, got %s", want, codes)
+	}
+
+	result = protocol.BatchResult{}
+	writeCommand(t, stream, &protocol.Command{Type: "batch", Commands: cmds, Params: atomic})
+	readResponse(t, stream, &result)
+	if codes := batchCodes(&result); codes != "200 , 200 , 200 , 200 " || !result.Completed {
+		t.Fatalf("Expected the batch to complete, got %s", codes)
+	}
+	if data, _ := os.ReadFile(filepath.Join(uploadDir, "a.txt")); string(data) != "new" {
+		t.Errorf("Expected a.txt to be replaced, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected b.txt to be deleted, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(uploadDir, "sub", "c.txt")); string(data) != "c" {
+		t.Errorf("Expected sub/c.txt to be uploaded, got %q", data)
+	}
+	if info, err := os.Stat(filepath.Join(uploadDir, "dir")); err != nil || !info.IsDir() {
+		t.Errorf("Expected dir to be created: %v", err)
+	}
+
+	if dirs := stagingDirs(t, uploadDir); len(dirs) != 0 {
+		t.Errorf("Expected staging directories to be removed, got %v", dirs)
+	}
+	if entries, _ := os.ReadDir(uploadDir); len(entries) != 3 {
+		t.Errorf("Expected only a.txt, dir and sub in the upload directory, got %v", entries)
+	}
+}
+
+func TestStagingRemovedAtStartup(t *testing.T) {
+	uploadDir := t.TempDir()
+	leftover := filepath.Join(stagingRoot(uploadDir), "123", "1")
+	if err := os.MkdirAll(filepath.Dir(leftover), 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(leftover, []byte("deleted by a crashed batch"), 0644)
+
+	NewServer(t.TempDir(), uploadDir, "")
+	if _, err := os.Stat(stagingRoot(uploadDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected the staging directory to be removed, got %v", err)
+	}
+}
+
+func TestYamuxHashCommand(t *testing.T) {
+	dir := t.TempDir()
+	stream := openCommandStream(t, NewServer(dir, t.TempDir(), ""))
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello world"), 0644)
+
+	tests := []struct {
+		params map[string]string
+		expect string
+		length int64
+	}{
+		{nil, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", 11},
+		{map[string]string{"algorithm": "md5"}, "5eb63bbbe01eeed093cb22bb8f5acdc3", 11},
+		{map[string]string{"algorithm": "sha1"}, "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", 11},
+		{map[string]string{"algorithm": "blake2b"}, "021ced8799296ceca557832ab941a50b4a11f83478cf141f51f933f653ab9fbcc05a037cddbed06e309bf334942c4e58cdf1a46e237911ccd7fcf9787cbc7fd0", 11},
+		{map[string]string{"offset": "6", "length": "5"}, "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7", 5},
+	}
+	for _, tt := range tests {
+		var result protocol.HashResult
+		writeCommand(t, stream, &protocol.Command{Type: "hash", Path: "file.txt", Params: tt.params})
+		if resp := readResponse(t, stream, &result); resp.Type != protocol.TypeHash {
+			t.Fatalf("Expected a hash reply, got %+v", resp)
+		}
+		if result.Hash != tt.expect || result.Length != tt.length || result.Size != 11 {
+			t.Errorf("%v: expected %s over %d bytes, got %+v", tt.params, tt.expect, tt.length, result)
+		}
+	}
+
+	failures := []struct {
+		cmd  *protocol.Command
+		code string
+	}{
+		{&protocol.Command{Type: "hash", Path: "file.txt", Params: map[string]string{"algorithm": "crc32"}}, protocol.CodeInvalidParams},
+		{&protocol.Command{Type: "hash", Path: "missing"}, protocol.CodeNotFound},
+		{&protocol.Command{Type: "hash", Path: "."}, protocol.CodeInvalidPath},
+		{&protocol.Command{Type: "hash", Path: "file.txt", Params: map[string]string{"offset": "20"}}, protocol.CodeInvalidRange},
+		{&protocol.Command{Type: "manifest", Path: "file.txt"}, protocol.CodeInvalidPath},
+	}
+	for _, tt := range failures {
+		writeCommand(t, stream, tt.cmd)
+		if resp := readResponse(t, stream, nil); resp.Code != tt.code {
+			t.Errorf("%+v: expected code %s, got %+v", tt.cmd, tt.code, resp)
+		}
+	}
+}
+
+func TestYamuxManifestCommand(t *testing.T) {
+	uploadDir := t.TempDir()
+	stream := openCommandStream(t, NewServer(t.TempDir(), uploadDir, ""))
+	os.MkdirAll(filepath.Join(uploadDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(uploadDir, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(uploadDir, "sub", "b.txt"), []byte("bb"), 0644)
+
+	manifest := func() *protocol.ManifestResult {
+		t.Helper()
+		var result protocol.ManifestResult
+		writeCommand(t, stream, &protocol.Command{Type: "manifest", Params: map[string]string{"location": "upload", "algorithm": "md5"}})
+		if resp := readResponse(t, stream, &result); resp.Type != protocol.TypeManifest {
+			t.Fatalf("Expected a manifest reply, got %+v", resp)
+		}
+		return &result
+	}
+
+	result := manifest()
+	if len(result.Files) != 2 || result.Files[0].Path != "a.txt" || result.Files[1].Path != "sub/b.txt" {
+		t.Fatalf("Expected a.txt and sub/b.txt, got %+v", result.Files)
+	}
+	if result.Files[1].Size != 2 || result.Files[1].Hash != "21ad0bd836b90d08f4cf640b4c298e7c" {
+		t.Errorf("Expected the size and MD5 of sub/b.txt, got %+v", result.Files[1])
+	}
+	if result.Cached != 0 {
+		t.Errorf("Expected nothing cached yet, got %d", result.Cached)
+	}
+
+	if result = manifest(); result.Cached != 2 {
+		t.Errorf("Expected both checksums from the cache, got %d", result.Cached)
+	}
+
+	// A changed file is hashed again
+	os.WriteFile(filepath.Join(uploadDir, "a.txt"), []byte("changed"), 0644)
+	result = manifest()
+	if result.Cached != 1 || result.Files[0].Hash != "8977dfac2f8e04cb96e66882235f5aba" || result.Files[0].Size != 7 {
+		t.Errorf("Expected a.txt to be hashed again, got %+v", result)
+	}
+}
+
+func TestMuxRouting(t *testing.T) {
+	mux := NewMux()
+	reply := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + PathParam(r, "name") + "|" + PathParam(r, "path")))
+		}
+	}
+	mux.HandleFunc("/status", reply("status"))
+	mux.HandleFunc("GET /files/{path...}", reply("get-files"))
+	mux.HandleFunc("PUT /files/{path...}", reply("put-files"))
+	mux.HandleFunc("GET /files/special", reply("special"))
+	mux.HandleFunc("GET /users/{name}", reply("user"))
+	mux.HandleFunc("/static/", reply("static"))
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", "/status", 200, "status |"},
+		{"DELETE", "/status", 200, "status |"},
+		{"GET", "/files/a/b.txt", 200, "get-files |a/b.txt"},
+		{"PUT", "/files/a", 200, "put-files |a"},
+		{"GET", "/files/", 200, "get-files |"},
+		{"GET", "/files/special", 200, "special |"},
+		{"GET", "/files", 404, ""},
+		{"GET", "/users/bob", 200, "user bob|"},
+		{"GET", "/users/", 404, ""},
+		{"GET", "/users/bob/x", 404, ""},
+		{"POST", "/static/css/site.css", 200, "static |"},
+		{"GET", "/static", 404, ""},
+		{"GET", "/missing", 404, ""},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.status, rr.Code)
+			continue
+		}
+		if tt.status == 200 && rr.Body.String() != tt.body {
+			t.Errorf("%s %s: expected %q, got %q", tt.method, tt.path, tt.body, rr.Body.String())
+		}
+	}
+}
+
+func TestMuxMethods(t *testing.T) {
+	mux := NewMux()
+	mux.HandleFunc("GET /files/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	})
+	mux.HandleFunc("DELETE /files/{path...}", func(w http.ResponseWriter, r *http.Request) {})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/files/a", nil))
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "DELETE, GET, HEAD, OPTIONS" {
+		t.Errorf("Expected 405 allowing DELETE, GET, HEAD, OPTIONS, got %d %q", rr.Code, rr.Header().Get("Allow"))
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("OPTIONS", "/files/a", nil))
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Allow") == "" {
+		t.Errorf("Expected 204 with Allow for OPTIONS, got %d %q", rr.Code, rr.Header().Get("Allow"))
+	}
+
+	// HEAD goes to the GET handler
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	resp, err := http.Head(ts.URL + "/files/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected HEAD to be served by GET, got %d", resp.StatusCode)
+	}
+
+	// Registering a method twice is a mistake
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for a duplicate registration")
+		}
+	}()
+	mux.HandleFunc("GET /files/{path...}", func(w http.ResponseWriter, r *http.Request) {})
+}
+
+func TestMuxMiddleware(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	server := NewServer(t.TempDir(), t.TempDir(), "")
+	server.Use(tag("first"), tag("second"))
+	server.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "secret" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/status", nil))
+	if rr.Code != http.StatusUnauthorized || strings.Join(order, ",") != "first,second" {
+		t.Errorf("Expected the middleware to run in order and refuse, got %d %v", rr.Code, order)
+	}
+
+	// Middleware sees requests the mux refuses too
+	order = nil
+	req := httptest.NewRequest("DELETE", "/status", nil)
+	req.Header.Set("Authorization", "secret")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed || len(order) != 2 {
+		t.Errorf("Expected 405 after the middleware, got %d %v", rr.Code, order)
+	}
+}
+
+func TestFilesAPI(t *testing.T) {
+	downloadDir, uploadDir := t.TempDir(), t.TempDir()
+	key := "secretkey"
+	server := NewServer(downloadDir, uploadDir, key)
+
+	do := func(method, target string, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rr
+	}
+	expectError := func(rr *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var failure protocol.Response
+		if err := json.Unmarshal(rr.Body.Bytes(), &failure); err != nil {
+			t.Fatalf("Expected a JSON error, got %d %q", rr.Code, rr.Body.String())
+		}
+		if rr.Code != status || failure.Status != status || failure.Code != code {
+			t.Errorf("Expected %d %s, got %d %+v", status, code, rr.Code, failure)
+		}
+	}
+
+	// PUT creates the file and its parents, and reports what it stored
+	content := "hello, world"
+	rr := do("PUT", "/api/v1/files/docs/a.txt", content)
+	var stored protocol.FileResult
+	json.Unmarshal(rr.Body.Bytes(), &stored)
+	sum := sha256.Sum256([]byte(content))
+	if rr.Code != http.StatusCreated || stored.Size != int64(len(content)) || stored.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Expected 201 with the size and checksum, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = do("PUT", "/api/v1/files/docs/a.txt", content); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 replacing the file, got %d", rr.Code)
+	}
+
+	// The file is stored XOR encoded, like /upload stores it
+	encoded := &bytes.Buffer{}
+	xorrw.NewXorReaderWriter(encoded, []byte(key)).Write([]byte(content))
+	if data, _ := os.ReadFile(filepath.Join(downloadDir, "docs", "a.txt")); !bytes.Equal(data, encoded.Bytes()) {
+		t.Errorf("Expected the XOR encoded content on disk, got %q", data)
+	}
+
+	// GET decodes it, and answers ranges
+	rr = do("GET", "/api/v1/files/docs/a.txt", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != content || rr.Header().Get("X-File-Type") != "file" {
+		t.Errorf("Expected the file, got %d %q", rr.Code, rr.Body.String())
+	}
+	req := httptest.NewRequest("GET", "/api/v1/files/docs/a.txt", nil)
+	req.Header.Set("Range", "bytes=7-")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "world" {
+		t.Errorf("Expected 206 with world, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// HEAD has the metadata and no body
+	rr = do("HEAD", "/api/v1/files/docs/a.txt", "")
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("Expected 200 without a body, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Length") != strconv.Itoa(len(content)) || rr.Header().Get("ETag") == "" || rr.Header().Get("Last-Modified") == "" {
+		t.Errorf("Expected the size, ETag and Last-Modified, got %v", rr.Header())
+	}
+
+	// GET on a directory lists it
+	rr = do("GET", "/api/v1/files/docs", "")
+	var listing protocol.ListResult
+	json.Unmarshal(rr.Body.Bytes(), &listing)
+	if rr.Header().Get("X-File-Type") != "directory" || len(listing.Entries) != 1 || listing.Entries[0].Name != "a.txt" {
+		t.Errorf("Expected a listing of docs, got %q", rr.Body.String())
+	}
+	rr = do("GET", "/api/v1/files/", "")
+	json.Unmarshal(rr.Body.Bytes(), &listing)
+	if len(listing.Entries) != 1 || !listing.Entries[0].IsDir {
+		t.Errorf("Expected the root listing, got %q", rr.Body.String())
+	}
+
+	// POST runs actions
+	rr = do("POST", "/api/v1/files/docs/a.txt", `{"action": "copy", "to": "docs/b.txt"}`)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected copy to succeed, got %d %q", rr.Code, rr.Body.String())
+	}
+	expectError(do("POST", "/api/v1/files/docs/a.txt", `{"action": "move", "to": "docs/b.txt"}`), http.StatusConflict, protocol.CodeAlreadyExists)
+	rr = do("POST", "/api/v1/files/docs/a.txt", `{"action": "move", "to": "docs/b.txt", "overwrite": true}`)
+	var moved protocol.MoveResult
+	json.Unmarshal(rr.Body.Bytes(), &moved)
+	if rr.Code != http.StatusOK || moved.From != "docs/a.txt" || moved.To != "docs/b.txt" {
+		t.Errorf("Expected the move, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = do("POST", "/api/v1/files/x/y", `{"action": "mkdir", "parents": true}`); rr.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for mkdir, got %d %q", rr.Code, rr.Body.String())
+	}
+	expectError(do("POST", "/api/v1/files/docs", `{"action": "chmod"}`), http.StatusBadRequest, protocol.CodeInvalidCommand)
+	expectError(do("POST", "/api/v1/files/docs", `not json`), http.StatusBadRequest, protocol.CodeInvalidCommand)
+
+	// DELETE removes files, and directories only if empty or recursive
+	if rr = do("DELETE", "/api/v1/files/docs/b.txt", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected delete to succeed, got %d %q", rr.Code, rr.Body.String())
+	}
+	expectError(do("DELETE", "/api/v1/files/x", ""), http.StatusConflict, protocol.CodeNotEmpty)
+	if rr = do("DELETE", "/api/v1/files/x?recursive=true", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected recursive delete to succeed, got %d %q", rr.Code, rr.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(downloadDir, "x")); !os.IsNotExist(err) {
+		t.Errorf("Expected x to be removed, got %v", err)
+	}
+
+	// The upload directory is reached with location=upload
+	if rr = do("PUT", "/api/v1/files/up.txt?location=upload", "up"); rr.Code != http.StatusCreated {
+		t.Errorf("Expected 201 in the upload directory, got %d", rr.Code)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "up.txt")); err != nil {
+		t.Errorf("Expected up.txt in the upload directory: %v", err)
+	}
+	if rr = do("GET", "/api/v1/files/up.txt?location=upload", ""); rr.Body.String() != "up" {
+		t.Errorf("Expected up, got %q", rr.Body.String())
+	}
+
+	// Failures share the JSON envelope
+	expectError(do("GET", "/api/v1/files/missing.txt", ""), http.StatusNotFound, protocol.CodeNotFound)
+	expectError(do("GET", "/api/v1/files/../secret", ""), http.StatusBadRequest, protocol.CodeInvalidPath)
+	expectError(do("PUT", "/api/v1/files/docs", "x"), http.StatusConflict, protocol.CodeAlreadyExists)
+	expectError(do("DELETE", "/api/v1/files/", ""), http.StatusBadRequest, protocol.CodeMissingPath)
+	rr = do("PATCH", "/api/v1/files/docs", "")
+	expectError(rr, http.StatusMethodNotAllowed, protocol.CodeInvalidCommand)
+	if rr.Header().Get("Allow") == "" {
+		t.Errorf("Expected an Allow header")
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	uploadDir := t.TempDir()
+	server := NewServer(t.TempDir(), uploadDir, "")
+
+	type part struct{ field, file, value string }
+	upload := func(parts ...part) (*httptest.ResponseRecorder, *UploadResult) {
+		t.Helper()
+		var b bytes.Buffer
+		w := multipart.NewWriter(&b)
+		for _, p := range parts {
+			var fw io.Writer
+			if p.file != "" {
+				fw, _ = w.CreateFormFile(p.field, p.file)
+			} else {
+				fw, _ = w.CreateFormField(p.field)
+			}
+			fw.Write([]byte(p.value))
+		}
+		w.Close()
+
+		req := httptest.NewRequest("POST", "/upload", &b)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+
+		var result UploadResult
+		json.Unmarshal(rr.Body.Bytes(), &result)
+		return rr, &result
+	}
+	storedPath := func(file *UploadedFile) string {
+		data, _ := json.Marshal(file.Data)
+		var result protocol.FileResult
+		json.Unmarshal(data, &result)
+		return result.Path
+	}
+
+	// Several files, the later ones in a subdirectory
+	sum := sha256.Sum256([]byte("second"))
+	rr, result := upload(
+		part{"file", "a.txt", "first"},
+		part{"subdir", "", "nested/dir"},
+		part{"checksum", "", hex.EncodeToString(sum[:])},
+		part{"file", "b.txt", "second"},
+		part{"other", "c.txt", "third"},
+	)
+	if rr.Code != http.StatusOK || len(result.Files) != 3 {
+		t.Fatalf("Expected 200 with 3 files, got %d %q", rr.Code, rr.Body.String())
+	}
+	for i, want := range []string{"a.txt", "nested/dir/b.txt", "nested/dir/c.txt"} {
+		if got := storedPath(result.Files[i]); got != want {
+			t.Errorf("Expected file %d at %s, got %s", i, want, got)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(uploadDir, "nested", "dir", "c.txt")); string(data) != "third" {
+		t.Errorf("Expected third, got %q", data)
+	}
+
+	// Overwrite policies
+	rr, result = upload(part{"overwrite", "", "false"}, part{"file", "a.txt", "again"})
+	if rr.Code != http.StatusConflict || result.Files[0].Code != protocol.CodeAlreadyExists {
+		t.Errorf("Expected 409 already_exists, got %d %q", rr.Code, rr.Body.String())
+	}
+	rr, result = upload(part{"overwrite", "", "rename"}, part{"file", "a.txt", "again"}, part{"file", "a.txt", "and again"})
+	if rr.Code != http.StatusOK || storedPath(result.Files[0]) != "a (1).txt" || storedPath(result.Files[1]) != "a (2).txt" {
+		t.Errorf("Expected renamed files, got %d %q", rr.Code, rr.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(uploadDir, "a.txt")); string(data) != "first" {
+		t.Errorf("Expected a.txt to be kept, got %q", data)
+	}
+	if rr, _ = upload(part{"file", "a.txt", "replaced"}); rr.Code != http.StatusOK {
+		t.Errorf("Expected replacing to succeed, got %d", rr.Code)
+	}
+
+	// A checksum mismatch fails only that file
+	rr, result = upload(
+		part{"checksum", "", "md5:00000000000000000000000000000000"},
+		part{"file", "bad.txt", "data"},
+		part{"file", "good.txt", "data"},
+	)
+	if rr.Code != http.StatusMultiStatus || result.Files[0].Code != protocol.CodeChecksumMismatch || result.Files[1].Failed() {
+		t.Errorf("Expected 207 with one mismatch, got %d %q", rr.Code, rr.Body.String())
+	}
+	if common.FileExists(filepath.Join(uploadDir, "bad.txt")) {
+		t.Errorf("Expected bad.txt not to be stored")
+	}
+
+	// Bad fields and names
+	if rr, _ = upload(part{"overwrite", "", "maybe"}, part{"file", "x.txt", "x"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad policy, got %d", rr.Code)
+	}
+	if rr, _ = upload(part{"subdir", "", "../escape"}, part{"file", "x.txt", "x"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a subdir outside the upload directory, got %d", rr.Code)
+	}
+	if rr, _ = upload(part{"subdir", "", "only"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a file, got %d", rr.Code)
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(uploadDir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".upload-") {
+			t.Errorf("Temporary file %s left behind", entry.Name())
+		}
+	}
+
+	// Requests over the limit are cut off
+	server.SetMaxUploadSize(100)
+	rr, result = upload(part{"file", "big.bin", strings.Repeat("x", 1000)})
+	failure := result.Error
+	if len(result.Files) > 0 {
+		// The limit was reached reading the file rather than its headers
+		failure = result.Files[0].Response
+	}
+	if rr.Code != http.StatusRequestEntityTooLarge || failure == nil || failure.Code != protocol.CodeTooLarge {
+		t.Errorf("Expected 413 too_large, got %d %q", rr.Code, rr.Body.String())
+	}
+	if common.FileExists(filepath.Join(uploadDir, "big.bin")) {
+		t.Errorf("Expected big.bin not to be stored")
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	downloadDir, uploadDir := t.TempDir(), t.TempDir()
+	key := "secretkey"
+	server := NewServer(downloadDir, uploadDir, key)
+	content := []byte(strings.Repeat("0123456789", 10))
+
+	do := func(server *Server, method, target string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+	patch := func(server *Server, location string, offset int, body []byte, checksum string) *httptest.ResponseRecorder {
+		t.Helper()
+		headers := map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}
+		if checksum != "" {
+			headers["Upload-Checksum"] = checksum
+		}
+		return do(server, "PATCH", location, headers, body)
+	}
+
+	// OPTIONS describes the protocol
+	rr := do(server, "OPTIONS", "/tus", nil, nil)
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Tus-Version") != "1.0.0" ||
+		rr.Header().Get("Tus-Extension") != "creation,termination,checksum,expiration" {
+		t.Errorf("Expected the protocol description, got %d %v", rr.Code, rr.Header())
+	}
+
+	// Creation
+	filename := base64.StdEncoding.EncodeToString([]byte("captures/run1.bin"))
+	rr = do(server, "POST", "/tus", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename " + filename + ",draft",
+	}, nil)
+	location := rr.Header().Get("Location")
+	if rr.Code != http.StatusCreated || !strings.HasPrefix(location, "/tus/") || rr.Header().Get("Upload-Expires") == "" {
+		t.Fatalf("Expected 201 with a Location, got %d %v", rr.Code, rr.Header())
+	}
+	if rr.Header().Get("Tus-Resumable") != "1.0.0" {
+		t.Errorf("Expected Tus-Resumable on the reply, got %v", rr.Header())
+	}
+
+	// The first chunk
+	if rr = patch(server, location, 0, content[:40], ""); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "40" {
+		t.Fatalf("Expected 204 at offset 40, got %d %v", rr.Code, rr.Header())
+	}
+
+	// A wrong offset or checksum changes nothing
+	if rr = patch(server, location, 10, content[10:50], ""); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a wrong offset, got %d", rr.Code)
+	}
+	if rr = patch(server, location, 40, content[40:60], "sha1 "+base64.StdEncoding.EncodeToString(make([]byte, 20))); rr.Code != StatusChecksumMismatch {
+		t.Errorf("Expected 460 for a bad checksum, got %d", rr.Code)
+	}
+	if rr = patch(server, location, 40, content[40:], "crc32 AAAA"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown algorithm, got %d", rr.Code)
+	}
+	if rr = patch(server, location, 40, append(content[40:], 'x'), ""); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for data past the length, got %d", rr.Code)
+	}
+
+	// The upload survives a restart
+	server = NewServer(downloadDir, uploadDir, key)
+	rr = do(server, "HEAD", location, nil, nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != "40" || rr.Header().Get("Upload-Length") != "100" {
+		t.Fatalf("Expected offset 40 of 100, got %d %v", rr.Code, rr.Header())
+	}
+	if !strings.HasPrefix(rr.Header().Get("Upload-Metadata"), "filename ") || rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected the metadata and no-store, got %v", rr.Header())
+	}
+
+	// The last chunk, with a checksum, finishes the upload
+	sum := sha256.Sum256(content[40:])
+	rr = patch(server, location, 40, content[40:], "sha256 "+base64.StdEncoding.EncodeToString(sum[:]))
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "100" {
+		t.Fatalf("Expected 204 at offset 100, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// The file is stored XOR encoded, like /upload stores it
+	encoded := &bytes.Buffer{}
+	xorrw.NewXorReaderWriter(encoded, []byte(key)).Write(content)
+	if data, err := os.ReadFile(filepath.Join(uploadDir, "captures", "run1.bin")); err != nil || !bytes.Equal(data, encoded.Bytes()) {
+		t.Errorf("Expected the XOR encoded upload, got %q (%v)", data, err)
+	}
+	if rr = do(server, "HEAD", location, nil, nil); rr.Header().Get("Upload-Offset") != "100" {
+		t.Errorf("Expected a finished upload at offset 100, got %v", rr.Header())
+	}
+
+	// Requests must name the protocol version
+	req := httptest.NewRequest("HEAD", location, nil)
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPreconditionFailed || rr.Header().Get("Tus-Version") != "1.0.0" {
+		t.Errorf("Expected 412 without Tus-Resumable, got %d", rr.Code)
+	}
+
+	// Termination
+	rr = do(server, "POST", "/tus", map[string]string{"Upload-Length": "10"}, nil)
+	other := rr.Header().Get("Location")
+	if rr = do(server, "DELETE", other, nil, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 for DELETE, got %d", rr.Code)
+	}
+	if rr = do(server, "HEAD", other, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after DELETE, got %d", rr.Code)
+	}
+
+	// Expiration
+	server.tus.expiry = -time.Second
+	rr = do(server, "POST", "/tus", map[string]string{"Upload-Length": "10"}, nil)
+	expired := rr.Header().Get("Location")
+	if rr = patch(server, expired, 0, []byte("0123"), ""); rr.Code != http.StatusGone {
+		t.Errorf("Expected 410 for an expired upload, got %d", rr.Code)
+	}
+	if rr = do(server, "HEAD", expired, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected an expired upload to be removed, got %d", rr.Code)
+	}
+
+	// Bad requests
+	if rr = do(server, "POST", "/tus", nil, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without Upload-Length, got %d", rr.Code)
+	}
+	traversal := base64.StdEncoding.EncodeToString([]byte("../escape"))
+	if rr = do(server, "POST", "/tus", map[string]string{"Upload-Length": "1", "Upload-Metadata": "filename " + traversal}, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a filename outside the upload directory, got %d", rr.Code)
+	}
+	if rr = do(server, "HEAD", "/tus/..", nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a malformed ID, got %d", rr.Code)
+	}
+}
+
+func TestSetTusDir(t *testing.T) {
+	downloadDir, uploadDir := t.TempDir(), t.TempDir()
+	server := NewServer(downloadDir, uploadDir, "")
+
+	for _, dir := range []string{uploadDir, filepath.Join(uploadDir, "tus"), filepath.Join(downloadDir, "a", "..", "b")} {
+		if err := server.SetTusDir(dir); err == nil {
+			t.Errorf("Expected %s to be refused", dir)
+		}
+	}
+
+	// Next to the upload directory is fine, even with a similar name
+	if err := server.SetTusDir(uploadDir + "-tus"); err != nil {
+		t.Errorf("Expected %s to be accepted, got %v", uploadDir+"-tus", err)
+	}
+}
+
+func TestPartFilesExpire(t *testing.T) {
+	server := NewServer(t.TempDir(), t.TempDir(), "")
+	upload := func(path string) {
+		t.Helper()
+		cmd := &protocol.Command{Type: "upload", Path: path, Content: []byte("part"), Params: map[string]string{"offset": "0"}}
+		if resp := server.processCommand(context.Background(), cmd); resp.Status != http.StatusOK {
+			t.Fatalf("Upload failed: %+v", resp)
+		}
+	}
+
+	upload("abandoned.bin")
+	old := time.Now().Add(-2 * defaultTusExpiry)
+	if err := os.Chtimes(server.partPath("abandoned.bin"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Starting another upload removes the abandoned one
+	upload("fresh.bin")
+	if _, err := os.Stat(server.partPath("abandoned.bin")); !os.IsNotExist(err) {
+		t.Errorf("Expected the abandoned part file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(server.partPath("fresh.bin")); err != nil {
+		t.Errorf("Expected the new part file to be kept: %v", err)
+	}
+}
+
+func TestTusStateOutsideUploads(t *testing.T) {
+	uploadDir := t.TempDir()
+	server := NewServer(t.TempDir(), uploadDir, "")
+
+	header := func(req *http.Request, headers map[string]string) *http.Request {
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, header(httptest.NewRequest("POST", "/tus", nil), map[string]string{"Upload-Length": "4"}))
+	location := rr.Header().Get("Location")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rr.Code)
+	}
+
+	// Nothing of the upload is kept where clients can reach it
+	if entries, _ := os.ReadDir(uploadDir); len(entries) != 0 {
+		t.Errorf("Expected an empty upload directory, got %d entries", len(entries))
+	}
+
+	// A path changed in the stored state is checked before the upload is
+	// finished
+	id := strings.TrimPrefix(location, "/tus/")
+	upload, failure := server.tus.load(id, time.Now())
+	if failure != nil {
+		t.Fatalf("Failed to load upload: %s", failure.Error)
+	}
+	upload.Path = "../escape.bin"
+	if err := server.tus.save(upload); err != nil {
+		t.Fatalf("Failed to save upload: %v", err)
+	}
+
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, header(httptest.NewRequest("PATCH", location, strings.NewReader("data")), map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a path outside the upload directory, got %d", rr.Code)
+	}
+	if common.FileExists(filepath.Join(filepath.Dir(uploadDir), "escape.bin")) {
+		t.Errorf("Expected nothing written outside the upload directory")
+	}
+}
 
 // TestCloser tests a struct that implements io.Closer for coverage purposes
 type testCloser struct {
@@ -0,0 +1,363 @@
+package httpserver
+
+import (
+	"container/heap"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-sharing-utility/internal/protocol"
+)
+
+// Listing options, given as command parameters or as query parameters of
+// the /list endpoint:
+//
+//	depth          levels to descend, 1 (the default) lists one directory
+//	recursive      "true" lists every level unless depth is also set
+//	include        glob an entry must match to be listed
+//	exclude        glob of entries to leave out; excluded directories are
+//	               not descended into
+//	include_regex  regular expression an entry's path must match
+//	exclude_regex  regular expression of paths to leave out
+//	sort           "name" (the default), "size" or "mtime"
+//	order          "asc" (the default) or "desc"
+//	limit          entries per page, defaultListLimit unless given
+//	cursor         next_cursor of the previous page
+//
+// Globs match the entry's name, or its path below the listed directory if
+// they contain a slash. Entry names in recursive listings are such paths.
+
+const (
+	// defaultListLimit is the page size when none is given
+	defaultListLimit = 1000
+
+	// maxListLimit caps the page size
+	maxListLimit = 10000
+)
+
+// listOptions holds the parsed listing parameters
+type listOptions struct {
+	depth                int // 0 for no limit
+	include, exclude     string
+	includeRe, excludeRe *regexp.Regexp
+	sortBy               string
+	desc                 bool
+	limit                int
+	cursor               *listCursor
+}
+
+// listCursor marks the last entry of a page. It is sent to clients as
+// opaque base64-encoded JSON.
+type listCursor struct {
+	Sort    string `json:"s"`
+	Desc    bool   `json:"d,omitempty"`
+	Name    string `json:"n"`
+	Size    int64  `json:"z,omitempty"`
+	ModTime int64  `json:"m,omitempty"`
+}
+
+// parseListOptions reads the listing parameters
+func parseListOptions(params map[string]string) (*listOptions, *protocol.Response) {
+	opts := &listOptions{
+		depth:   1,
+		include: params["include"],
+		exclude: params["exclude"],
+		sortBy:  "name",
+		limit:   defaultListLimit,
+	}
+
+	if params["recursive"] == "true" {
+		opts.depth = 0
+	}
+	if value, ok := params["depth"]; ok {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 1 {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid depth")
+		}
+		opts.depth = depth
+	}
+
+	for _, pattern := range []string{opts.include, opts.exclude} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid pattern %q", pattern)
+		}
+	}
+
+	var err error
+	if value := params["include_regex"]; value != "" {
+		if opts.includeRe, err = regexp.Compile(value); err != nil {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid include_regex: %v", err)
+		}
+	}
+	if value := params["exclude_regex"]; value != "" {
+		if opts.excludeRe, err = regexp.Compile(value); err != nil {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid exclude_regex: %v", err)
+		}
+	}
+
+	switch value := params["sort"]; value {
+	case "":
+	case "name", "size", "mtime":
+		opts.sortBy = value
+	default:
+		return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid sort %q", value)
+	}
+
+	switch value := params["order"]; value {
+	case "", "asc":
+	case "desc":
+		opts.desc = true
+	default:
+		return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid order %q", value)
+	}
+
+	if value, ok := params["limit"]; ok {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid limit")
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+		opts.limit = limit
+	}
+
+	if value := params["cursor"]; value != "" {
+		cursor, err := decodeListCursor(value)
+		if err != nil || cursor.Sort != opts.sortBy || cursor.Desc != opts.desc {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid cursor")
+		}
+		opts.cursor = cursor
+	}
+
+	return opts, nil
+}
+
+// decodeListCursor parses a cursor sent by a client
+func decodeListCursor(value string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// encode returns the cursor as sent to clients
+func (c *listCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// cursorAt returns the cursor pointing at an entry
+func (opts *listOptions) cursorAt(entry protocol.FileEntry) *listCursor {
+	cursor := &listCursor{Sort: opts.sortBy, Desc: opts.desc, Name: entry.Name}
+	switch opts.sortBy {
+	case "size":
+		cursor.Size = entry.Size
+	case "mtime":
+		cursor.ModTime = entry.ModTime.UnixNano()
+	}
+	return cursor
+}
+
+// less reports whether entry a is listed before entry b. Names break ties,
+// so the order is total and cursors are stable.
+func (opts *listOptions) less(a, b protocol.FileEntry) bool {
+	if opts.desc {
+		a, b = b, a
+	}
+	switch opts.sortBy {
+	case "size":
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case "mtime":
+		if !a.ModTime.Equal(b.ModTime) {
+			return a.ModTime.Before(b.ModTime)
+		}
+	}
+	return a.Name < b.Name
+}
+
+// afterCursor reports whether an entry belongs after the requested cursor
+func (opts *listOptions) afterCursor(entry protocol.FileEntry) bool {
+	if opts.cursor == nil {
+		return true
+	}
+	last := protocol.FileEntry{
+		Name:    opts.cursor.Name,
+		Size:    opts.cursor.Size,
+		ModTime: time.Unix(0, opts.cursor.ModTime),
+	}
+	return opts.less(last, entry)
+}
+
+// included reports whether an entry at rel passes the include options
+func (opts *listOptions) included(rel string) bool {
+	if opts.include != "" && !matchGlob(opts.include, rel) {
+		return false
+	}
+	return opts.includeRe == nil || opts.includeRe.MatchString(rel)
+}
+
+// excluded reports whether an entry at rel is filtered out by the exclude
+// options
+func (opts *listOptions) excluded(rel string) bool {
+	if opts.exclude != "" && matchGlob(opts.exclude, rel) {
+		return true
+	}
+	return opts.excludeRe != nil && opts.excludeRe.MatchString(rel)
+}
+
+// matchGlob matches a glob against a slash-separated path, or just its
+// last element if the glob has no slash
+func matchGlob(pattern, rel string) bool {
+	name := rel
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(rel)
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// listDirectory walks dir and returns one page of its entries
+func listDirectory(ctx context.Context, dir, displayPath string, opts *listOptions) (*protocol.ListResult, *protocol.Response) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fileErrorResponse("reading directory", err)
+	}
+	if !info.IsDir() {
+		return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidPath, "Error reading directory: %s is not a directory", displayPath)
+	}
+
+	// Only the page and one entry to tell whether more follow are kept
+	page := &pageHeap{opts: opts}
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if p == dir {
+			// An unreadable directory fails the listing
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			// Skip subdirectories that cannot be read
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if opts.excluded(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if opts.included(rel) {
+			entry := protocol.FileEntry{Name: rel, IsDir: d.IsDir()}
+			if info, err := d.Info(); err == nil {
+				entry.Size = info.Size()
+				entry.ModTime = info.ModTime()
+			}
+			if opts.afterCursor(entry) {
+				page.add(entry, opts.limit+1)
+			}
+		}
+
+		// Stop descending once the depth limit is reached
+		if d.IsDir() && opts.depth > 0 && depthOf(rel) >= opts.depth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fileErrorResponse("reading directory", err)
+	}
+
+	entries := page.entries
+	sort.Slice(entries, func(i, j int) bool {
+		return opts.less(entries[i], entries[j])
+	})
+
+	result := &protocol.ListResult{Path: displayPath, Entries: entries}
+	if len(entries) > opts.limit {
+		result.Entries = entries[:opts.limit]
+		result.NextCursor = opts.cursorAt(result.Entries[opts.limit-1]).encode()
+	}
+	if result.Entries == nil {
+		result.Entries = []protocol.FileEntry{}
+	}
+	return result, nil
+}
+
+// pageHeap collects the first entries in listing order without holding
+// every entry of the walk. It is a max-heap, so the entry listed last is
+// on top, ready to make way for one listed before it.
+type pageHeap struct {
+	entries []protocol.FileEntry
+	opts    *listOptions
+}
+
+func (h *pageHeap) Len() int           { return len(h.entries) }
+func (h *pageHeap) Less(i, j int) bool { return h.opts.less(h.entries[j], h.entries[i]) }
+func (h *pageHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+
+func (h *pageHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(protocol.FileEntry))
+}
+
+func (h *pageHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
+
+// add keeps entry if it is among the first max entries seen so far
+func (h *pageHeap) add(entry protocol.FileEntry, max int) {
+	if len(h.entries) < max {
+		heap.Push(h, entry)
+		return
+	}
+	if h.opts.less(entry, h.entries[0]) {
+		h.entries[0] = entry
+		heap.Fix(h, 0)
+	}
+}
+
+// depthOf returns how many levels below the listed directory rel is
+func depthOf(rel string) int {
+	return strings.Count(rel, "/") + 1
+}
+
+// handleList serves a directory listing as JSON, taking the listing
+// options and the path and location as query parameters
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	params := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		params[key] = values[0]
+	}
+
+	cmd := &protocol.Command{Type: "list", Path: params["path"], Params: params}
+
+	// Listings are sent bare, failures in the command envelope
+	writeAPIResponse(w, s.handleListCommand(r.Context(), cmd))
+}
@@ -1,45 +1,291 @@
 package httpserver
 
 import (
+	"context"
 	"net/http"
+	"sort"
+	"strings"
 )
 
-// Mux is a custom HTTP multiplexer
+// Mux is a custom HTTP multiplexer. A pattern is a path, optionally
+// preceded by a method and a space:
+//
+//	/status            exactly /status, any method
+//	GET /status        exactly /status, GET (and so HEAD) only
+//	/static/           /static/ and everything below it
+//	/files/{name}      one non-empty path segment, see PathParam
+//	/files/{path...}   /files/ and everything below it, the rest of the
+//	                   path being the parameter
+//
+// The most specific pattern matching a path wins: the one with the most
+// literal segments, then the most parameters, and patterns matching an
+// exact number of segments before subtrees. If that pattern has no
+// handler for the request's method, the mux answers 405 with an Allow
+// header, or 204 with the Allow header to an OPTIONS request. Handlers
+// registered without a method get every method.
 type Mux struct {
-	routes map[string]http.HandlerFunc
+	routes     map[string]*route // Routes by path pattern
+	entries    []muxEntry        // Routes, most specific first
+	middleware []Middleware
+	handler    http.Handler // Dispatch wrapped in the middleware
 }
 
+// Middleware wraps the handling of every request, such as to log or
+// authenticate it
+type Middleware func(http.Handler) http.Handler
+
 // muxEntry represents a route entry in the mux
 type muxEntry struct {
 	pattern string
-	handler http.HandlerFunc
+	route   *route
+}
+
+// route holds the handlers registered for one path pattern
+type route struct {
+	segments []segment
+	subtree  bool   // Matches any further segments
+	rest     string // Parameter holding the further segments
+	methods  map[string]http.Handler
+	any      http.Handler // Handler registered without a method
 }
 
+// segment is one element of a path pattern, a literal or a parameter
+type segment struct {
+	literal string
+	param   string
+}
+
+// pathParamsKey is the context key of a request's path parameters
+type pathParamsKey struct{}
+
 // NewMux creates a new custom multiplexer
 func NewMux() *Mux {
-	return &Mux{
-		routes: make(map[string]http.HandlerFunc),
+	m := &Mux{
+		routes: make(map[string]*route),
+	}
+	m.handler = http.HandlerFunc(m.dispatch)
+	return m
+}
+
+// Handle registers a handler for a pattern. It panics if the pattern is
+// malformed or already has a handler for the method.
+func (m *Mux) Handle(pattern string, handler http.Handler) {
+	method, path := "", pattern
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		method, path = pattern[:i], strings.TrimLeft(pattern[i+1:], " ")
+	}
+
+	rt, ok := m.routes[path]
+	if !ok {
+		rt = parseRoute(path)
+		m.routes[path] = rt
+		m.entries = appendSorted(m.entries, muxEntry{pattern: path, route: rt})
+	}
+
+	switch {
+	case method == "":
+		if rt.any != nil {
+			panic("httpserver: multiple registrations for " + pattern)
+		}
+		rt.any = handler
+	case rt.methods[method] != nil:
+		panic("httpserver: multiple registrations for " + pattern)
+	default:
+		rt.methods[method] = handler
 	}
 }
 
 // HandleFunc registers a handler function for a given pattern
 func (m *Mux) HandleFunc(pattern string, handler http.HandlerFunc) {
-	m.routes[pattern] = handler
+	m.Handle(pattern, handler)
+}
+
+// Use adds middleware around every request the mux handles, including
+// those answered with 404 or 405. Middleware added first runs first.
+func (m *Mux) Use(middleware ...Middleware) {
+	m.middleware = append(m.middleware, middleware...)
+
+	var handler http.Handler = http.HandlerFunc(m.dispatch)
+	for i := len(m.middleware) - 1; i >= 0; i-- {
+		handler = m.middleware[i](handler)
+	}
+	m.handler = handler
 }
 
 // ServeHTTP implements the http.Handler interface
 func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Look for exact match first
-	if handler, ok := m.routes[r.URL.Path]; ok {
-		handler(w, r)
+	m.handler.ServeHTTP(w, r)
+}
+
+// dispatch hands a request to the handler of the route it matches
+func (m *Mux) dispatch(w http.ResponseWriter, r *http.Request) {
+	rt, params := m.match(r.URL.Path)
+	if rt == nil {
+		// No match found
+		http.NotFound(w, r)
+		return
+	}
+	if len(params) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+	}
+
+	handler := rt.handler(r.Method)
+	if handler == nil {
+		w.Header().Set("Allow", rt.allowed())
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	handler.ServeHTTP(w, r)
+}
+
+// match returns the most specific route matching a path and the values
+// of its parameters
+func (m *Mux) match(path string) (*route, map[string]string) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, nil
+	}
+	parts := strings.Split(path[1:], "/")
+	for _, entry := range m.entries {
+		if params, ok := entry.route.match(parts); ok {
+			return entry.route, params
+		}
+	}
+	return nil, nil
+}
+
+// PathParam returns the value of a path parameter of the route that
+// matched the request, or "" if it has no such parameter
+func PathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// parseRoute parses the path of a pattern
+func parseRoute(path string) *route {
+	if !strings.HasPrefix(path, "/") {
+		panic("httpserver: pattern path must start with /: " + path)
+	}
+
+	rt := &route{methods: make(map[string]http.Handler)}
+	parts := strings.Split(path[1:], "/")
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch {
+		case last && part == "":
+			// A trailing slash matches the subtree
+			rt.subtree = true
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}"):
+			if !last {
+				panic("httpserver: {name...} must end the pattern: " + path)
+			}
+			rt.subtree = true
+			rt.rest = part[1 : len(part)-4]
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			rt.segments = append(rt.segments, segment{param: part[1 : len(part)-1]})
+		default:
+			rt.segments = append(rt.segments, segment{literal: part})
+		}
+	}
+	return rt
+}
+
+// match matches the segments of a path against the route
+func (rt *route) match(parts []string) (map[string]string, bool) {
+	// A subtree starts after a slash, so it needs at least one more part
+	if rt.subtree && len(parts) <= len(rt.segments) || !rt.subtree && len(parts) != len(rt.segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, seg := range rt.segments {
+		switch {
+		case seg.param == "":
+			if parts[i] != seg.literal {
+				return nil, false
+			}
+		case parts[i] == "":
+			return nil, false
+		default:
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[seg.param] = parts[i]
+		}
+	}
+
+	if rt.rest != "" {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[rt.rest] = strings.Join(parts[len(rt.segments):], "/")
+	}
+	return params, true
+}
+
+// handler returns the handler for a method. HEAD requests fall back to
+// the GET handler.
+func (rt *route) handler(method string) http.Handler {
+	if handler, ok := rt.methods[method]; ok {
+		return handler
+	}
+	if method == http.MethodHead {
+		if handler, ok := rt.methods[http.MethodGet]; ok {
+			return handler
+		}
+	}
+	return rt.any
+}
+
+// allowed returns the methods the route answers, for the Allow header
+func (rt *route) allowed() string {
+	methods := []string{http.MethodOptions}
+	for method := range rt.methods {
+		methods = append(methods, method)
+	}
+	if _, ok := rt.methods[http.MethodGet]; ok {
+		if _, ok := rt.methods[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
 
-	// No match found
-	http.NotFound(w, r)
+// literals counts the literal segments of the route
+func (rt *route) literals() int {
+	n := 0
+	for _, seg := range rt.segments {
+		if seg.param == "" {
+			n++
+		}
+	}
+	return n
 }
 
-// appendSorted is a helper function, likely for maintaining sorted routes
+// moreSpecific reports whether route a is tried before route b
+func moreSpecific(a, b *route) bool {
+	if la, lb := a.literals(), b.literals(); la != lb {
+		return la > lb
+	}
+	if len(a.segments) != len(b.segments) {
+		return len(a.segments) > len(b.segments)
+	}
+	return !a.subtree && b.subtree
+}
+
+// appendSorted inserts an entry after those at least as specific, so
+// routes are tried most specific first and equally specific ones in the
+// order they were registered
 func appendSorted(entries []muxEntry, entry muxEntry) []muxEntry {
-	return append(entries, entry)
-} 
\ No newline at end of file
+	i := sort.Search(len(entries), func(i int) bool {
+		return moreSpecific(entry.route, entries[i].route)
+	})
+	entries = append(entries, muxEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	return entries
+}
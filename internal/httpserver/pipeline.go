@@ -0,0 +1,256 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"file-sharing-utility/internal/protocol"
+)
+
+// Pipelined mode. A stream that sends {"type": "pipeline"} stops handling
+// one command at a time: from then on every command must carry an ID, up
+// to the server's pipeline limit run at once, and each reply is tagged
+// with the ID of its command as soon as it is ready, so replies may come
+// back out of order. Params["limit"] asks for a lower limit than the
+// server's. {"type": "cancel", "params": {"id": ...}} cancels a command
+// still in flight; the cancelled command then replies with status 499 and
+// code "cancelled". Streaming transfers and watches need the stream to
+// themselves and are refused in pipelined mode.
+
+const (
+	// DefaultPipelineLimit is the default number of commands a pipelined
+	// stream runs at once
+	DefaultPipelineLimit = 8
+
+	// pipelineQueueFactor times the limit is how many commands may be in
+	// flight, running or waiting for a slot, before new ones are refused
+	pipelineQueueFactor = 4
+
+	// DefaultPipelineDrainTimeout is how long commands still in flight may
+	// run once the client has closed its side of the stream
+	DefaultPipelineDrainTimeout = 30 * time.Second
+
+	// pipelineCancelTimeout is how long cancelled commands get to report
+	// it before the stream is closed without their replies
+	pipelineCancelTimeout = time.Second
+)
+
+// SetPipelineLimit sets how many commands a pipelined stream runs at once
+func (s *Server) SetPipelineLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	s.pipelineLimit = limit
+}
+
+// SetPipelineDrainTimeout sets how long a pipelined stream waits for its
+// commands once the client is done sending, before cancelling them
+func (s *Server) SetPipelineDrainTimeout(timeout time.Duration) {
+	s.pipelineDrain = timeout
+}
+
+// pipeline runs the commands of one stream concurrently
+type pipeline struct {
+	server *Server
+	ctx    context.Context
+
+	// writeLock keeps replies from interleaving on the stream
+	writeLock sync.Mutex
+	w         io.Writer
+
+	slots    chan struct{}
+	lock     sync.Mutex
+	inflight map[string]context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// startPipeline answers a pipeline command. It returns the pipeline to
+// hand the stream's commands to, or nil if the command was refused.
+func (s *Server) startPipeline(w io.Writer, cmd *protocol.Command) (*pipeline, error) {
+	limit := s.pipelineLimit
+	if value, ok := cmd.Params["limit"]; ok {
+		requested, err := strconv.Atoi(value)
+		if err != nil || requested < 1 {
+			reply := errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid limit")
+			return nil, protocol.WriteFrame(w, reply.WithID(cmd.ID))
+		}
+		if requested < limit {
+			limit = requested
+		}
+	}
+
+	p := &pipeline{
+		server:   s,
+		w:        w,
+		slots:    make(chan struct{}, limit),
+		inflight: make(map[string]context.CancelFunc),
+	}
+
+	reply := newResponse(protocol.TypePipeline, &protocol.PipelineResult{Limit: limit})
+	return p, protocol.WriteFrame(w, reply.WithID(cmd.ID))
+}
+
+// run reads and dispatches commands until the stream ends. Commands still
+// in flight are finished if the client only closed its side of the
+// stream, and cancelled otherwise or once the drain timeout passes.
+func (p *pipeline) run(reader *commandReader) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.ctx = ctx
+
+	for {
+		cmd, err := reader.readCommand()
+		var malformed *malformedCommandError
+		if errors.As(err, &malformed) {
+			p.reply(errorResponse(http.StatusBadRequest, protocol.CodeInvalidCommand, "Error: %v", malformed.err))
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Failed to read command: %v", err)
+				cancel()
+			}
+			break
+		}
+
+		p.dispatch(cmd)
+	}
+
+	if ctx.Err() != nil || !p.wait(p.server.pipelineDrain) {
+		cancel()
+		if !p.wait(pipelineCancelTimeout) {
+			// Stuck in a call that ignores the context, such as opening
+			// a FIFO; its reply fails once the stream is closed
+			log.Printf("Pipelined commands still running, closing the stream")
+		}
+	}
+}
+
+// wait waits for the commands in flight to finish. It reports false if
+// they did not within timeout.
+func (p *pipeline) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// dispatch answers control commands and starts everything else
+func (p *pipeline) dispatch(cmd *protocol.Command) {
+	switch {
+	case cmd.ID == "":
+		p.reply(errorResponse(http.StatusBadRequest, protocol.CodeInvalidCommand, "Error: Pipelined commands need an ID"))
+		return
+	case cmd.Type == "cancel":
+		p.reply(p.cancel(cmd.Params["id"]).WithID(cmd.ID))
+		return
+	case cmd.Type == "pipeline" || cmd.Type == "upload_stream" || cmd.Type == "download_stream" || cmd.Type == "watch":
+		p.reply(errorResponse(http.StatusBadRequest, protocol.CodeInvalidCommand,
+			"Error: %s is not supported in pipelined mode", cmd.Type).WithID(cmd.ID))
+		return
+	}
+
+	p.lock.Lock()
+	if _, ok := p.inflight[cmd.ID]; ok {
+		p.lock.Unlock()
+		p.reply(errorResponse(http.StatusConflict, protocol.CodeDuplicateID,
+			"Error: Command %s is already in flight", cmd.ID).WithID(cmd.ID))
+		return
+	}
+	if len(p.inflight) >= cap(p.slots)*pipelineQueueFactor {
+		p.lock.Unlock()
+		p.reply(errorResponse(http.StatusTooManyRequests, protocol.CodeTooManyCommands,
+			"Error: Too many commands in flight").WithID(cmd.ID))
+		return
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.inflight[cmd.ID] = cancel
+	p.lock.Unlock()
+
+	p.wg.Add(1)
+	go p.execute(ctx, cmd)
+}
+
+// execute runs a command once a slot is free and sends its reply
+func (p *pipeline) execute(ctx context.Context, cmd *protocol.Command) {
+	defer p.wg.Done()
+
+	// A command that got to run reports what it did, which is the
+	// cancellation only if it stopped on it
+	var response *protocol.Response
+	select {
+	case p.slots <- struct{}{}:
+		if ctx.Err() == nil {
+			response = p.server.processCommand(ctx, cmd)
+		}
+		<-p.slots
+	case <-ctx.Done():
+	}
+	if response == nil {
+		response = errorResponse(protocol.StatusCancelled, protocol.CodeCancelled, "Error: Command %s was cancelled", cmd.ID).WithID(cmd.ID)
+	}
+
+	p.lock.Lock()
+	p.inflight[cmd.ID]()
+	delete(p.inflight, cmd.ID)
+	p.lock.Unlock()
+
+	p.reply(response)
+}
+
+// cancel cancels the command with the given ID
+func (p *pipeline) cancel(id string) *protocol.Response {
+	p.lock.Lock()
+	cancel, ok := p.inflight[id]
+	p.lock.Unlock()
+
+	if !ok {
+		return errorResponse(http.StatusNotFound, protocol.CodeNotFound, "Error: No command %s in flight", id)
+	}
+	cancel()
+	return newResponse(protocol.TypeCancel, &protocol.CancelResult{ID: id})
+}
+
+// reply sends a reply, serialized with the others
+func (p *pipeline) reply(response *protocol.Response) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	if err := protocol.WriteFrame(p.w, response); err != nil {
+		log.Printf("Failed to send reply: %v", err)
+	}
+}
+
+// contextReader returns a reader that fails with ctx's error once ctx is
+// cancelled
+func contextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &ctxReader{ctx: ctx, r: r}
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
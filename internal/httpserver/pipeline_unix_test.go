@@ -0,0 +1,158 @@
+//go:build unix
+
+package httpserver
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"file-sharing-utility/internal/protocol"
+)
+
+// blockingFile creates a FIFO in dir. Opening it for reading blocks until
+// release writes content to it.
+func blockingFile(t *testing.T, dir, name string) (release func(content string)) {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := syscall.Mkfifo(path, 0644); err != nil {
+		t.Skipf("Cannot create FIFO: %v", err)
+	}
+	return func(content string) {
+		fifo, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Errorf("Failed to open FIFO: %v", err)
+			return
+		}
+		fifo.WriteString(content)
+		fifo.Close()
+	}
+}
+
+func TestPipelineRepliesOutOfOrder(t *testing.T) {
+	downloadDir := t.TempDir()
+	release := blockingFile(t, downloadDir, "slow")
+	stream := openCommandStream(t, NewServer(downloadDir, t.TempDir(), ""))
+
+	writeCommand(t, stream, &protocol.Command{Type: "pipeline"})
+	var result protocol.PipelineResult
+	readResponse(t, stream, &result)
+	if result.Limit != DefaultPipelineLimit {
+		t.Fatalf("Expected limit %d, got %d", DefaultPipelineLimit, result.Limit)
+	}
+
+	writeCommand(t, stream, &protocol.Command{ID: "slow", Type: "download", Path: "slow"})
+	writeCommand(t, stream, &protocol.Command{ID: "fast", Type: "info"})
+
+	// The info command overtakes the blocked download
+	if resp := readResponse(t, stream, nil); resp.ID != "fast" || resp.Type != protocol.TypeInfo {
+		t.Fatalf("Expected the info reply first, got %+v", resp)
+	}
+
+	release("data")
+	if resp := readResponse(t, stream, nil); resp.ID != "slow" || resp.Type != protocol.TypeFileData {
+		t.Errorf("Expected the download reply, got %+v", resp)
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	downloadDir := t.TempDir()
+	release := blockingFile(t, downloadDir, "slow")
+	stream := openCommandStream(t, NewServer(downloadDir, t.TempDir(), ""))
+
+	writeCommand(t, stream, &protocol.Command{Type: "pipeline", Params: map[string]string{"limit": "1"}})
+	var result protocol.PipelineResult
+	readResponse(t, stream, &result)
+	if result.Limit != 1 {
+		t.Fatalf("Expected limit 1, got %d", result.Limit)
+	}
+
+	// The download takes the only slot, so the info command waits
+	writeCommand(t, stream, &protocol.Command{ID: "slow", Type: "download", Path: "slow"})
+	writeCommand(t, stream, &protocol.Command{ID: "queued", Type: "info"})
+	writeCommand(t, stream, &protocol.Command{ID: "c1", Type: "cancel", Params: map[string]string{"id": "queued"}})
+
+	replies := map[string]*protocol.Response{}
+	for i := 0; i < 2; i++ {
+		resp := readResponse(t, stream, nil)
+		replies[resp.ID] = resp
+	}
+	if resp := replies["c1"]; resp == nil || resp.Type != protocol.TypeCancel {
+		t.Errorf("Expected the cancel to be acknowledged, got %+v", resp)
+	}
+	if resp := replies["queued"]; resp == nil || resp.Status != protocol.StatusCancelled || resp.Code != protocol.CodeCancelled {
+		t.Errorf("Expected the queued command to be cancelled, got %+v", resp)
+	}
+
+	// A command already running answers for itself
+	writeCommand(t, stream, &protocol.Command{ID: "c2", Type: "cancel", Params: map[string]string{"id": "slow"}})
+	if resp := readResponse(t, stream, nil); resp.ID != "c2" || resp.Status != http.StatusOK {
+		t.Fatalf("Expected the cancel to be acknowledged, got %+v", resp)
+	}
+	release("data")
+	if resp := readResponse(t, stream, nil); resp.ID != "slow" || resp.Type != protocol.TypeFileData {
+		t.Errorf("Expected the download reply, got %+v", resp)
+	}
+}
+
+func TestPipelineDrainIsBounded(t *testing.T) {
+	downloadDir := t.TempDir()
+	release := blockingFile(t, downloadDir, "slow")
+	defer release("")
+	server := NewServer(downloadDir, t.TempDir(), "")
+	server.SetPipelineDrainTimeout(50 * time.Millisecond)
+	stream := openCommandStream(t, server)
+
+	writeCommand(t, stream, &protocol.Command{Type: "pipeline"})
+	readResponse(t, stream, nil)
+
+	// The download never finishes, yet the server lets go of the stream
+	// once the client is done sending
+	writeCommand(t, stream, &protocol.Command{ID: "slow", Type: "download", Path: "slow"})
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the server to close the stream, got %v", err)
+	}
+}
+
+func TestPipelineCancelAfterFinish(t *testing.T) {
+	downloadDir := t.TempDir()
+	blockingFile(t, downloadDir, "slow")
+	stream := openCommandStream(t, NewServer(downloadDir, t.TempDir(), ""))
+
+	writeCommand(t, stream, &protocol.Command{Type: "pipeline"})
+	readResponse(t, stream, nil)
+
+	// Opening the FIFO returns once the copy is reading it
+	writeCommand(t, stream, &protocol.Command{ID: "copy", Type: "copy", Path: "slow", Params: map[string]string{"to": "copied"}})
+	fifo, err := os.OpenFile(filepath.Join(downloadDir, "slow"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open FIFO: %v", err)
+	}
+
+	writeCommand(t, stream, &protocol.Command{ID: "c", Type: "cancel", Params: map[string]string{"id": "copy"}})
+	if resp := readResponse(t, stream, nil); resp.ID != "c" || resp.Type != protocol.TypeCancel {
+		t.Fatalf("Expected the cancel to be acknowledged, got %+v", resp)
+	}
+
+	// The copy does not look at the cancellation, so it finishes anyway
+	// and must say so
+	fifo.WriteString("data")
+	fifo.Close()
+	resp := readResponse(t, stream, nil)
+	if resp.ID != "copy" || resp.Type != protocol.TypeCopy {
+		t.Fatalf("Expected the copy to report its result, got %+v", resp)
+	}
+	if data, err := os.ReadFile(filepath.Join(downloadDir, "copied")); err != nil || string(data) != "data" {
+		t.Errorf("Expected the copy to be made, got %q, %v", data, err)
+	}
+}
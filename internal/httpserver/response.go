@@ -0,0 +1,54 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"file-sharing-utility/internal/protocol"
+)
+
+// Replies are protocol.Response envelopes; the helpers below build them.
+
+// newResponse builds a successful reply
+func newResponse(payloadType string, data interface{}) *protocol.Response {
+	return &protocol.Response{
+		Status: http.StatusOK,
+		Type:   payloadType,
+		Data:   data,
+	}
+}
+
+// errorResponse builds a failed reply
+func errorResponse(status int, code string, format string, args ...interface{}) *protocol.Response {
+	return &protocol.Response{
+		Status: status,
+		Code:   code,
+		Error:  fmt.Sprintf(format, args...),
+	}
+}
+
+// fileErrorResponse reports a failed file operation, telling a missing
+// file apart from other failures
+func fileErrorResponse(what string, err error) *protocol.Response {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return errorResponse(protocol.StatusCancelled, protocol.CodeCancelled, "Error %s: %v", what, err)
+	case errors.Is(err, fs.ErrNotExist):
+		return errorResponse(http.StatusNotFound, protocol.CodeNotFound, "Error %s: %v", what, err)
+	case errors.Is(err, fs.ErrPermission):
+		return errorResponse(http.StatusForbidden, protocol.CodePermissionDenied, "Error %s: %v", what, err)
+	case errors.Is(err, fs.ErrExist):
+		return errorResponse(http.StatusConflict, protocol.CodeAlreadyExists, "Error %s: %v", what, err)
+	default:
+		return errorResponse(http.StatusInternalServerError, protocol.CodeIOError, "Error %s: %v", what, err)
+	}
+}
+
+// Common failures shared by the commands
+var (
+	errMissingPath = errorResponse(http.StatusBadRequest, protocol.CodeMissingPath, "Error: Path not specified")
+	errInvalidPath = errorResponse(http.StatusBadRequest, protocol.CodeInvalidPath, "Error: Invalid path")
+)
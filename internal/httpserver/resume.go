@@ -0,0 +1,262 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"file-sharing-utility/internal/protocol"
+)
+
+// Resumable transfers. An upload that sets Params["offset"] or
+// Params["commit"] writes into a part file instead of replacing its
+// target. Part files are kept with the tus uploads, outside the served
+// directories, so no file a client can name collides with one. One
+// request at a time writes to a part file; others get CodeLocked. The
+// offset may be anywhere up to the end of the data already received, so
+// a client can resend a chunk it is unsure about; the part is cut off
+// after the data just written. Once the part is complete, "commit":
+// "true" moves it into place, after checking it against Params["sha256"]
+// if one is given.
+//
+// Downloads take Params["offset"] and Params["length"] to send only part
+// of a file. The stat command reports a file's size and SHA-256, or the
+// part's with Params["partial"] set, so clients can pick up where they
+// stopped and verify the result.
+
+// partsDir is the directory below the tus directory holding part files
+const partsDir = "parts"
+
+// transferRange is the part of a file a command covers
+type transferRange struct {
+	offset    int64
+	length    int64 // -1 for the rest of the file
+	hasOffset bool
+	commit    bool
+	sha256    string
+}
+
+// resumable reports whether an upload goes through a part file
+func (r *transferRange) resumable() bool {
+	return r.hasOffset || r.commit
+}
+
+// parseTransferRange reads the range parameters of a command
+func parseTransferRange(params map[string]string) (*transferRange, *protocol.Response) {
+	r := &transferRange{length: -1}
+
+	if value, ok := params["offset"]; ok {
+		offset, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid offset")
+		}
+		r.offset = offset
+		r.hasOffset = true
+	}
+
+	if value, ok := params["length"]; ok {
+		length, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || length < 0 {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid length")
+		}
+		r.length = length
+	}
+
+	r.commit = params["commit"] == "true"
+	r.sha256 = params["sha256"]
+	return r, nil
+}
+
+// section limits a file of the given size to the range. It returns the
+// offset and length to read.
+func (r *transferRange) section(size int64) (int64, int64, *protocol.Response) {
+	if r.offset > size {
+		return 0, 0, errorResponse(http.StatusRequestedRangeNotSatisfiable, protocol.CodeInvalidRange,
+			"Error: Offset %d is past the end of the file (%d bytes)", r.offset, size)
+	}
+
+	length := size - r.offset
+	if r.length >= 0 && r.length < length {
+		length = r.length
+	}
+	return r.offset, length, nil
+}
+
+// partPath returns the part file of an upload to cleanPath, in the parts
+// directory of the tus directory
+func (s *Server) partPath(cleanPath string) string {
+	key := sha256.Sum256([]byte(filepath.ToSlash(cleanPath)))
+	return filepath.Join(s.tus.dir, partsDir, hex.EncodeToString(key[:])+".part")
+}
+
+// writeResumable writes n bytes from src into the part file of an upload
+// to cleanPath, and moves it to target if the range asks for it
+func (s *Server) writeResumable(cleanPath, target string, rng *transferRange, src io.Reader, n int64) (*protocol.FileResult, *protocol.Response) {
+	partPath := s.partPath(cleanPath)
+	if _, err := os.Stat(partPath); errors.Is(err, fs.ErrNotExist) {
+		// Starting an upload clears out the abandoned ones, as for tus
+		s.tus.sweep(time.Now())
+	}
+
+	// Part files share the tus uploads' locks, under their file names
+	key := filepath.Base(partPath)
+	if !s.tus.acquire(key) {
+		return nil, errorResponse(http.StatusLocked, protocol.CodeLocked,
+			"Error: Another upload to %s is in progress", filepath.ToSlash(cleanPath))
+	}
+	defer s.tus.release(key)
+
+	if failure := writePart(partPath, rng, src, n); failure != nil {
+		return nil, failure
+	}
+	return finishPart(partPath, target, rng)
+}
+
+// writePart writes n bytes from src into a part file at the range's
+// offset, or at the end of the part if no offset was given
+func writePart(partPath string, rng *transferRange, src io.Reader, n int64) *protocol.Response {
+	if err := os.MkdirAll(filepath.Dir(partPath), 0755); err != nil {
+		return fileErrorResponse("creating directory", err)
+	}
+
+	part, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fileErrorResponse("creating file", err)
+	}
+	defer part.Close()
+
+	info, err := part.Stat()
+	if err != nil {
+		return fileErrorResponse("writing file", err)
+	}
+
+	offset := info.Size()
+	if rng.hasOffset {
+		if rng.offset > offset {
+			return errorResponse(http.StatusConflict, protocol.CodeOffsetMismatch,
+				"Error: Offset %d is past the %d bytes received", rng.offset, offset)
+		}
+		offset = rng.offset
+	}
+
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		return fileErrorResponse("writing file", err)
+	}
+	written, err := io.CopyN(part, src, n)
+	if err != nil {
+		return fileErrorResponse("writing file", err)
+	}
+
+	// Anything after the new data is stale
+	if err := part.Truncate(offset + written); err != nil {
+		return fileErrorResponse("writing file", err)
+	}
+	if err := part.Close(); err != nil {
+		return fileErrorResponse("writing file", err)
+	}
+	return nil
+}
+
+// finishPart moves a part file to target if the range asks for it, and
+// returns the size and SHA-256 of the data
+func finishPart(partPath, target string, rng *transferRange) (*protocol.FileResult, *protocol.Response) {
+	size, sum, err := fileSHA256(context.Background(), partPath)
+	if err != nil {
+		return nil, fileErrorResponse("reading file", err)
+	}
+
+	result := &protocol.FileResult{Size: size, SHA256: sum}
+	if !rng.commit {
+		return result, nil
+	}
+
+	if rng.sha256 != "" && rng.sha256 != sum {
+		return nil, errorResponse(http.StatusUnprocessableEntity, protocol.CodeChecksumMismatch,
+			"Error: Checksum %s does not match the data received (%s)", rng.sha256, sum)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, fileErrorResponse("creating directory", err)
+	}
+	staged, failure := stageFrom(partPath, filepath.Dir(target))
+	if failure != nil {
+		return nil, failure
+	}
+	if _, failure := staged.commit(target, overwriteReplace); failure != nil {
+		// Put the data back, so committing can be retried
+		if err := os.Rename(staged.name, partPath); err != nil {
+			staged.discard()
+		}
+		return nil, failure
+	}
+
+	result.Committed = true
+	return result, nil
+}
+
+// fileSHA256 returns the size and hex-encoded SHA-256 of a file, giving up
+// if ctx is cancelled
+func fileSHA256(ctx context.Context, path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, contextReader(ctx, file))
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// handleStatCommand reports the size, modification time and SHA-256 of a
+// file, or of its unfinished upload with Params["partial"] set
+func (s *Server) handleStatCommand(ctx context.Context, cmd *protocol.Command) *protocol.Response {
+	target, failure := s.resolvePath(cmd, cmd.Path)
+	if failure != nil {
+		return failure
+	}
+
+	partial := cmd.Params["partial"] == "true"
+	if partial {
+		cleanPath, failure := cleanCommandPath(cmd.Path)
+		if failure != nil {
+			return failure
+		}
+		target = s.partPath(cleanPath)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return fileErrorResponse("reading file", err)
+	}
+
+	result := &protocol.StatResult{
+		Path:    cmd.Path,
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode().String(),
+		Partial: partial,
+	}
+	if !info.IsDir() {
+		// Hash what is read, in case the file grew since the stat
+		size, sum, err := fileSHA256(ctx, target)
+		if err != nil {
+			return fileErrorResponse("reading file", err)
+		}
+		result.Size = size
+		result.SHA256 = sum
+	}
+
+	return newResponse(protocol.TypeStat, result)
+}
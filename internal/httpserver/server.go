@@ -2,15 +2,22 @@
 package httpserver
 
 import (
+	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"file-sharing-utility/internal/common"
+	"file-sharing-utility/internal/watch"
 	"file-sharing-utility/internal/xorrw"
+	"file-sharing-utility/internal/yamux"
 )
 
 // Server represents the HTTP server
@@ -19,20 +26,59 @@ type Server struct {
 	downloadPath string
 	uploadPath   string
 	xorKey       string
+
+	// Most commands a pipelined stream runs at once
+	pipelineLimit int
+
+	// How long a pipelined stream waits for its commands once the client
+	// is done sending
+	pipelineDrain time.Duration
+
+	// Largest request body of an upload, 0 for no limit
+	maxUploadSize int64
+
+	// Resumable uploads over the tus protocol
+	tus *tusStore
+
+	// Whether the admin endpoints answer, off by default since they
+	// expose who is connected
+	adminEnabled bool
+
+	// Checksums of unchanged files, for hash and manifest commands
+	hashes *hashCache
+
+	// Active watches, at most maxWatchers of them
+	watchers    map[*watch.Watcher]struct{}
+	maxWatchers int
+	watchLock   sync.Mutex
+
+	// Active yamux sessions
+	sessions    map[*yamux.Session]struct{}
+	sessionLock sync.Mutex
 }
 
 // NewServer creates a new HTTP server
 func NewServer(downloadPath, uploadPath, xorKey string) *Server {
 	server := &Server{
-		mux:          NewMux(),
-		downloadPath: downloadPath,
-		uploadPath:   uploadPath,
-		xorKey:       xorKey,
+		mux:           NewMux(),
+		downloadPath:  downloadPath,
+		uploadPath:    uploadPath,
+		xorKey:        xorKey,
+		pipelineLimit: DefaultPipelineLimit,
+		pipelineDrain: DefaultPipelineDrainTimeout,
+		hashes:        newHashCache(),
+		tus:           newTusStore(filepath.Clean(uploadPath) + tusDirSuffix),
+		watchers:      make(map[*watch.Watcher]struct{}),
+		maxWatchers:   DefaultMaxWatchers,
+		sessions:      make(map[*yamux.Session]struct{}),
 	}
 	
 	// Set up HTTP routes
 	server.setupRoutes()
 	
+	// Clear out batches interrupted by a crash
+	server.removeStaging()
+	
 	return server
 }
 
@@ -42,67 +88,46 @@ func (s *Server) ListenAndServe(addr string) error {
 	return http.ListenAndServe(addr, s.mux)
 }
 
+// ServeHTTP dispatches a request to the server's routes, so the server can
+// be mounted on any listener
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
 // setupRoutes configures the HTTP routes
 func (s *Server) setupRoutes() {
 	// Handle file uploads
-	s.mux.HandleFunc("/upload", s.handleUpload)
+	s.mux.HandleFunc("POST /upload", s.handleUpload)
 	
 	// Handle file downloads
-	s.mux.HandleFunc("/download", s.handleDownload)
+	s.mux.HandleFunc("GET /download", s.handleDownload)
 	
 	// Simple status endpoint
-	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("GET /status", s.handleStatus)
+	
+	// JSON directory listings
+	s.mux.HandleFunc("GET /list", s.handleList)
+	
+	// Change feeds as Server-Sent Events
+	s.mux.HandleFunc("GET /events", s.handleEvents)
+	
+	// REST API over the served directories
+	s.setupAPI()
+	
+	// Resumable uploads
+	s.setupTus()
 }
 
-// handleUpload handles file upload requests
-func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Failed to get file from request", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	// Create the target file
-	targetPath := filepath.Join(s.uploadPath, header.Filename)
-	target, err := os.Create(targetPath)
-	if err != nil {
-		http.Error(w, "Failed to create target file", http.StatusInternalServerError)
-		return
-	}
-	defer target.Close()
-
-	// Apply XOR encoding if a key is provided
-	var writer io.Writer = target
-	if s.xorKey != "" {
-		xorWriter := xorrw.NewXorReaderWriter(target, []byte(s.xorKey))
-		defer xorWriter.Close()
-		writer = xorWriter
-	}
-
-	// Copy the file contents
-	_, err = common.WriteBlob(writer, file)
-	if err != nil {
-		http.Error(w, "Failed to write file", http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("File uploaded successfully"))
+// Use adds middleware around every request the server handles, such as
+// logging or authentication
+func (s *Server) Use(middleware ...Middleware) {
+	s.mux.Use(middleware...)
 }
 
-// handleDownload handles file download requests
+// handleDownload handles file download requests. Range requests get the
+// requested bytes, as one part or as multipart/byteranges, and requests
+// whose If-None-Match or If-Modified-Since still match get a 304.
 func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	filename := r.URL.Query().Get("file")
 	if filename == "" {
 		http.Error(w, "Filename not provided", http.StatusBadRequest)
@@ -123,35 +148,64 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Get file info for Content-Length header
+	// Get file info for the validators and Content-Length header
 	info, err := file.Stat()
 	if err != nil {
 		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
 		return
 	}
+	if info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 
 	// Set response headers
 	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("ETag", s.downloadETag(info))
 
-	// Apply XOR decoding if a key is provided
-	var reader io.Reader = file
+	// Apply XOR decoding if a key is provided. The key position follows
+	// the file offset, so any range decodes correctly.
+	var content io.ReadSeeker = file
 	if s.xorKey != "" {
-		xorReader := xorrw.NewXorReaderWriter(file, []byte(s.xorKey))
-		defer xorReader.Close()
-		reader = xorReader
+		content = xorrw.NewXorReadSeeker(file, []byte(s.xorKey))
 	}
 
-	// Copy the file to the response
-	_, err = common.WriteBlob(w, reader)
-	if err != nil {
-		log.Printf("Error downloading file: %v", err)
+	// Answer Range, If-Range and the conditional headers, and copy the
+	// selected bytes to the response
+	http.ServeContent(w, r, filename, info.ModTime(), content)
+}
+
+// downloadETag returns the entity tag of a downloaded file. It changes
+// with the file's size and modification time, and with the XOR key, since
+// the key changes the bytes sent.
+func (s *Server) downloadETag(info os.FileInfo) string {
+	tag := fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano())
+	if s.xorKey != "" {
+		key := fnv.New32a()
+		key.Write([]byte(s.xorKey))
+		tag += fmt.Sprintf("-%x", key.Sum32())
 	}
+	return strconv.Quote(tag)
 }
 
 // handleStatus returns system information
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	info := common.GetInfo()
-	w.Write([]byte(info.String()))
+
+	var result strings.Builder
+	result.WriteString(info.String())
+
+	// Report the round-trip time measured by each session's keep-alive
+	sessions := s.activeSessions()
+	result.WriteString(fmt.Sprintf("Yamux Sessions: %d\n", len(sessions)))
+	for _, session := range sessions {
+		rtt := "unknown"
+		if d := session.RTT(); d > 0 {
+			rtt = d.String()
+		}
+		result.WriteString(fmt.Sprintf("Yamux RTT (%s): %s\n", session.RemoteAddr(), rtt))
+	}
+
+	w.Write([]byte(result.String()))
 }
\ No newline at end of file
@@ -0,0 +1,177 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"file-sharing-utility/internal/protocol"
+)
+
+// Streaming transfers move file contents as raw bytes on the command's
+// stream instead of inside the JSON command, so files of any size pass
+// through in constant memory.
+//
+// upload_stream: the client sends the command with Params["size"] and then
+// exactly that many raw bytes. The server replies with a transfer_status
+// response.
+//
+// download_stream: the server replies with a transfer_header response,
+// then Size raw bytes, then a transfer_status response.
+//
+// Both take the range parameters of resumable transfers.
+
+// handleUploadStreamCommand receives a file sent as raw bytes after the
+// command. The announced bytes are always consumed, even on failure, so
+// the stream stays usable for further commands.
+func (s *Server) handleUploadStreamCommand(rw io.ReadWriter, cmd *protocol.Command) error {
+	size, err := strconv.ParseInt(cmd.Params["size"], 10, 64)
+	if err != nil || size < 0 {
+		// Without a size we cannot find the next command
+		protocol.WriteFrame(rw, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid size").WithID(cmd.ID))
+		return fmt.Errorf("invalid upload size %q", cmd.Params["size"])
+	}
+
+	// Count what is read, a failed write may have consumed more than it
+	// stored
+	body := &countingReader{r: rw}
+	status, failure := s.receiveUpload(body, cmd, size)
+	if failure != nil {
+		// Skip whatever is left of the announced data
+		if _, err := io.CopyN(io.Discard, rw, size-body.n); err != nil {
+			return err
+		}
+		return protocol.WriteFrame(rw, failure.WithID(cmd.ID))
+	}
+
+	return protocol.WriteFrame(rw, newResponse(protocol.TypeTransferStatus, status).WithID(cmd.ID))
+}
+
+// receiveUpload stores size bytes from r under the upload path. The data
+// goes to a temporary file that replaces the target once complete, or to
+// the part file for resumed uploads.
+func (s *Server) receiveUpload(r io.Reader, cmd *protocol.Command, size int64) (*protocol.TransferStatus, *protocol.Response) {
+	cleanPath, failure := cleanCommandPath(cmd.Path)
+	if failure != nil {
+		return nil, failure
+	}
+
+	rng, failure := parseTransferRange(cmd.Params)
+	if failure != nil {
+		return nil, failure
+	}
+
+	targetPath := filepath.Join(s.uploadPath, cleanPath)
+	if rng.resumable() {
+		result, failure := s.writeResumable(cleanPath, targetPath, rng, r, size)
+		if failure != nil {
+			return nil, failure
+		}
+		return &protocol.TransferStatus{Size: result.Size, SHA256: result.SHA256, Committed: result.Committed}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return nil, fileErrorResponse("creating directory", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(targetPath), ".upload-*")
+	if err != nil {
+		return nil, fileErrorResponse("creating file", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	n, err := io.CopyN(io.MultiWriter(tmp, hash), r, size)
+	if err != nil {
+		return nil, fileErrorResponse("writing file", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, fileErrorResponse("writing file", err)
+	}
+	if err := os.Rename(tmp.Name(), targetPath); err != nil {
+		return nil, fileErrorResponse("writing file", err)
+	}
+
+	return &protocol.TransferStatus{Size: n, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// handleDownloadStreamCommand sends a file as raw bytes between a header
+// and a status reply
+func (s *Server) handleDownloadStreamCommand(w io.Writer, cmd *protocol.Command) error {
+	rng, failure := parseTransferRange(cmd.Params)
+	if failure != nil {
+		return protocol.WriteFrame(w, failure.WithID(cmd.ID))
+	}
+
+	file, size, failure := s.openDownload(cmd.Path)
+	if failure != nil {
+		return protocol.WriteFrame(w, failure.WithID(cmd.ID))
+	}
+	defer file.Close()
+
+	offset, length, failure := rng.section(size)
+	if failure != nil {
+		return protocol.WriteFrame(w, failure.WithID(cmd.ID))
+	}
+
+	header := newResponse(protocol.TypeTransferHeader, &protocol.TransferHeader{Size: length, Offset: offset})
+	if err := protocol.WriteFrame(w, header.WithID(cmd.ID)); err != nil {
+		return err
+	}
+
+	// The size was promised, so a short read leaves the stream unusable
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(w, hash), io.NewSectionReader(file, offset, length), length); err != nil {
+		return fmt.Errorf("sending %s: %w", cmd.Path, err)
+	}
+
+	status := newResponse(protocol.TypeTransferStatus, &protocol.TransferStatus{
+		Size:   length,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	})
+	return protocol.WriteFrame(w, status.WithID(cmd.ID))
+}
+
+// openDownload opens a file under the download path and returns its size
+func (s *Server) openDownload(path string) (*os.File, int64, *protocol.Response) {
+	cleanPath, failure := cleanCommandPath(path)
+	if failure != nil {
+		return nil, 0, failure
+	}
+
+	file, err := os.Open(filepath.Join(s.downloadPath, cleanPath))
+	if err != nil {
+		return nil, 0, fileErrorResponse("reading file", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fileErrorResponse("reading file", err)
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, 0, errorResponse(http.StatusBadRequest, protocol.CodeInvalidPath, "Error reading file: %s is a directory", path)
+	}
+
+	return file, info.Size(), nil
+}
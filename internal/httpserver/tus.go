@@ -0,0 +1,667 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"file-sharing-utility/internal/protocol"
+	"file-sharing-utility/internal/xorrw"
+)
+
+// Resumable uploads over the tus protocol, version 1.0.0, with the
+// creation, termination, checksum and expiration extensions
+// (https://tus.io/protocols/resumable-upload):
+//
+//	OPTIONS /tus         the protocol versions, extensions, maximum size
+//	                     and checksum algorithms served
+//	POST    /tus         creates an upload of Upload-Length bytes and
+//	                     answers 201 with its URL in Location
+//	HEAD    /tus/{id}    the upload's Upload-Offset and Upload-Length
+//	PATCH   /tus/{id}    appends the body at Upload-Offset, checked against
+//	                     Upload-Checksum if given
+//	DELETE  /tus/{id}    abandons the upload
+//
+// The filename key of Upload-Metadata names the file below the upload
+// directory, the upload's ID being used without one. A finished upload
+// replaces any file there, XOR-encoded like /upload stores files.
+//
+// Uploads in progress are kept in a directory outside the served ones,
+// next to the upload directory unless SetTusDir says otherwise, each as
+// its data so far and its state in JSON, so they can be resumed after a
+// restart. An upload expires defaultTusExpiry after it was last written
+// to; expired uploads are removed when new ones are created, and so are
+// the part files of resumable uploads left alone as long.
+
+const (
+	// tusVersion is the protocol version served
+	tusVersion = "1.0.0"
+
+	// tusExtensions are the protocol extensions served
+	tusExtensions = "creation,termination,checksum,expiration"
+
+	// tusPath is the URL uploads are created at, and the prefix of the
+	// URLs of uploads
+	tusPath = "/tus"
+
+	// tusDirSuffix names the default directory holding uploads in
+	// progress, after the upload directory
+	tusDirSuffix = ".tus"
+
+	// defaultTusExpiry is how long an upload is kept after it was last
+	// written to
+	defaultTusExpiry = 24 * time.Hour
+)
+
+// StatusChecksumMismatch is the status of a PATCH whose data does not
+// match its Upload-Checksum, defined by the tus checksum extension
+const StatusChecksumMismatch = 460
+
+// tusUpload is the state of an upload, as stored next to its data
+type tusUpload struct {
+	ID       string    `json:"id"`
+	Length   int64     `json:"length"`
+	Offset   int64     `json:"offset"`
+	Metadata string    `json:"metadata,omitempty"` // Upload-Metadata as sent
+	Path     string    `json:"path"`               // Slash-separated, below the upload directory
+	Expires  time.Time `json:"expires"`
+	Done     bool      `json:"done,omitempty"`
+}
+
+// tusStore keeps the uploads in progress in a directory
+type tusStore struct {
+	dir    string
+	expiry time.Duration
+
+	lock sync.Mutex
+	busy map[string]bool // Uploads and part files a request is working on
+}
+
+// newTusStore creates a store keeping uploads in dir, which is created
+// with the first upload
+func newTusStore(dir string) *tusStore {
+	return &tusStore{
+		dir:    dir,
+		expiry: defaultTusExpiry,
+		busy:   make(map[string]bool),
+	}
+}
+
+// SetTusDir sets the directory resumable uploads in progress are kept in.
+// It fails if the directory is the download or upload directory or below
+// them, where clients could change the uploads' state. Finished uploads
+// are moved rather than copied if it is on the same filesystem as the
+// upload directory.
+func (s *Server) SetTusDir(dir string) error {
+	for _, served := range []string{s.downloadPath, s.uploadPath} {
+		if pathWithin(dir, served) {
+			return fmt.Errorf("tus directory %s is inside the served directory %s", dir, served)
+		}
+	}
+	s.tus.dir = dir
+	return nil
+}
+
+// pathWithin reports whether path is dir or below it, once both are
+// absolute and their symbolic links resolved
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(realPath(dir), realPath(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// realPath returns path made absolute, with the symbolic links of the
+// part of it that exists resolved
+func realPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	for dir, rest := abs, ""; ; {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs
+		}
+		dir, rest = parent, filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// setupTus registers the tus routes
+func (s *Server) setupTus() {
+	s.mux.HandleFunc("OPTIONS "+tusPath, tusProtocol(s.handleTusOptions))
+	s.mux.HandleFunc("POST "+tusPath, tusProtocol(s.handleTusCreate))
+
+	upload := tusPath + "/{id}"
+	s.mux.HandleFunc("OPTIONS "+upload, tusProtocol(s.handleTusOptions))
+	s.mux.HandleFunc("HEAD "+upload, tusProtocol(s.handleTusHead))
+	s.mux.HandleFunc("PATCH "+upload, tusProtocol(s.handleTusPatch))
+	s.mux.HandleFunc("DELETE "+upload, tusProtocol(s.handleTusDelete))
+}
+
+// tusProtocol checks the protocol version of a tus request, and marks the
+// response with the version served
+func tusProtocol(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			writeAPIResponse(w, errorResponse(http.StatusPreconditionFailed, protocol.CodeInvalidParams,
+				"Error: Unsupported tus version %q", r.Header.Get("Tus-Resumable")))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleTusOptions describes the protocol served
+func (s *Server) handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	algorithms := make([]string, 0, len(hashAlgorithms))
+	for algorithm := range hashAlgorithms {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", strings.Join(algorithms, ","))
+	if s.maxUploadSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.maxUploadSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTusCreate creates an upload
+func (s *Server) handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeAPIResponse(w, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams,
+			"Error: Upload-Defer-Length is not supported"))
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeAPIResponse(w, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams,
+			"Error: Invalid Upload-Length %q", r.Header.Get("Upload-Length")))
+		return
+	}
+	if s.maxUploadSize > 0 && length > s.maxUploadSize {
+		writeAPIResponse(w, errorResponse(http.StatusRequestEntityTooLarge, protocol.CodeTooLarge,
+			"Error: Upload larger than %d bytes", s.maxUploadSize))
+		return
+	}
+
+	metadata, failure := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+
+	id, err := newTusID()
+	if err != nil {
+		writeAPIResponse(w, errorResponse(http.StatusInternalServerError, protocol.CodeIOError, "Error creating upload: %v", err))
+		return
+	}
+	name := metadata["filename"]
+	if name == "" {
+		name = id
+	}
+	cmd := &protocol.Command{Type: "upload", Path: name, Params: map[string]string{"location": "upload"}}
+	target, failure := s.resolveEntry(cmd, name)
+	if failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+	rel, err := filepath.Rel(s.uploadPath, target)
+	if err != nil {
+		writeAPIResponse(w, fileErrorResponse("creating upload", err))
+		return
+	}
+
+	s.tus.sweep(time.Now())
+
+	upload := &tusUpload{
+		ID:       id,
+		Length:   length,
+		Metadata: r.Header.Get("Upload-Metadata"),
+		Path:     filepath.ToSlash(rel),
+		Expires:  time.Now().Add(s.tus.expiry),
+	}
+	if failure := s.tus.create(upload); failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+
+	// An empty upload is finished as soon as it exists
+	if length == 0 {
+		if failure := s.finishTusUpload(upload); failure != nil {
+			writeAPIResponse(w, failure)
+			return
+		}
+	}
+
+	w.Header().Set("Location", tusPath+"/"+id)
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleTusHead reports the progress of an upload
+func (s *Server) handleTusHead(w http.ResponseWriter, r *http.Request) {
+	upload, failure := s.tus.load(PathParam(r, "id"), time.Now())
+	if failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTusPatch appends data to an upload, and finishes it once all of it
+// has arrived
+func (s *Server) handleTusPatch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeAPIResponse(w, errorResponse(http.StatusUnsupportedMediaType, protocol.CodeInvalidParams,
+			"Error: Content-Type must be application/offset+octet-stream"))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeAPIResponse(w, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams,
+			"Error: Invalid Upload-Offset %q", r.Header.Get("Upload-Offset")))
+		return
+	}
+	check, expected, failure := parseTusChecksum(r.Header.Get("Upload-Checksum"))
+	if failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+
+	id := PathParam(r, "id")
+	if !s.tus.acquire(id) {
+		writeAPIResponse(w, errorResponse(http.StatusLocked, protocol.CodeLocked,
+			"Error: Upload %s is busy with another request", id))
+		return
+	}
+	defer s.tus.release(id)
+
+	upload, failure := s.tus.load(id, time.Now())
+	if failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+	if offset != upload.Offset {
+		writeAPIResponse(w, errorResponse(http.StatusConflict, protocol.CodeOffsetMismatch,
+			"Error: Upload-Offset is %d, the upload is at %d", offset, upload.Offset))
+		return
+	}
+
+	if !upload.Done {
+		if failure := s.appendTusData(upload, r.Body, check, expected); failure != nil {
+			writeAPIResponse(w, failure)
+			return
+		}
+		if upload.Offset == upload.Length {
+			if failure := s.finishTusUpload(upload); failure != nil {
+				writeAPIResponse(w, failure)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendTusData writes the body of a PATCH at the upload's offset. Data
+// received before the request broke off is kept, unless it came with a
+// checksum, which it cannot be checked against. Anything past what was
+// kept, such as data written when the server stopped during a PATCH and
+// never recorded, is cut off.
+func (s *Server) appendTusData(upload *tusUpload, r io.Reader, check hash.Hash, expected []byte) *protocol.Response {
+	file, err := os.OpenFile(s.tus.dataPath(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return fileErrorResponse("writing upload", err)
+	}
+	defer file.Close()
+
+	var writerAt io.WriterAt = file
+	if s.xorKey != "" {
+		writerAt = xorrw.NewXorWriterAt(file, []byte(s.xorKey))
+	}
+	var writer io.Writer = &offsetWriter{w: writerAt, off: upload.Offset}
+	if check != nil {
+		writer = io.MultiWriter(writer, check)
+	}
+
+	// Read one byte more than the upload has room for, to spot overruns
+	body := &readErrorReader{r: r}
+	remaining := upload.Length - upload.Offset
+	n, err := io.Copy(writer, io.LimitReader(body, remaining+1))
+
+	var failure *protocol.Response
+	switch {
+	case n > remaining:
+		failure = errorResponse(http.StatusRequestEntityTooLarge, protocol.CodeTooLarge,
+			"Error: Data goes past Upload-Length %d", upload.Length)
+	case body.err != nil:
+		failure = uploadReadError(body.err)
+	case err != nil:
+		failure = fileErrorResponse("writing upload", err)
+	case check != nil && !bytes.Equal(check.Sum(nil), expected):
+		failure = errorResponse(StatusChecksumMismatch, protocol.CodeChecksumMismatch,
+			"Error: Data does not match Upload-Checksum")
+	}
+
+	if failure != nil && (check != nil || n > remaining) {
+		// Drop what was written
+		n = 0
+	}
+	if err := file.Truncate(upload.Offset + n); err != nil && failure == nil {
+		failure = fileErrorResponse("writing upload", err)
+	}
+
+	if n > 0 {
+		upload.Offset += n
+		upload.Expires = time.Now().Add(s.tus.expiry)
+		if err := s.tus.save(upload); err != nil && failure == nil {
+			failure = fileErrorResponse("writing upload", err)
+		}
+	}
+	return failure
+}
+
+// finishTusUpload moves a complete upload to its file
+func (s *Server) finishTusUpload(upload *tusUpload) *protocol.Response {
+	// The path is checked again, in case the stored state was changed
+	cmd := &protocol.Command{Type: "upload", Path: upload.Path, Params: map[string]string{"location": "upload"}}
+	target, failure := s.resolveEntry(cmd, filepath.FromSlash(upload.Path))
+	if failure != nil {
+		return failure
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fileErrorResponse("creating directory", err)
+	}
+
+	staged, failure := stageFrom(s.tus.dataPath(upload.ID), filepath.Dir(target))
+	if failure != nil {
+		return failure
+	}
+	if _, failure := staged.commit(target, overwriteReplace); failure != nil {
+		// Put the data back, so finishing can be retried
+		if err := os.Rename(staged.name, s.tus.dataPath(upload.ID)); err != nil {
+			staged.discard()
+		}
+		return failure
+	}
+
+	upload.Done = true
+	if err := s.tus.save(upload); err != nil {
+		return fileErrorResponse("writing upload", err)
+	}
+	return nil
+}
+
+// handleTusDelete abandons an upload
+func (s *Server) handleTusDelete(w http.ResponseWriter, r *http.Request) {
+	id := PathParam(r, "id")
+	if !s.tus.acquire(id) {
+		writeAPIResponse(w, errorResponse(http.StatusLocked, protocol.CodeLocked,
+			"Error: Upload %s is busy with another request", id))
+		return
+	}
+	defer s.tus.release(id)
+
+	if _, failure := s.tus.load(id, time.Now()); failure != nil {
+		writeAPIResponse(w, failure)
+		return
+	}
+	if err := s.tus.remove(id); err != nil {
+		writeAPIResponse(w, fileErrorResponse("removing upload", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseTusMetadata parses Upload-Metadata, a comma-separated list of keys
+// each followed by a space and its base64-encoded value, or alone
+func parseTusMetadata(header string) (map[string]string, *protocol.Response) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded := strings.TrimSpace(pair), ""
+		if i := strings.IndexByte(key, ' '); i >= 0 {
+			key, encoded = key[:i], key[i+1:]
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if key == "" || err != nil {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid Upload-Metadata %q", pair)
+		}
+		if _, ok := metadata[key]; ok {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Upload-Metadata repeats %s", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// parseTusChecksum parses Upload-Checksum, an algorithm and the base64
+// checksum of the request body. Both results are nil without the header.
+func parseTusChecksum(header string) (hash.Hash, []byte, *protocol.Response) {
+	if header == "" {
+		return nil, nil, nil
+	}
+
+	algorithm, encoded, _ := strings.Cut(header, " ")
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return nil, nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Unsupported algorithm %q", algorithm)
+	}
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid Upload-Checksum %q", header)
+	}
+	return newHash(), expected, nil
+}
+
+// newTusID returns a random upload ID
+func newTusID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// validTusID reports whether id could have come from newTusID, so it is
+// safe to use in file names
+func validTusID(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == 16
+}
+
+// offsetWriter writes to an io.WriterAt from an offset onwards
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// infoPath returns the file holding an upload's state
+func (t *tusStore) infoPath(id string) string {
+	return filepath.Join(t.dir, id+".info")
+}
+
+// dataPath returns the file holding an upload's data
+func (t *tusStore) dataPath(id string) string {
+	return filepath.Join(t.dir, id+".bin")
+}
+
+// acquire marks an upload busy, reporting false if it already was
+func (t *tusStore) acquire(id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.busy[id] {
+		return false
+	}
+	t.busy[id] = true
+	return true
+}
+
+// release marks an upload no longer busy
+func (t *tusStore) release(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.busy, id)
+}
+
+// create stores a new upload with no data
+func (t *tusStore) create(upload *tusUpload) *protocol.Response {
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return fileErrorResponse("creating upload", err)
+	}
+	data, err := os.OpenFile(t.dataPath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fileErrorResponse("creating upload", err)
+	}
+	data.Close()
+
+	if err := t.save(upload); err != nil {
+		os.Remove(t.dataPath(upload.ID))
+		return fileErrorResponse("creating upload", err)
+	}
+	return nil
+}
+
+// save writes an upload's state, replacing the previous one at once so a
+// crash cannot leave it half written
+func (t *tusStore) save(upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(t.dir, ".info-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), t.infoPath(upload.ID))
+}
+
+// load reads an upload's state. Expired uploads are removed and reported
+// as gone.
+func (t *tusStore) load(id string, now time.Time) (*tusUpload, *protocol.Response) {
+	if !validTusID(id) {
+		return nil, errorResponse(http.StatusNotFound, protocol.CodeNotFound, "Error: No upload %s", id)
+	}
+
+	data, err := os.ReadFile(t.infoPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errorResponse(http.StatusNotFound, protocol.CodeNotFound, "Error: No upload %s", id)
+	}
+	if err != nil {
+		return nil, fileErrorResponse("reading upload", err)
+	}
+
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, errorResponse(http.StatusInternalServerError, protocol.CodeIOError, "Error reading upload %s: %v", id, err)
+	}
+	if now.After(upload.Expires) {
+		t.remove(id)
+		return nil, errorResponse(http.StatusGone, protocol.CodeExpired, "Error: Upload %s has expired", id)
+	}
+
+	return &upload, nil
+}
+
+// remove deletes an upload's data and state
+func (t *tusStore) remove(id string) error {
+	if err := os.Remove(t.dataPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Remove(t.infoPath(id))
+}
+
+// sweep removes the uploads that have expired, leaving alone those a
+// request is working on
+func (t *tusStore) sweep(now time.Time) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".info")
+		if id == entry.Name() || !validTusID(id) || !t.acquire(id) {
+			continue
+		}
+		// Loading an expired upload removes it
+		t.load(id, now)
+		t.release(id)
+	}
+
+	t.sweepParts(now)
+}
+
+// sweepParts removes the part files of resumable uploads that have not
+// been written to for the expiry time, leaving alone those a request is
+// writing
+func (t *tusStore) sweepParts(now time.Time) {
+	dir := filepath.Join(t.dir, partsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".part") || !t.acquire(name) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && now.Sub(info.ModTime()) > t.expiry {
+			os.Remove(filepath.Join(dir, name))
+		}
+		t.release(name)
+	}
+}
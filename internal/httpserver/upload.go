@@ -0,0 +1,433 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"file-sharing-utility/internal/common"
+	"file-sharing-utility/internal/protocol"
+	"file-sharing-utility/internal/xorrw"
+)
+
+// Multipart uploads. POST /upload reads the multipart body as a stream and
+// writes each file part to its destination as it arrives, so nothing is
+// held in memory or spooled to a temporary directory. Any number of files
+// may be sent, each stored in the upload directory under its file name.
+// Form fields set options for the file parts that follow them:
+//
+//	subdir     directory below the upload directory to store files in,
+//	           created if needed
+//	overwrite  "true" (the default) replaces an existing file, "false"
+//	           fails the file, and "rename" stores it as "name (1).ext",
+//	           "name (2).ext" and so on
+//	checksum   checksum the next file must match, as "algorithm:hex" with
+//	           an algorithm of the hash command, or bare hex for sha256
+//
+// The reply has a command reply per file part. Requests larger than the
+// maximum upload size, if one is set, are cut off with 413.
+
+const (
+	// maxFieldSize caps the value of a form field
+	maxFieldSize = 4096
+
+	// maxRenameAttempts caps the names tried by the rename policy
+	maxRenameAttempts = 1000
+)
+
+// Overwrite policies of multipart uploads
+const (
+	overwriteReplace = "true"
+	overwriteFail    = "false"
+	overwriteRename  = "rename"
+)
+
+// UploadResult is the reply to a multipart upload. Files has the reply to
+// each file part in the order they were sent. Error is the failure that
+// stopped the request being read, if any.
+type UploadResult struct {
+	Files []*UploadedFile    `json:"files"`
+	Error *protocol.Response `json:"error,omitempty"`
+}
+
+// UploadedFile is the reply to one file part, for the file Name as sent
+type UploadedFile struct {
+	Name string `json:"name"`
+	*protocol.Response
+}
+
+// uploadOptions holds the form fields read so far
+type uploadOptions struct {
+	subdir    string
+	overwrite string
+	checksum  *expectedChecksum // For the next file only
+}
+
+// expectedChecksum is a checksum an uploaded file must match
+type expectedChecksum struct {
+	algorithm string
+	sum       string
+}
+
+// SetMaxUploadSize sets the largest request body an upload may have, in
+// bytes. Zero or less removes the limit.
+func (s *Server) SetMaxUploadSize(size int64) {
+	if size < 0 {
+		size = 0
+	}
+	s.maxUploadSize = size
+}
+
+// limitBody applies the maximum upload size to a request
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) {
+	if s.maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize)
+	}
+}
+
+// handleUpload stores the files of a multipart request
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeAPIResponse(w, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams,
+			"Error: Expected a multipart request: %v", err))
+		return
+	}
+
+	result := &UploadResult{Files: []*UploadedFile{}}
+	opts := &uploadOptions{overwrite: overwriteReplace}
+	for result.Error == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			result.Error = uploadReadError(err)
+			break
+		}
+
+		if part.FileName() == "" {
+			result.Error = opts.set(part)
+			part.Close()
+			continue
+		}
+
+		response, readErr := s.storePart(part, opts)
+		part.Close()
+		result.Files = append(result.Files, &UploadedFile{Name: part.FileName(), Response: response})
+		if readErr {
+			// The rest of the request cannot be read
+			break
+		}
+	}
+
+	if len(result.Files) == 0 && result.Error == nil {
+		writeAPIResponse(w, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: No file in request"))
+		return
+	}
+
+	// The result is sent bare even if every file failed, since each file
+	// has its own reply
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(result.status())
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("Error encoding reply: %v", err)
+	}
+}
+
+// status returns the status of the reply to a multipart upload: 200 if
+// every file was stored, 207 if only some were, and otherwise the status
+// of the first failure
+func (r *UploadResult) status() int {
+	var stored int
+	var first *protocol.Response
+	for _, file := range r.Files {
+		switch {
+		case !file.Failed():
+			stored++
+		case first == nil:
+			first = file.Response
+		}
+	}
+	if first == nil {
+		first = r.Error
+	}
+
+	switch {
+	case first == nil:
+		return http.StatusOK
+	case stored > 0:
+		return http.StatusMultiStatus
+	default:
+		return first.Status
+	}
+}
+
+// set reads a form field into the options
+func (o *uploadOptions) set(part *multipart.Part) *protocol.Response {
+	data, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+	if err != nil {
+		return uploadReadError(err)
+	}
+	if len(data) > maxFieldSize {
+		return errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Field %s is too long", part.FormName())
+	}
+	value := string(data)
+
+	switch part.FormName() {
+	case "subdir":
+		o.subdir = value
+	case "overwrite":
+		if value != overwriteReplace && value != overwriteFail && value != overwriteRename {
+			return errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid overwrite policy %q", value)
+		}
+		o.overwrite = value
+	case "checksum":
+		expect, failure := parseExpectedChecksum(value)
+		if failure != nil {
+			return failure
+		}
+		o.checksum = expect
+	}
+	return nil
+}
+
+// parseExpectedChecksum parses a checksum given as "algorithm:hex", or as
+// bare hex for sha256
+func parseExpectedChecksum(value string) (*expectedChecksum, *protocol.Response) {
+	algorithm, sum := defaultHashAlgorithm, value
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		algorithm, sum = value[:i], value[i+1:]
+	}
+	if _, ok := hashAlgorithms[algorithm]; !ok {
+		return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Unsupported algorithm %q", algorithm)
+	}
+	if _, err := hex.DecodeString(sum); err != nil || sum == "" {
+		return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid checksum %q", value)
+	}
+	return &expectedChecksum{algorithm: algorithm, sum: strings.ToLower(sum)}, nil
+}
+
+// storePart stores one file part. It reports whether reading the request
+// failed, leaving the rest of it unreadable.
+func (s *Server) storePart(part *multipart.Part, opts *uploadOptions) (*protocol.Response, bool) {
+	expect := opts.checksum
+	opts.checksum = nil
+
+	name := part.FileName()
+	if opts.subdir != "" {
+		name = path.Join(opts.subdir, name)
+	}
+	cmd := &protocol.Command{Type: "upload", Path: name, Params: map[string]string{"location": "upload"}}
+	target, failure := s.resolveEntry(cmd, name)
+	if failure != nil {
+		return failure, false
+	}
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return errorResponse(http.StatusConflict, protocol.CodeAlreadyExists, "Error: %s is a directory", name), false
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fileErrorResponse("creating directory", err), false
+	}
+
+	body := &readErrorReader{r: part}
+	staged, failure := s.stageFile(filepath.Dir(target), body, expect)
+	if body.err != nil {
+		return uploadReadError(body.err), true
+	}
+	if failure != nil {
+		return failure, false
+	}
+	defer staged.discard()
+
+	target, failure = staged.commit(target, opts.overwrite)
+	if failure != nil {
+		return failure, false
+	}
+
+	rel, err := filepath.Rel(s.uploadPath, target)
+	if err != nil {
+		return fileErrorResponse("writing file", err), false
+	}
+	return newResponse(protocol.TypeUpload, &protocol.FileResult{
+		Path:   filepath.ToSlash(rel),
+		Size:   staged.size,
+		SHA256: staged.sha256,
+	}), false
+}
+
+// uploadReadError reports a failure reading an upload's request body
+func uploadReadError(err error) *protocol.Response {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errorResponse(http.StatusRequestEntityTooLarge, protocol.CodeTooLarge,
+			"Error: Request larger than %d bytes", tooLarge.Limit)
+	}
+	return errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error reading request: %v", err)
+}
+
+// readErrorReader remembers the error reading failed with, other than
+// io.EOF, telling a broken request apart from failing to store it
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// stagedFile is an upload written to a temporary file next to where it
+// goes, waiting to be moved into place
+type stagedFile struct {
+	name      string
+	size      int64
+	sha256    string
+	committed bool
+}
+
+// stageFile writes everything read from r to a temporary file in dir,
+// XOR-encoded if the server has a key. If expect is given, the data must
+// match it.
+func (s *Server) stageFile(dir string, r io.Reader, expect *expectedChecksum) (*stagedFile, *protocol.Response) {
+	temp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return nil, fileErrorResponse("creating file", err)
+	}
+	staged := &stagedFile{name: temp.Name()}
+	failed := true
+	defer func() {
+		if failed {
+			temp.Close()
+			staged.discard()
+		}
+	}()
+
+	var writer io.Writer = temp
+	if s.xorKey != "" {
+		writer = xorrw.NewXorReaderWriter(temp, []byte(s.xorKey))
+	}
+
+	sum := sha256.New()
+	writers := []io.Writer{writer, sum}
+	var check hash.Hash
+	if expect != nil {
+		check = hashAlgorithms[expect.algorithm]()
+		writers = append(writers, check)
+	}
+
+	staged.size, err = io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return nil, fileErrorResponse("writing file", err)
+	}
+	staged.sha256 = hex.EncodeToString(sum.Sum(nil))
+	if check != nil {
+		if got := hex.EncodeToString(check.Sum(nil)); got != expect.sum {
+			return nil, errorResponse(http.StatusUnprocessableEntity, protocol.CodeChecksumMismatch,
+				"Error: %s checksum is %s, expected %s", expect.algorithm, got, expect.sum)
+		}
+	}
+
+	// CreateTemp makes the file private, give it the usual permissions
+	if err := temp.Chmod(0644); err != nil {
+		return nil, fileErrorResponse("writing file", err)
+	}
+	if err := temp.Close(); err != nil {
+		return nil, fileErrorResponse("writing file", err)
+	}
+	failed = false
+	return staged, nil
+}
+
+// stageFrom moves the file src to a temporary file in dir, copying it if
+// src is on another filesystem
+func stageFrom(src, dir string) (*stagedFile, *protocol.Response) {
+	temp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return nil, fileErrorResponse("creating file", err)
+	}
+	temp.Close()
+	staged := &stagedFile{name: temp.Name()}
+
+	if err := os.Rename(src, staged.name); err == nil {
+		return staged, nil
+	}
+	if _, err := common.CopyFile(staged.name, src); err != nil {
+		staged.discard()
+		return nil, fileErrorResponse("writing file", err)
+	}
+	// CreateTemp makes the file private, give it the usual permissions
+	if err := os.Chmod(staged.name, 0644); err != nil {
+		staged.discard()
+		return nil, fileErrorResponse("writing file", err)
+	}
+	os.Remove(src)
+	return staged, nil
+}
+
+// commit moves the staged file to target, following an overwrite policy.
+// It returns where the file went, which differs from target if it was
+// renamed.
+func (f *stagedFile) commit(target, overwrite string) (string, *protocol.Response) {
+	switch overwrite {
+	case overwriteFail:
+		return target, f.commitNew(target)
+	case overwriteRename:
+		ext := filepath.Ext(target)
+		stem := strings.TrimSuffix(target, ext)
+		candidate := target
+		for i := 1; ; i++ {
+			failure := f.commitNew(candidate)
+			if failure == nil || failure.Code != protocol.CodeAlreadyExists || i > maxRenameAttempts {
+				return candidate, failure
+			}
+			candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+	default:
+		if err := os.Rename(f.name, target); err != nil {
+			return target, fileErrorResponse("writing file", err)
+		}
+		f.committed = true
+		return target, nil
+	}
+}
+
+// commitNew moves the staged file to target, failing if target exists
+func (f *stagedFile) commitNew(target string) *protocol.Response {
+	// Claim the name first, so a file appearing meanwhile is not replaced
+	placeholder, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fileErrorResponse("creating file", err)
+	}
+	placeholder.Close()
+
+	if err := os.Rename(f.name, target); err != nil {
+		os.Remove(target)
+		return fileErrorResponse("writing file", err)
+	}
+	f.committed = true
+	return nil
+}
+
+// discard removes the staged file unless it was committed
+func (f *stagedFile) discard() {
+	if !f.committed {
+		os.Remove(f.name)
+	}
+}
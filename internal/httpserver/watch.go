@@ -0,0 +1,218 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"file-sharing-utility/internal/protocol"
+	"file-sharing-utility/internal/watch"
+)
+
+// Change feeds. A watch command turns its stream into a feed of the
+// changes below a directory: after the watch reply, every change arrives
+// as a watch_event reply tagged with the command's ID, until the client
+// closes the stream. GET /events serves the same feed as Server-Sent
+// Events. Both take the path and location like list, and these options:
+//
+//	debounce  milliseconds a path must stay quiet before its changes are
+//	          reported, watch.DefaultDebounce unless given
+//	poll      "true" rescans the directory instead of using inotify
+//
+// Each watch holds an inotify instance, which the system has few of, so
+// no more than the server's watch limit run at once.
+
+const (
+	// DefaultMaxWatchers is how many watches the server runs at once
+	// unless told otherwise
+	DefaultMaxWatchers = 32
+
+	// sseKeepAlive is how often an idle event stream sends a comment, so
+	// proxies keep the connection open
+	sseKeepAlive = 15 * time.Second
+)
+
+// SetMaxWatchers sets how many watches the server runs at once
+func (s *Server) SetMaxWatchers(max int) {
+	if max < 1 {
+		max = 1
+	}
+	s.watchLock.Lock()
+	s.maxWatchers = max
+	s.watchLock.Unlock()
+}
+
+// watchesFull reports whether the server runs as many watches as it may
+func (s *Server) watchesFull() bool {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+	return len(s.watchers) >= s.maxWatchers
+}
+
+// errTooManyWatches refuses a watch while the server is at its limit
+func errTooManyWatches() *protocol.Response {
+	return errorResponse(http.StatusTooManyRequests, protocol.CodeTooManyWatches, "Error: Too many watches, try again later")
+}
+
+// newWatcher starts watching the directory a watch command names
+func (s *Server) newWatcher(cmd *protocol.Command) (*watch.Watcher, *protocol.Response) {
+	var opts watch.Options
+	if value, ok := cmd.Params["debounce"]; ok {
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms < 0 {
+			return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidParams, "Error: Invalid debounce")
+		}
+		opts.Debounce = time.Duration(ms) * time.Millisecond
+	}
+	opts.ForcePoll = cmd.Params["poll"] == "true"
+
+	dir := s.basePath(cmd)
+	if cmd.Path != "" {
+		resolved, failure := s.resolvePath(cmd, cmd.Path)
+		if failure != nil {
+			return nil, failure
+		}
+		dir = resolved
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fileErrorResponse("watching directory", err)
+	}
+	if !info.IsDir() {
+		return nil, errorResponse(http.StatusBadRequest, protocol.CodeInvalidPath, "Error watching directory: %s is not a directory", cmd.Path)
+	}
+
+	if s.watchesFull() {
+		return nil, errTooManyWatches()
+	}
+	watcher, err := watch.New(dir, opts)
+	if err != nil {
+		return nil, fileErrorResponse("watching directory", err)
+	}
+
+	// Others may have started watching meanwhile
+	s.watchLock.Lock()
+	full := len(s.watchers) >= s.maxWatchers
+	if !full {
+		s.watchers[watcher] = struct{}{}
+	}
+	s.watchLock.Unlock()
+	if full {
+		watcher.Close()
+		return nil, errTooManyWatches()
+	}
+	return watcher, nil
+}
+
+// closeWatcher stops a watch and frees its place under the limit. It may
+// be called more than once.
+func (s *Server) closeWatcher(watcher *watch.Watcher) {
+	watcher.Close()
+	s.watchLock.Lock()
+	delete(s.watchers, watcher)
+	s.watchLock.Unlock()
+}
+
+// startWatch answers a watch command. It returns the watcher whose events
+// the stream carries from now on, or nil if the command was refused.
+func (s *Server) startWatch(w io.Writer, cmd *protocol.Command) (*watch.Watcher, error) {
+	watcher, failure := s.newWatcher(cmd)
+	if failure != nil {
+		return nil, protocol.WriteFrame(w, failure.WithID(cmd.ID))
+	}
+
+	reply := newResponse(protocol.TypeWatch, &protocol.WatchResult{Path: cmd.Path, Backend: watcher.Backend()})
+	if err := protocol.WriteFrame(w, reply.WithID(cmd.ID)); err != nil {
+		s.closeWatcher(watcher)
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// feedWatch sends a watcher's events until the client closes the stream
+func (s *Server) feedWatch(stream io.ReadWriter, cmd *protocol.Command, watcher *watch.Watcher) {
+	defer s.closeWatcher(watcher)
+
+	// Nothing more is read from the stream, so reading only tells when
+	// the client is done with it
+	go func() {
+		io.Copy(io.Discard, stream)
+		s.closeWatcher(watcher)
+	}()
+
+	for event := range watcher.Events() {
+		event := event
+		reply := newResponse(protocol.TypeWatchEvent, &event).WithID(cmd.ID)
+		if err := protocol.WriteFrame(stream, reply); err != nil {
+			log.Printf("Failed to send watch event: %v", err)
+			return
+		}
+	}
+}
+
+// handleEvents serves the changes below a directory as Server-Sent
+// Events, taking the watch options and the path and location as query
+// parameters. Each event is named after its op and carries the
+// watch.Event as JSON.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	params := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		params[key] = values[0]
+	}
+
+	cmd := &protocol.Command{Type: "watch", Path: params["path"], Params: params}
+	watcher, failure := s.newWatcher(cmd)
+	if failure != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(failure.Status)
+		json.NewEncoder(w).Encode(failure)
+		return
+	}
+	defer s.closeWatcher(watcher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Announce the watch the way the watch command's reply does
+	ready, _ := json.Marshal(&protocol.WatchResult{Path: cmd.Path, Backend: watcher.Backend()})
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", protocol.TypeWatch, ready)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	id := 0
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-watcher.Events():
+			if !ok {
+				return
+			}
+			id++
+			data, _ := json.Marshal(&event)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event.Op, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
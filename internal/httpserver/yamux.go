@@ -1,25 +1,73 @@
 package httpserver
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/hashicorp/yamux"
-
 	"file-sharing-utility/internal/common"
+	"file-sharing-utility/internal/protocol"
+	"file-sharing-utility/internal/watch"
 	"file-sharing-utility/internal/xorrw"
+	"file-sharing-utility/internal/yamux"
 )
 
 // SetupYamux configures yamux support for the HTTP server
 func (s *Server) SetupYamux() {
-	s.mux.HandleFunc("/yamux", s.handleYamux)
+	s.mux.HandleFunc("GET /yamux", s.handleYamux)
+
+	// List active sessions and their statistics, if enabled
+	s.mux.HandleFunc("GET /admin/sessions", s.handleSessions)
+}
+
+// SetAdminEnabled turns the admin endpoints on or off. They are off by
+// default; when off they answer 404 as if they did not exist.
+func (s *Server) SetAdminEnabled(enabled bool) {
+	s.adminEnabled = enabled
+}
+
+// sessionInfo describes an active yamux session on the admin endpoint
+type sessionInfo struct {
+	RemoteAddr string              `json:"remote_addr"`
+	RTT        string              `json:"rtt,omitempty"`
+	Stats      yamux.SessionStats  `json:"stats"`
+	Streams    []yamux.StreamStats `json:"streams"`
+}
+
+// handleSessions lists the active yamux sessions as JSON
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !s.adminEnabled {
+		writeAPIResponse(w, errorResponse(http.StatusNotFound, protocol.CodeNotFound, "Error: Not found"))
+		return
+	}
+
+	sessions := s.activeSessions()
+	result := make([]sessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		info := sessionInfo{
+			RemoteAddr: session.RemoteAddr().String(),
+			Stats:      session.Stats(),
+			Streams:    session.Streams(),
+		}
+		if rtt := session.RTT(); rtt > 0 {
+			info.RTT = rtt.String()
+		}
+		result = append(result, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("Error encoding sessions: %v", err)
+	}
 }
 
 // handleYamux handles yamux connection requests
@@ -49,11 +97,14 @@ func (s *Server) handleYamux(w http.ResponseWriter, r *http.Request) {
 	// Apply XOR encoding if a key is provided
 	var rwConn io.ReadWriteCloser = conn
 	if s.xorKey != "" {
-		rwConn = xorrw.NewXorReaderWriter(conn, []byte(s.xorKey))
+		rwConn = &xorConn{
+			XorReaderWriter: xorrw.NewXorReaderWriter(conn, []byte(s.xorKey)),
+			conn:            conn,
+		}
 	}
 	
 	// Create yamux server session
-	config := yamux.DefaultConfig()
+	config := yamux.NewConfig()
 	config.EnableKeepAlive = true
 	config.KeepAliveInterval = 30 * time.Second
 	config.ConnectionWriteTimeout = 10 * time.Second
@@ -69,8 +120,53 @@ func (s *Server) handleYamux(w http.ResponseWriter, r *http.Request) {
 	go s.handleYamuxSession(session)
 }
 
+// xorConn keeps the addresses of a hijacked connection visible to the
+// yamux session when XOR encoding is applied
+type xorConn struct {
+	*xorrw.XorReaderWriter
+	conn net.Conn
+}
+
+// LocalAddr returns the local network address
+func (x *xorConn) LocalAddr() net.Addr {
+	return x.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address
+func (x *xorConn) RemoteAddr() net.Addr {
+	return x.conn.RemoteAddr()
+}
+
+// addSession registers an active yamux session
+func (s *Server) addSession(session *yamux.Session) {
+	s.sessionLock.Lock()
+	s.sessions[session] = struct{}{}
+	s.sessionLock.Unlock()
+}
+
+// removeSession forgets a yamux session once it has closed
+func (s *Server) removeSession(session *yamux.Session) {
+	s.sessionLock.Lock()
+	delete(s.sessions, session)
+	s.sessionLock.Unlock()
+}
+
+// activeSessions returns the yamux sessions currently connected
+func (s *Server) activeSessions() []*yamux.Session {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+
+	sessions := make([]*yamux.Session, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
 // handleYamuxSession manages a yamux session and its streams
 func (s *Server) handleYamuxSession(session *yamux.Session) {
+	s.addSession(session)
+	defer s.removeSession(session)
 	defer session.Close()
 	
 	log.Printf("Started yamux session")
@@ -79,7 +175,7 @@ func (s *Server) handleYamuxSession(session *yamux.Session) {
 		// Accept a new stream
 		stream, err := session.AcceptStream()
 		if err != nil {
-			if err != io.EOF {
+			if !errors.Is(err, yamux.ErrSessionShutdown) {
 				log.Printf("Failed accepting yamux connection: %v", err)
 			}
 			break
@@ -89,7 +185,11 @@ func (s *Server) handleYamuxSession(session *yamux.Session) {
 		go s.handleYamuxStream(stream)
 	}
 	
-	log.Printf("Yamux session closed")
+	if cause := session.Err(); cause != nil {
+		log.Printf("Yamux session closed: %v", cause)
+	} else {
+		log.Printf("Yamux session closed")
+	}
 }
 
 // handleYamuxStream processes commands sent over a yamux stream
@@ -104,6 +204,16 @@ func (s *Server) handleYamuxStream(stream *yamux.Stream) {
 	for {
 		// Read a command
 		cmd, err := reader.readCommand()
+		var malformed *malformedCommandError
+		if errors.As(err, &malformed) {
+			// The frame was consumed, so the stream can go on
+			err = protocol.WriteFrame(stream, errorResponse(http.StatusBadRequest, protocol.CodeInvalidCommand, "Error: %v", malformed.err))
+			if err != nil {
+				log.Printf("Failed to send reply: %v", err)
+				break
+			}
+			continue
+		}
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("Failed to read command: %v", err)
@@ -111,23 +221,44 @@ func (s *Server) handleYamuxStream(stream *yamux.Stream) {
 			break
 		}
 		
-		// Process the command
-		response := s.processCommand(cmd)
-		
-		// Send the response
-		if _, err := stream.Write([]byte(response)); err != nil {
-			log.Printf("Failed to send reply: %v", err)
+		// Streaming transfers use the stream for their data
+		switch cmd.Type {
+		case "pipeline":
+			var p *pipeline
+			if p, err = s.startPipeline(stream, cmd); err == nil && p != nil {
+				// The rest of the stream is pipelined
+				p.run(reader)
+				return
+			}
+		case "watch":
+			var watcher *watch.Watcher
+			if watcher, err = s.startWatch(stream, cmd); err == nil && watcher != nil {
+				// The rest of the stream carries the change feed
+				s.feedWatch(stream, cmd, watcher)
+				return
+			}
+		case "upload_stream":
+			err = s.handleUploadStreamCommand(stream, cmd)
+		case "download_stream":
+			err = s.handleDownloadStreamCommand(stream, cmd)
+		default:
+			// Process the command and send the response
+			err = protocol.WriteFrame(stream, s.processCommand(context.Background(), cmd))
+		}
+		if err != nil {
+			log.Printf("Failed to handle %s command: %v", cmd.Type, err)
 			break
 		}
 	}
 }
 
-// Command represents a client command
-type Command struct {
-	Type    string            `json:"type"`
-	Path    string            `json:"path,omitempty"`
-	Content []byte            `json:"content,omitempty"`
-	Params  map[string]string `json:"params,omitempty"`
+// malformedCommandError is a command frame that could be read but not parsed
+type malformedCommandError struct {
+	err error
+}
+
+func (e *malformedCommandError) Error() string {
+	return "malformed command: " + e.err.Error()
 }
 
 // commandReader reads commands from a reader
@@ -141,202 +272,192 @@ func newCommandReader(r io.Reader) *commandReader {
 }
 
 // readCommand reads and parses a command
-func (cr *commandReader) readCommand() (*Command, error) {
-	// Read the command length (4 bytes)
-	var length [4]byte
-	if _, err := io.ReadFull(cr.r, length[:]); err != nil {
-		return nil, err
-	}
-	
-	// Convert to integer (assuming little-endian)
-	cmdLen := int(length[0]) | int(length[1])<<8 | int(length[2])<<16 | int(length[3])<<24
-	
-	// Read the command data
-	cmdData := make([]byte, cmdLen)
-	if _, err := io.ReadFull(cr.r, cmdData); err != nil {
+func (cr *commandReader) readCommand() (*protocol.Command, error) {
+	// Read the command frame
+	cmdData, err := protocol.ReadFrame(cr.r)
+	if err != nil {
 		return nil, err
 	}
 	
 	// Parse the command
-	var cmd Command
+	var cmd protocol.Command
 	if err := json.Unmarshal(cmdData, &cmd); err != nil {
-		return nil, err
+		return nil, &malformedCommandError{err: err}
 	}
 	
 	return &cmd, nil
 }
 
-// processCommand handles a command and returns a response
-func (s *Server) processCommand(cmd *Command) string {
+// processCommand handles a command and returns the reply to it. Long
+// running commands give up once ctx is cancelled.
+func (s *Server) processCommand(ctx context.Context, cmd *protocol.Command) *protocol.Response {
+	var response *protocol.Response
 	switch cmd.Type {
 	case "list":
-		return s.handleListCommand(cmd)
+		response = s.handleListCommand(ctx, cmd)
 	case "upload":
-		return s.handleUploadCommand(cmd)
+		response = s.handleUploadCommand(cmd)
 	case "download":
-		return s.handleDownloadCommand(cmd)
+		response = s.handleDownloadCommand(ctx, cmd)
 	case "delete":
-		return s.handleDeleteCommand(cmd)
+		response = s.handleDeleteCommand(cmd)
 	case "info":
-		return s.handleInfoCommand()
+		response = s.handleInfoCommand()
+	case "stat":
+		response = s.handleStatCommand(ctx, cmd)
+	case "mkdir":
+		response = s.handleMkdirCommand(cmd)
+	case "rename", "move":
+		response = s.handleRenameCommand(cmd)
+	case "copy":
+		response = s.handleCopyCommand(cmd)
+	case "rmdir":
+		response = s.handleRmdirCommand(cmd)
+	case "touch":
+		response = s.handleTouchCommand(cmd)
+	case "batch":
+		response = s.handleBatchCommand(ctx, cmd)
+	case "hash":
+		response = s.handleHashCommand(ctx, cmd)
+	case "manifest":
+		response = s.handleManifestCommand(ctx, cmd)
 	default:
-		return "Unsupported command: " + cmd.Type
+		response = errorResponse(http.StatusBadRequest, protocol.CodeInvalidCommand, "Unsupported command: %s", cmd.Type)
 	}
+	return response.WithID(cmd.ID)
 }
 
-// handleListCommand lists files in a directory
-func (s *Server) handleListCommand(cmd *Command) string {
-	dir := s.downloadPath
-	if cmd.Path != "" {
-		// Prevent directory traversal
-		cleanPath := filepath.Clean(cmd.Path)
-		if strings.Contains(cleanPath, "..") {
-			return "Error: Invalid path"
-		}
-		dir = filepath.Join(s.downloadPath, cleanPath)
+// cleanCommandPath validates a path sent with a command. It returns the
+// cleaned path or the reply to fail the command with.
+func cleanCommandPath(path string) (string, *protocol.Response) {
+	if path == "" {
+		return "", errMissingPath
 	}
 	
-	// Read the directory
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return "Error reading directory: " + err.Error()
+	// Prevent directory traversal
+	cleanPath := filepath.Clean(path)
+	if strings.Contains(cleanPath, "..") {
+		return "", errInvalidPath
+	}
+	return cleanPath, nil
+}
+
+// handleListCommand lists files in a directory, taking the listing
+// options described in list.go
+func (s *Server) handleListCommand(ctx context.Context, cmd *protocol.Command) *protocol.Response {
+	opts, failure := parseListOptions(cmd.Params)
+	if failure != nil {
+		return failure
 	}
 	
-	// Build the response
-	var result strings.Builder
-	for _, entry := range entries {
-		if entry.IsDir() {
-			result.WriteString("d ")
-		} else {
-			result.WriteString("f ")
-		}
-		
-		info, err := entry.Info()
-		if err == nil {
-			result.WriteString(info.ModTime().Format("2006-01-02 15:04:05") + " ")
-			result.WriteString(formatSize(info.Size()) + " ")
+	dir := s.basePath(cmd)
+	if cmd.Path != "" {
+		resolved, failure := s.resolvePath(cmd, cmd.Path)
+		if failure != nil {
+			return failure
 		}
-		
-		result.WriteString(entry.Name() + "\n")
+		dir = resolved
 	}
 	
-	return result.String()
+	result, failure := listDirectory(ctx, dir, cmd.Path, opts)
+	if failure != nil {
+		return failure
+	}
+	
+	return newResponse(protocol.TypeList, result)
 }
 
 // handleUploadCommand stores uploaded data
-func (s *Server) handleUploadCommand(cmd *Command) string {
-	if cmd.Path == "" {
-		return "Error: Path not specified"
+func (s *Server) handleUploadCommand(cmd *protocol.Command) *protocol.Response {
+	cleanPath, failure := cleanCommandPath(cmd.Path)
+	if failure != nil {
+		return failure
 	}
 	
-	// Prevent directory traversal
-	cleanPath := filepath.Clean(cmd.Path)
-	if strings.Contains(cleanPath, "..") {
-		return "Error: Invalid path"
+	rng, failure := parseTransferRange(cmd.Params)
+	if failure != nil {
+		return failure
 	}
 	
 	// Create the target file
 	targetPath := filepath.Join(s.uploadPath, cleanPath)
 	
+	// Resumed uploads collect their data in a part file
+	if rng.resumable() {
+		result, failure := s.writeResumable(cleanPath, targetPath, rng, bytes.NewReader(cmd.Content), int64(len(cmd.Content)))
+		if failure != nil {
+			return failure
+		}
+		result.Path = cmd.Path
+		return newResponse(protocol.TypeUpload, result)
+	}
+	
 	// Ensure the directory exists
 	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return "Error creating directory: " + err.Error()
+		return fileErrorResponse("creating directory", err)
 	}
 	
 	// Write the content
 	if err := os.WriteFile(targetPath, cmd.Content, 0644); err != nil {
-		return "Error writing file: " + err.Error()
+		return fileErrorResponse("writing file", err)
 	}
 	
-	return "File uploaded successfully"
+	return newResponse(protocol.TypeUpload, &protocol.FileResult{Path: cmd.Path, Size: int64(len(cmd.Content))})
 }
 
-// handleDownloadCommand retrieves file data
-func (s *Server) handleDownloadCommand(cmd *Command) string {
-	if cmd.Path == "" {
-		return "Error: Path not specified"
+// handleDownloadCommand retrieves file data, or the range given by
+// Params["offset"] and Params["length"]
+func (s *Server) handleDownloadCommand(ctx context.Context, cmd *protocol.Command) *protocol.Response {
+	rng, failure := parseTransferRange(cmd.Params)
+	if failure != nil {
+		return failure
 	}
 	
-	// Prevent directory traversal
-	cleanPath := filepath.Clean(cmd.Path)
-	if strings.Contains(cleanPath, "..") {
-		return "Error: Invalid path"
+	file, size, failure := s.openDownload(cmd.Path)
+	if failure != nil {
+		return failure
 	}
+	defer file.Close()
 	
-	// Read the file
-	targetPath := filepath.Join(s.downloadPath, cleanPath)
-	data, err := os.ReadFile(targetPath)
-	if err != nil {
-		return "Error reading file: " + err.Error()
+	offset, length, failure := rng.section(size)
+	if failure != nil {
+		return failure
 	}
 	
-	// Return it as a command response
-	response := &Command{
-		Type:    "file_data",
-		Path:    cmd.Path,
-		Content: data,
+	// Read the requested part of the file
+	data := make([]byte, length)
+	if _, err := io.ReadFull(contextReader(ctx, io.NewSectionReader(file, offset, length)), data); err != nil {
+		return fileErrorResponse("reading file", err)
 	}
 	
-	jsonData, err := json.Marshal(response)
-	if err != nil {
-		return "Error serializing data: " + err.Error()
-	}
-	
-	return string(jsonData)
+	return newResponse(protocol.TypeFileData, &protocol.FileData{Path: cmd.Path, Content: data, Offset: offset, Size: size})
 }
 
 // handleDeleteCommand deletes a file
-func (s *Server) handleDeleteCommand(cmd *Command) string {
-	if cmd.Path == "" {
-		return "Error: Path not specified"
-	}
-	
-	// Prevent directory traversal
-	cleanPath := filepath.Clean(cmd.Path)
-	if strings.Contains(cleanPath, "..") {
-		return "Error: Invalid path"
-	}
-	
-	// Determine which base path to use
-	var basePath string
-	if cmd.Params != nil && cmd.Params["location"] == "upload" {
-		basePath = s.uploadPath
-	} else {
-		basePath = s.downloadPath
+func (s *Server) handleDeleteCommand(cmd *protocol.Command) *protocol.Response {
+	targetPath, failure := s.resolvePath(cmd, cmd.Path)
+	if failure != nil {
+		return failure
 	}
 	
 	// Delete the file
-	targetPath := filepath.Join(basePath, cleanPath)
 	if err := os.Remove(targetPath); err != nil {
-		return "Error deleting file: " + err.Error()
+		return fileErrorResponse("deleting file", err)
 	}
 	
-	return "File deleted successfully"
+	return newResponse(protocol.TypeDelete, &protocol.FileResult{Path: cmd.Path})
 }
 
-// handleInfoCommand returns system information
-func (s *Server) handleInfoCommand() string {
-	info := common.GetInfo()
-	return info.String()
+// basePath returns the directory a command operates on, the upload path
+// if Params["location"] is "upload" and the download path otherwise
+func (s *Server) basePath(cmd *protocol.Command) string {
+	if cmd.Params["location"] == "upload" {
+		return s.uploadPath
+	}
+	return s.downloadPath
 }
 
-// formatSize formats a file size in a human-readable format
-func formatSize(size int64) string {
-	const (
-		_        = iota
-		KB int64 = 1 << (10 * iota)
-		MB
-		GB
-	)
-	
-	switch {
-	case size >= GB:
-		return fmt.Sprintf("%.2f GB", float64(size)/float64(GB))
-	case size >= MB:
-		return fmt.Sprintf("%.2f MB", float64(size)/float64(MB))
-	case size >= KB:
-		return fmt.Sprintf("%.2f KB", float64(size)/float64(KB))
-	default:
-		return fmt.Sprintf("%d B", size)
-	}
-} 
\ No newline at end of file
+// handleInfoCommand returns system information
+func (s *Server) handleInfoCommand() *protocol.Response {
+	return newResponse(protocol.TypeInfo, common.GetInfo())
+}
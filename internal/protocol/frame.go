@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Commands and replies are sent as JSON, each prefixed with its length as
+// a 4-byte little-endian integer. Frames are at most MaxFrameSize bytes;
+// larger files go through the streaming transfers.
+
+// MaxFrameSize is the largest frame either side sends or accepts
+const MaxFrameSize = 64 << 20
+
+// ErrFrameTooLarge is returned for frames over MaxFrameSize. A stream that
+// announced one cannot be read any further.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// WriteFrame writes v as length-prefixed JSON
+func WriteFrame(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(data))
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.LittleEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadFrame reads the JSON of one length-prefixed frame
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	// Refuse before allocating whatever the peer announced
+	size := binary.LittleEndian.Uint32(length[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
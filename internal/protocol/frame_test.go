@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	cmd := &Command{ID: "1", Type: "list", Path: "dir", Params: map[string]string{"depth": "2"}}
+	if err := WriteFrame(&buf, cmd); err != nil {
+		t.Fatalf("WriteFrame failed: %v", err)
+	}
+
+	// The length prefix is little-endian
+	if length := int(buf.Bytes()[0]) | int(buf.Bytes()[1])<<8; length != buf.Len()-4 {
+		t.Errorf("Expected length prefix %d, got %d", buf.Len()-4, length)
+	}
+
+	data, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrame failed: %v", err)
+	}
+	var got Command
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Failed to decode frame: %v", err)
+	}
+	if got.ID != cmd.ID || got.Type != cmd.Type || got.Path != cmd.Path || got.Params["depth"] != "2" {
+		t.Errorf("Expected %+v, got %+v", cmd, got)
+	}
+
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	if _, err := ReadFrame(bytes.NewReader([]byte{10, 0, 0, 0, '{'})); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	// Only the length arrives, which must not be allocated
+	if _, err := ReadFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, strings.Repeat("x", MaxFrameSize)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be written, got %d bytes", buf.Len())
+	}
+}
+
+func TestResponseFailed(t *testing.T) {
+	if (&Response{Status: 200}).Failed() {
+		t.Error("Expected status 200 to succeed")
+	}
+	if !(&Response{Status: StatusCancelled}).Failed() {
+		t.Error("Expected a cancelled reply to fail")
+	}
+
+	reply := &Response{Status: 200}
+	if answered := reply.WithID("7"); answered.ID != "7" || reply.ID != "" {
+		t.Errorf("Expected WithID to copy the reply, got %q and %q", answered.ID, reply.ID)
+	}
+}
@@ -0,0 +1,124 @@
+package protocol
+
+import "time"
+
+// FileEntry describes one entry of a directory listing. In recursive
+// listings Name is the slash-separated path below the listed directory.
+type FileEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// ListResult is the payload of a list reply. NextCursor is set when more
+// entries follow.
+type ListResult struct {
+	Path       string      `json:"path"`
+	Entries    []FileEntry `json:"entries"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// FileResult is the payload of upload and delete replies. Resumable
+// uploads also report the SHA-256 of the data stored so far.
+type FileResult struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	Committed bool   `json:"committed,omitempty"`
+}
+
+// FileData is the payload of a download reply. Content starts at Offset
+// in a file of Size bytes.
+type FileData struct {
+	Path    string `json:"path"`
+	Content []byte `json:"content"`
+	Offset  int64  `json:"offset,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+// StatResult is the payload of a stat reply
+type StatResult struct {
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Mode    string    `json:"mode"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Partial bool      `json:"partial,omitempty"`
+}
+
+// MoveResult is the payload of rename and copy replies. Size is the
+// number of bytes copied.
+type MoveResult struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Size int64  `json:"size,omitempty"`
+}
+
+// TransferHeader announces the data that follows a download_stream reply,
+// starting at Offset in the file
+type TransferHeader struct {
+	Size   int64 `json:"size"`
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// TransferStatus ends a streaming transfer with what was moved. For
+// resumed uploads it describes the whole part or file written so far.
+type TransferStatus struct {
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Committed bool   `json:"committed,omitempty"`
+}
+
+// BatchResult is the payload of a batch reply
+type BatchResult struct {
+	Atomic    bool        `json:"atomic,omitempty"`
+	Completed bool        `json:"completed"`
+	Results   []*Response `json:"results"`
+}
+
+// HashResult is the payload of a hash reply. Offset and Length give the
+// part of the file of Size bytes that was hashed.
+type HashResult struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	Hash      string `json:"hash"`
+	Offset    int64  `json:"offset,omitempty"`
+	Length    int64  `json:"length"`
+	Size      int64  `json:"size"`
+}
+
+// ManifestEntry describes one file of a manifest. Path is slash-separated
+// and relative to the directory of the manifest.
+type ManifestEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// ManifestResult is the payload of a manifest reply. Cached counts the
+// entries whose checksum came from the cache.
+type ManifestResult struct {
+	Path      string          `json:"path"`
+	Algorithm string          `json:"algorithm"`
+	Files     []ManifestEntry `json:"files"`
+	Cached    int             `json:"cached"`
+}
+
+// PipelineResult is the payload of the reply to a pipeline command
+type PipelineResult struct {
+	Limit int `json:"limit"`
+}
+
+// CancelResult is the payload of the reply to a cancel command
+type CancelResult struct {
+	ID string `json:"id"`
+}
+
+// WatchResult is the payload of the reply to a watch command
+type WatchResult struct {
+	Path    string `json:"path"`
+	Backend string `json:"backend"`
+}
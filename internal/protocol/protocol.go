@@ -0,0 +1,145 @@
+// Package protocol defines the command protocol spoken over yamux streams:
+// the commands a client sends, the replies the server answers with, their
+// payloads and how both are framed. The server and the client share it so
+// neither has to import the other.
+package protocol
+
+import "net/http"
+
+// Command represents a client command. ID is echoed in the reply.
+// Commands holds the operations of a batch.
+type Command struct {
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type"`
+	Path     string            `json:"path,omitempty"`
+	Content  []byte            `json:"content,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	Commands []Command         `json:"commands,omitempty"`
+}
+
+// Response is the envelope every yamux command reply is sent in, as
+// length-prefixed JSON framed like commands. Status follows the HTTP
+// status codes; failed replies carry a machine-readable Code and a
+// message in Error. Type names the shape of Data.
+type Response struct {
+	ID     string      `json:"id,omitempty"`
+	Status int         `json:"status"`
+	Code   string      `json:"code,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Type   string      `json:"type,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Failed reports whether the reply is an error
+func (r *Response) Failed() bool {
+	return r.Status >= http.StatusBadRequest
+}
+
+// WithID returns a copy of the reply answering the given request
+func (r *Response) WithID(id string) *Response {
+	reply := *r
+	reply.ID = id
+	return &reply
+}
+
+// Error codes carried by failed responses
+const (
+	// CodeInvalidCommand means the command could not be parsed or its
+	// type is unknown
+	CodeInvalidCommand = "invalid_command"
+
+	// CodeMissingPath means the command needs a path and has none
+	CodeMissingPath = "missing_path"
+
+	// CodeInvalidPath means the path escapes the served directories
+	CodeInvalidPath = "invalid_path"
+
+	// CodeInvalidParams means a parameter is missing or malformed
+	CodeInvalidParams = "invalid_params"
+
+	// CodeNotFound means the file or directory does not exist
+	CodeNotFound = "not_found"
+
+	// CodePermissionDenied means the server may not access the file
+	CodePermissionDenied = "permission_denied"
+
+	// CodeIOError means reading or writing the file failed
+	CodeIOError = "io_error"
+
+	// CodeOffsetMismatch means a resumed upload starts past the data
+	// received so far
+	CodeOffsetMismatch = "offset_mismatch"
+
+	// CodeChecksumMismatch means a partial upload does not match the
+	// checksum it was committed with
+	CodeChecksumMismatch = "checksum_mismatch"
+
+	// CodeInvalidRange means the requested range lies outside the file
+	CodeInvalidRange = "invalid_range"
+
+	// CodeAlreadyExists means the target of a command is already there
+	CodeAlreadyExists = "already_exists"
+
+	// CodeNotEmpty means a directory still has entries and recursive
+	// removal was not asked for
+	CodeNotEmpty = "not_empty"
+
+	// CodeDuplicateID means a pipelined command reused the ID of one
+	// still in flight
+	CodeDuplicateID = "duplicate_id"
+
+	// CodeTooManyCommands means too many pipelined commands are waiting
+	CodeTooManyCommands = "too_many_commands"
+
+	// CodeTooManyWatches means the server is already running as many
+	// watches as it allows
+	CodeTooManyWatches = "too_many_watches"
+
+	// CodeTooLarge means the request is larger than the server accepts
+	CodeTooLarge = "too_large"
+
+	// CodeExpired means a resumable upload was not finished in time
+	CodeExpired = "expired"
+
+	// CodeLocked means another request is working on the same resource
+	CodeLocked = "locked"
+
+	// CodeCancelled means the command was cancelled before it finished
+	CodeCancelled = "cancelled"
+
+	// CodeSkipped means a batch operation was not run because an earlier
+	// one failed
+	CodeSkipped = "skipped"
+
+	// CodeRolledBack means an atomic batch operation succeeded but was
+	// undone because a later one failed
+	CodeRolledBack = "rolled_back"
+)
+
+// StatusCancelled is the status of a cancelled command's reply. It is the
+// non-standard 499 Client Closed Request.
+const StatusCancelled = 499
+
+// Payload types carried in Response.Type
+const (
+	TypeList           = "list"
+	TypeUpload         = "upload"
+	TypeFileData       = "file_data"
+	TypeDelete         = "delete"
+	TypeInfo           = "info"
+	TypeStat           = "stat"
+	TypeMkdir          = "mkdir"
+	TypeRename         = "rename"
+	TypeCopy           = "copy"
+	TypeRmdir          = "rmdir"
+	TypeTouch          = "touch"
+	TypePipeline       = "pipeline"
+	TypeCancel         = "cancel"
+	TypeTransferHeader = "transfer_header"
+	TypeTransferStatus = "transfer_status"
+	TypeWatch          = "watch"
+	TypeWatchEvent     = "watch_event"
+	TypeBatch          = "batch"
+	TypeHash           = "hash"
+	TypeManifest       = "manifest"
+)
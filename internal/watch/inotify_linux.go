@@ -0,0 +1,293 @@
+package watch
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// watchMask selects the inotify events a directory watch reports
+const watchMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+// moveWait is how long the first half of a rename waits for its second
+// before the entry is taken to have left the tree
+const moveWait = 50 * time.Millisecond
+
+// inotify watches every directory of the tree with one inotify instance
+type inotify struct {
+	root    string
+	fd      int
+	file    *os.File
+	changes chan<- change
+	done    <-chan struct{}
+	stopped chan struct{}
+
+	// Watched directories by descriptor. Only the reading goroutine uses
+	// it once it has started.
+	dirs map[int32]string
+
+	// First halves of renames waiting for their second, which may come
+	// with the next read
+	from []moved
+}
+
+// moved is the first half of a rename, waiting for its second
+type moved struct {
+	cookie uint32
+	path   string
+	isDir  bool
+	held   bool // Already waited through the end of one read
+}
+
+// newInotify watches the directories below root and starts reading events
+func newInotify(root string, changes chan<- change, done <-chan struct{}) (*inotify, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	// A non-blocking descriptor goes through the runtime poller, so
+	// closing the file wakes a pending Read. The descriptor is kept apart
+	// because File.Fd would switch it back to blocking.
+	in := &inotify{
+		root:    root,
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changes: changes,
+		done:    done,
+		stopped: make(chan struct{}),
+		dirs:    make(map[int32]string),
+	}
+
+	if err := in.addTree(root, nil); err != nil {
+		in.file.Close()
+		return nil, err
+	}
+
+	go in.run()
+	return in, nil
+}
+
+// close stops reading events and waits for the reading goroutine
+func (in *inotify) close() error {
+	err := in.file.Close()
+	<-in.stopped
+	return err
+}
+
+// addTree watches dir and the directories below it. Entries found below
+// a directory that is new to the tree are passed to found, since their
+// own creation may have happened before the watch was in place.
+func (in *inotify) addTree(dir string, found func(path string)) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if path != dir && found != nil {
+			found(path)
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(in.fd, path, watchMask)
+		if err != nil {
+			if path == dir {
+				return os.NewSyscallError("inotify_add_watch", err)
+			}
+			return nil
+		}
+		in.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+// run reads events until the file is closed
+func (in *inotify) run() {
+	defer close(in.stopped)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		// Renames waiting for their second half only wait so long
+		var deadline time.Time
+		if len(in.from) > 0 {
+			deadline = time.Now().Add(moveWait)
+		}
+		in.file.SetReadDeadline(deadline)
+
+		n, err := in.file.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if !in.send(in.expireMoves(true)) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if !in.handle(buf[:n]) {
+			return
+		}
+	}
+}
+
+// handle turns one read's worth of events into changes. It reports false
+// once the watcher is closed.
+func (in *inotify) handle(buf []byte) bool {
+	var changes []change
+
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		offset = nameStart + int(raw.Len)
+		if offset > len(buf) {
+			break
+		}
+		name := string(bytes.TrimRight(buf[nameStart:offset], "\x00"))
+
+		if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			// Events were lost, so the clients must look for themselves.
+			// Directories created meanwhile are not watched yet, and
+			// waiting renames may never see their second half.
+			changes = append(changes, in.expireMoves(true)...)
+			changes = append(changes, change{op: Rescan})
+			in.addTree(in.root, nil)
+			continue
+		}
+		if raw.Mask&syscall.IN_IGNORED != 0 {
+			// The kernel dropped the watch
+			delete(in.dirs, raw.Wd)
+			continue
+		}
+		dir, ok := in.dirs[raw.Wd]
+		if !ok || name == "" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		rel := relPath(in.root, path)
+		isDir := raw.Mask&syscall.IN_ISDIR != 0
+
+		switch {
+		case raw.Mask&syscall.IN_CREATE != 0:
+			changes = append(changes, change{op: Create, path: rel})
+			if isDir {
+				in.addTree(path, func(p string) {
+					changes = append(changes, change{op: Create, path: relPath(in.root, p)})
+				})
+			}
+		case raw.Mask&(syscall.IN_MODIFY|syscall.IN_ATTRIB) != 0:
+			if !isDir {
+				changes = append(changes, change{op: Modify, path: rel})
+			}
+		case raw.Mask&syscall.IN_DELETE != 0:
+			changes = append(changes, change{op: Delete, path: rel})
+		case raw.Mask&syscall.IN_MOVED_FROM != 0:
+			in.from = append(in.from, moved{cookie: raw.Cookie, path: path, isDir: isDir})
+		case raw.Mask&syscall.IN_MOVED_TO != 0:
+			changes = append(changes, in.movedTo(raw.Cookie, path, isDir)...)
+		}
+	}
+
+	// The kernel queues both halves of a rename together, but a read may
+	// end between them. A first half still alone after the next read
+	// means the entry left the tree.
+	changes = append(changes, in.expireMoves(false)...)
+	return in.send(changes)
+}
+
+// send hands changes to the debouncer. It reports false once the watcher
+// is closed.
+func (in *inotify) send(changes []change) bool {
+	for _, c := range changes {
+		if !send(in.changes, in.done, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// expireMoves gives up on the first halves of renames that have waited
+// through a read, or on all of them, and reports their entries deleted
+func (in *inotify) expireMoves(all bool) []change {
+	var changes []change
+	waiting := in.from[:0]
+	for _, m := range in.from {
+		if !m.held && !all {
+			m.held = true
+			waiting = append(waiting, m)
+			continue
+		}
+		changes = append(changes, change{op: Delete, path: relPath(in.root, m.path)})
+		if m.isDir {
+			in.dropTree(m.path)
+		}
+	}
+	in.from = waiting
+	return changes
+}
+
+// movedTo handles the second half of a rename, pairing it with its first
+// half by cookie. An entry moved in from outside the tree is a creation.
+func (in *inotify) movedTo(cookie uint32, path string, isDir bool) []change {
+	rel := relPath(in.root, path)
+	for i, m := range in.from {
+		if m.cookie != cookie {
+			continue
+		}
+		in.from = append(in.from[:i], in.from[i+1:]...)
+		if isDir {
+			in.renameTree(m.path, path)
+		}
+		return []change{{op: Rename, path: rel, oldPath: relPath(in.root, m.path)}}
+	}
+
+	changes := []change{{op: Create, path: rel}}
+	if isDir {
+		in.addTree(path, func(p string) {
+			changes = append(changes, change{op: Create, path: relPath(in.root, p)})
+		})
+	}
+	return changes
+}
+
+// renameTree updates the watched paths of a renamed directory
+func (in *inotify) renameTree(oldPath, newPath string) {
+	for wd, dir := range in.dirs {
+		if rest, ok := below(dir, oldPath); ok {
+			in.dirs[wd] = newPath + rest
+		}
+	}
+}
+
+// dropTree stops watching a directory that left the tree
+func (in *inotify) dropTree(path string) {
+	for wd, dir := range in.dirs {
+		if _, ok := below(dir, path); ok {
+			syscall.InotifyRmWatch(in.fd, uint32(wd))
+			delete(in.dirs, wd)
+		}
+	}
+}
+
+// below reports whether path is dir or inside it, and returns the rest of
+// path after dir
+func below(path, dir string) (string, bool) {
+	if path == dir {
+		return "", true
+	}
+	if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return path[len(dir):], true
+	}
+	return "", false
+}
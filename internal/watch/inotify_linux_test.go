@@ -0,0 +1,133 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// newTestInotify watches root without reading the events, so the test
+// can feed them to handle
+func newTestInotify(t *testing.T, root string) (*inotify, chan change) {
+	t.Helper()
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		t.Fatalf("Failed to create inotify instance: %v", err)
+	}
+	changes := make(chan change, 16)
+	in := &inotify{
+		root:    root,
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changes: changes,
+		done:    make(chan struct{}),
+		dirs:    make(map[int32]string),
+	}
+	t.Cleanup(func() { in.file.Close() })
+
+	if err := in.addTree(root, nil); err != nil {
+		t.Fatalf("Failed to watch %s: %v", root, err)
+	}
+	return in, changes
+}
+
+// rawEvent encodes an event the way the kernel queues it
+func rawEvent(wd int32, mask, cookie uint32, name string) []byte {
+	nameLen := 0
+	if name != "" {
+		nameLen = (len(name) + 1 + 15) / 16 * 16
+	}
+	buf := make([]byte, syscall.SizeofInotifyEvent+nameLen)
+	event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+	event.Wd = wd
+	event.Mask = mask
+	event.Cookie = cookie
+	event.Len = uint32(nameLen)
+	copy(buf[syscall.SizeofInotifyEvent:], name)
+	return buf
+}
+
+// rootWatch returns the descriptor watching the root directory
+func rootWatch(t *testing.T, in *inotify) int32 {
+	t.Helper()
+	for wd, dir := range in.dirs {
+		if dir == in.root {
+			return wd
+		}
+	}
+	t.Fatal("Root directory is not watched")
+	return 0
+}
+
+// received drains the changes handed to the debouncer so far
+func received(changes chan change) []change {
+	var got []change
+	for {
+		select {
+		case c := <-changes:
+			got = append(got, c)
+		default:
+			return got
+		}
+	}
+}
+
+func TestInotifySplitRename(t *testing.T) {
+	in, changes := newTestInotify(t, t.TempDir())
+	wd := rootWatch(t, in)
+
+	// The read ends between the two halves of the rename
+	in.handle(rawEvent(wd, syscall.IN_MOVED_FROM, 7, "a"))
+	if got := received(changes); len(got) != 0 {
+		t.Fatalf("Expected the rename to wait for its second half, got %+v", got)
+	}
+	in.handle(rawEvent(wd, syscall.IN_MOVED_TO, 7, "b"))
+	got := received(changes)
+	if len(got) != 1 || got[0] != (change{op: Rename, path: "b", oldPath: "a"}) {
+		t.Fatalf("Expected rename of a to b, got %+v", got)
+	}
+
+	// A first half still alone after the next read left the tree
+	in.handle(rawEvent(wd, syscall.IN_MOVED_FROM, 8, "c"))
+	in.handle(rawEvent(wd, syscall.IN_MODIFY, 0, "d"))
+	got = received(changes)
+	want := []change{{op: Modify, path: "d"}, {op: Delete, path: "c"}}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Expected %+v, got %+v", want, got)
+	}
+	if len(in.from) != 0 {
+		t.Errorf("Expected no rename to wait, got %+v", in.from)
+	}
+}
+
+func TestInotifyOverflow(t *testing.T) {
+	root := t.TempDir()
+	in, changes := newTestInotify(t, root)
+	wd := rootWatch(t, in)
+
+	// Neither the creation of the directory nor the second half of the
+	// rename made it into the queue
+	newDir := filepath.Join(root, "new")
+	if err := os.Mkdir(newDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	in.handle(rawEvent(wd, syscall.IN_MOVED_FROM, 9, "a"))
+	in.handle(rawEvent(-1, syscall.IN_Q_OVERFLOW, 0, ""))
+
+	got := received(changes)
+	want := []change{{op: Delete, path: "a"}, {op: Rescan}}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Expected %+v, got %+v", want, got)
+	}
+
+	watched := false
+	for _, dir := range in.dirs {
+		watched = watched || dir == newDir
+	}
+	if !watched {
+		t.Errorf("Expected %s to be watched after the overflow", newDir)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package watch
+
+// inotify does not exist outside Linux
+type inotify struct{}
+
+// newInotify always fails, so the watcher polls instead
+func newInotify(root string, changes chan<- change, done <-chan struct{}) (*inotify, error) {
+	return nil, errNotSupported
+}
+
+func (in *inotify) close() error {
+	return nil
+}
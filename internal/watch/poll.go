@@ -0,0 +1,133 @@
+package watch
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// poller finds changes by rescanning the tree at an interval and
+// comparing it with the previous scan
+type poller struct {
+	root     string
+	interval time.Duration
+	changes  chan<- change
+	done     <-chan struct{}
+	stopped  chan struct{}
+}
+
+// newPoller takes the first scan and starts polling
+func newPoller(root string, interval time.Duration, changes chan<- change, done <-chan struct{}) (*poller, error) {
+	p := &poller{
+		root:     root,
+		interval: interval,
+		changes:  changes,
+		done:     done,
+		stopped:  make(chan struct{}),
+	}
+
+	snapshot, err := p.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	go p.run(snapshot)
+	return p, nil
+}
+
+// close waits for the polling goroutine, which stops once done is closed
+func (p *poller) close() error {
+	<-p.stopped
+	return nil
+}
+
+// run rescans until done is closed
+func (p *poller) run(previous map[string]os.FileInfo) {
+	defer close(p.stopped)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := p.scan()
+		if err != nil {
+			// The directory may be back by the next scan
+			continue
+		}
+		for _, c := range diff(previous, current) {
+			if !send(p.changes, p.done, c) {
+				return
+			}
+		}
+		previous = current
+	}
+}
+
+// scan records every file and directory below the root
+func (p *poller) scan() (map[string]os.FileInfo, error) {
+	snapshot := make(map[string]os.FileInfo)
+	err := filepath.WalkDir(p.root, func(path string, d fs.DirEntry, err error) error {
+		if path == p.root {
+			return err
+		}
+		if err != nil {
+			// Gone or unreadable since it was listed
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			snapshot[relPath(p.root, path)] = info
+		}
+		return nil
+	})
+	return snapshot, err
+}
+
+// diff returns the changes between two scans. A file that disappeared
+// and one that appeared are a rename if they are the same file.
+func diff(previous, current map[string]os.FileInfo) []change {
+	var created, deleted []string
+	var changes []change
+
+	for path, info := range current {
+		old, ok := previous[path]
+		switch {
+		case !ok:
+			created = append(created, path)
+		case !info.IsDir() && (info.Size() != old.Size() || !info.ModTime().Equal(old.ModTime())):
+			changes = append(changes, change{op: Modify, path: path})
+		}
+	}
+	for path := range previous {
+		if _, ok := current[path]; !ok {
+			deleted = append(deleted, path)
+		}
+	}
+
+	for _, path := range created {
+		renamed := false
+		for i, oldPath := range deleted {
+			if oldPath != "" && os.SameFile(previous[oldPath], current[path]) {
+				changes = append(changes, change{op: Rename, path: path, oldPath: oldPath})
+				deleted[i] = ""
+				renamed = true
+				break
+			}
+		}
+		if !renamed {
+			changes = append(changes, change{op: Create, path: path})
+		}
+	}
+	for _, path := range deleted {
+		if path != "" {
+			changes = append(changes, change{op: Delete, path: path})
+		}
+	}
+	return changes
+}
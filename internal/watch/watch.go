@@ -0,0 +1,279 @@
+// Package watch reports changes to the files below a directory. It uses
+// inotify on Linux and falls back to polling elsewhere, or when inotify
+// cannot be used.
+package watch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Kinds of change reported in Event.Op
+const (
+	Create = "create"
+	Modify = "modify"
+	Delete = "delete"
+	Rename = "rename"
+
+	// Rescan means changes were lost and the directory must be listed
+	// again to catch up. It has no path.
+	Rescan = "rescan"
+)
+
+// Backends a Watcher can use
+const (
+	BackendInotify = "inotify"
+	BackendPoll    = "poll"
+)
+
+const (
+	// DefaultDebounce is how long a path must stay quiet before its
+	// changes are reported
+	DefaultDebounce = 100 * time.Millisecond
+
+	// DefaultPollInterval is how often the polling backend rescans
+	DefaultPollInterval = time.Second
+
+	// eventBuffer is how many reported events may wait for the reader
+	eventBuffer = 64
+)
+
+// errNotSupported is returned by newInotify where inotify does not exist
+var errNotSupported = errors.New("inotify not supported")
+
+// Event is a change to a file or directory. Path and OldPath are
+// slash-separated and relative to the watched directory. Size and ModTime
+// describe the file after the change and are zero for deletions.
+type Event struct {
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	OldPath string    `json:"old_path,omitempty"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time,omitempty"`
+}
+
+// Options tune a Watcher. The zero value uses inotify where possible and
+// the default intervals.
+type Options struct {
+	Debounce     time.Duration // Quiet time before a change is reported
+	PollInterval time.Duration // Rescan interval of the polling backend
+	ForcePoll    bool          // Poll even where inotify is available
+}
+
+// change is a raw change reported by a backend, before debouncing
+type change struct {
+	op      string
+	path    string
+	oldPath string
+}
+
+// backend produces changes until it is closed
+type backend interface {
+	close() error
+}
+
+// Watcher reports changes below a directory on its Events channel. Each
+// path's changes are held back until it has been quiet for the debounce
+// time and then reported as one event, so a file written in many chunks
+// produces a single create or modify.
+type Watcher struct {
+	root    string
+	backend backend
+	name    string
+
+	changes chan change
+	events  chan Event
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+// New starts watching the directory root and everything below it
+func New(root string, opts Options) (*Watcher, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "watch", Path: root, Err: errors.New("not a directory")}
+	}
+
+	if opts.Debounce <= 0 {
+		opts.Debounce = DefaultDebounce
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+
+	w := &Watcher{
+		root:    filepath.Clean(root),
+		changes: make(chan change, eventBuffer),
+		events:  make(chan Event, eventBuffer),
+		done:    make(chan struct{}),
+	}
+
+	if !opts.ForcePoll {
+		w.backend, err = newInotify(w.root, w.changes, w.done)
+		w.name = BackendInotify
+	}
+	if opts.ForcePoll || err != nil {
+		w.backend, err = newPoller(w.root, opts.PollInterval, w.changes, w.done)
+		w.name = BackendPoll
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w.wg.Add(1)
+	go w.debounce(opts.Debounce)
+	return w, nil
+}
+
+// Events returns the channel changes are reported on. It is closed once
+// the watcher is closed.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Backend returns the name of the backend in use
+func (w *Watcher) Backend() string {
+	return w.name
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.done)
+		err = w.backend.close()
+		w.wg.Wait()
+		close(w.events)
+	})
+	return err
+}
+
+// pending is a change waiting out the debounce time
+type pending struct {
+	change
+	last time.Time
+}
+
+// debounce merges the changes to each path and reports them once the
+// path has been quiet for the given time
+func (w *Watcher) debounce(quiet time.Duration) {
+	defer w.wg.Done()
+
+	waiting := make(map[string]*pending)
+	ticker := time.NewTicker(quiet / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case c := <-w.changes:
+			merge(waiting, c, time.Now())
+		case now := <-ticker.C:
+			for path, p := range waiting {
+				if now.Sub(p.last) < quiet {
+					continue
+				}
+				delete(waiting, path)
+				if event, ok := w.describe(p.change); ok {
+					select {
+					case w.events <- event:
+					case <-w.done:
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// merge folds a change into the changes waiting for its path
+func merge(waiting map[string]*pending, c change, now time.Time) {
+	if c.op == Rescan {
+		// Listing the directory again catches up on everything waiting
+		for path := range waiting {
+			delete(waiting, path)
+		}
+	}
+
+	if c.op == Rename {
+		// The old path's own waiting change is superseded by the rename
+		if old, ok := waiting[c.oldPath]; ok {
+			delete(waiting, c.oldPath)
+			if old.op == Create {
+				// Never reported under its old name
+				c = change{op: Create, path: c.path}
+			}
+		}
+	}
+
+	prev, ok := waiting[c.path]
+	if !ok {
+		waiting[c.path] = &pending{change: c, last: now}
+		return
+	}
+	prev.last = now
+
+	switch {
+	case prev.op == Create && c.op == Delete:
+		// Came and went before anyone was told
+		delete(waiting, c.path)
+	case prev.op == Create && c.op == Modify:
+		// Still a new file
+	case prev.op == Rename && c.op == Modify:
+		// Report the rename, the size and time are read when it is sent
+	case prev.op == Rename && c.op == Delete:
+		prev.change = change{op: Delete, path: prev.oldPath}
+	case prev.op == Delete && c.op == Create:
+		// Replaced
+		prev.change = change{op: Modify, path: c.path}
+	default:
+		prev.change = c
+	}
+}
+
+// describe turns a change into an event, reading the file's size and
+// time. It reports false if the file is gone by then, since its deletion
+// will be reported too.
+func (w *Watcher) describe(c change) (Event, bool) {
+	event := Event{Op: c.op, Path: c.path, OldPath: c.oldPath}
+	if c.op == Delete || c.op == Rescan {
+		return event, true
+	}
+
+	info, err := os.Lstat(filepath.Join(w.root, filepath.FromSlash(c.path)))
+	if err != nil {
+		return event, false
+	}
+	event.IsDir = info.IsDir()
+	event.Size = info.Size()
+	event.ModTime = info.ModTime()
+	return event, true
+}
+
+// send hands a change from a backend to the debouncer
+func send(changes chan<- change, done <-chan struct{}, c change) bool {
+	select {
+	case changes <- c:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// relPath returns path relative to root, slash-separated
+func relPath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
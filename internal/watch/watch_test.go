@@ -0,0 +1,206 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// backends returns the options exercising each backend available here
+func backends() map[string]Options {
+	opts := map[string]Options{
+		BackendPoll: {Debounce: 50 * time.Millisecond, PollInterval: 20 * time.Millisecond, ForcePoll: true},
+	}
+	if runtime.GOOS == "linux" {
+		opts[BackendInotify] = Options{Debounce: 50 * time.Millisecond}
+	}
+	return opts
+}
+
+// nextEvent waits for the watcher's next event
+func nextEvent(t *testing.T, w *Watcher) Event {
+	t.Helper()
+	select {
+	case event := <-w.Events():
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return Event{}
+	}
+}
+
+// expectQuiet fails if the watcher reports anything for a while
+func expectQuiet(t *testing.T, w *Watcher) {
+	t.Helper()
+	select {
+	case event := <-w.Events():
+		t.Fatalf("Expected no event, got %+v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWatcherEvents(t *testing.T) {
+	for name, opts := range backends() {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			w, err := New(dir, opts)
+			if err != nil {
+				t.Fatalf("Failed to start watcher: %v", err)
+			}
+			defer w.Close()
+			if w.Backend() != name {
+				t.Fatalf("Expected backend %s, got %s", name, w.Backend())
+			}
+
+			// A file written in several steps is one creation
+			path := filepath.Join(dir, "sub", "a.txt")
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.WriteString("hello")
+			file.WriteString(" world")
+			file.Close()
+
+			event := nextEvent(t, w)
+			if event.Op != Create || event.Path != "sub/a.txt" || event.Size != 11 || event.IsDir {
+				t.Fatalf("Expected creation of sub/a.txt with 11 bytes, got %+v", event)
+			}
+			if event.ModTime.IsZero() {
+				t.Errorf("Expected a modification time")
+			}
+			expectQuiet(t, w)
+
+			if err := os.WriteFile(path, []byte("hi"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			event = nextEvent(t, w)
+			if event.Op != Modify || event.Path != "sub/a.txt" || event.Size != 2 {
+				t.Fatalf("Expected modification of sub/a.txt to 2 bytes, got %+v", event)
+			}
+
+			if err := os.Rename(path, filepath.Join(dir, "b.txt")); err != nil {
+				t.Fatal(err)
+			}
+			event = nextEvent(t, w)
+			if event.Op != Rename || event.Path != "b.txt" || event.OldPath != "sub/a.txt" || event.Size != 2 {
+				t.Fatalf("Expected rename of sub/a.txt to b.txt, got %+v", event)
+			}
+
+			if err := os.Remove(filepath.Join(dir, "b.txt")); err != nil {
+				t.Fatal(err)
+			}
+			event = nextEvent(t, w)
+			if event.Op != Delete || event.Path != "b.txt" {
+				t.Fatalf("Expected deletion of b.txt, got %+v", event)
+			}
+
+			// A file that comes and goes within the debounce time is not
+			// reported at all
+			os.WriteFile(filepath.Join(dir, "tmp"), []byte("x"), 0644)
+			os.Remove(filepath.Join(dir, "tmp"))
+			if name == BackendInotify {
+				expectQuiet(t, w)
+			}
+		})
+	}
+}
+
+func TestWatcherNewDirectory(t *testing.T) {
+	for name, opts := range backends() {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := New(dir, opts)
+			if err != nil {
+				t.Fatalf("Failed to start watcher: %v", err)
+			}
+			defer w.Close()
+
+			if err := os.MkdirAll(filepath.Join(dir, "x", "y"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "x", "y", "f"), []byte("abc"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			seen := make(map[string]Event)
+			for len(seen) < 3 {
+				event := nextEvent(t, w)
+				seen[event.Path] = event
+			}
+			if !seen["x"].IsDir || seen["x"].Op != Create || !seen["x/y"].IsDir {
+				t.Errorf("Expected creation of directories x and x/y, got %+v", seen)
+			}
+			if f := seen["x/y/f"]; f.Op != Create || f.Size != 3 {
+				t.Errorf("Expected creation of x/y/f with 3 bytes, got %+v", f)
+			}
+		})
+	}
+}
+
+func TestWatcherClose(t *testing.T) {
+	for name, opts := range backends() {
+		t.Run(name, func(t *testing.T) {
+			w, err := New(t.TempDir(), opts)
+			if err != nil {
+				t.Fatalf("Failed to start watcher: %v", err)
+			}
+			w.Close()
+			if _, ok := <-w.Events(); ok {
+				t.Errorf("Expected the events channel to be closed")
+			}
+			w.Close()
+		})
+	}
+
+	if _, err := New(filepath.Join(t.TempDir(), "missing"), Options{}); err == nil {
+		t.Errorf("Expected an error watching a missing directory")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes []change
+		want    map[string]change
+	}{
+		{"create then modify", []change{{op: Create, path: "a"}, {op: Modify, path: "a"}},
+			map[string]change{"a": {op: Create, path: "a"}}},
+		{"create then delete", []change{{op: Create, path: "a"}, {op: Delete, path: "a"}},
+			map[string]change{}},
+		{"modify then delete", []change{{op: Modify, path: "a"}, {op: Delete, path: "a"}},
+			map[string]change{"a": {op: Delete, path: "a"}}},
+		{"delete then create", []change{{op: Delete, path: "a"}, {op: Create, path: "a"}},
+			map[string]change{"a": {op: Modify, path: "a"}}},
+		{"create then rename", []change{{op: Create, path: "a"}, {op: Rename, path: "b", oldPath: "a"}},
+			map[string]change{"b": {op: Create, path: "b"}}},
+		{"modify then rename", []change{{op: Modify, path: "a"}, {op: Rename, path: "b", oldPath: "a"}},
+			map[string]change{"b": {op: Rename, path: "b", oldPath: "a"}}},
+		{"rename then delete", []change{{op: Rename, path: "b", oldPath: "a"}, {op: Delete, path: "b"}},
+			map[string]change{"b": {op: Delete, path: "a"}}},
+		{"rescan", []change{{op: Modify, path: "a"}, {op: Create, path: "b"}, {op: Rescan}, {op: Create, path: "c"}},
+			map[string]change{"": {op: Rescan}, "c": {op: Create, path: "c"}}},
+	}
+
+	for _, test := range tests {
+		waiting := make(map[string]*pending)
+		for _, c := range test.changes {
+			merge(waiting, c, time.Now())
+		}
+		if len(waiting) != len(test.want) {
+			t.Errorf("%s: expected %d changes, got %d", test.name, len(test.want), len(waiting))
+			continue
+		}
+		for path, want := range test.want {
+			if got, ok := waiting[path]; !ok || got.change != want {
+				t.Errorf("%s: expected %+v for %s, got %+v", test.name, want, path, got)
+			}
+		}
+	}
+}
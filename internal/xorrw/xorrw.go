@@ -5,19 +5,21 @@ import (
 	"io"
 )
 
-// XorReaderWriter is a wrapper around a Reader/Writer that applies XOR encoding/decoding
+// XorReaderWriter is a wrapper around a Reader/Writer that applies XOR encoding/decoding.
+// Reads and writes keep separate key positions, so each direction of a
+// connection is encoded independently and both can be used at once.
 type XorReaderWriter struct {
-	rw     io.ReadWriter // The underlying ReadWriter
-	key    []byte        // XOR key
-	keyPos int           // Current position in the key
+	rw       io.ReadWriter // The underlying ReadWriter
+	key      []byte        // XOR key
+	readPos  int           // Current position in the key for reads
+	writePos int           // Current position in the key for writes
 }
 
 // NewXorReaderWriter creates a new XorReaderWriter with the given ReadWriter and key
 func NewXorReaderWriter(rw io.ReadWriter, key []byte) *XorReaderWriter {
 	return &XorReaderWriter{
-		rw:     rw,
-		key:    key,
-		keyPos: 0,
+		rw:  rw,
+		key: key,
 	}
 }
 
@@ -32,10 +34,10 @@ func (x *XorReaderWriter) Read(p []byte) (n int, err error) {
 	// Apply XOR decoding
 	for i := 0; i < n; i++ {
 		// XOR the current byte with the current key byte
-		p[i] = p[i] ^ x.key[x.keyPos]
+		p[i] = p[i] ^ x.key[x.readPos]
 		
 		// Move to the next key byte, wrapping around if necessary
-		x.keyPos = (x.keyPos + 1) % len(x.key)
+		x.readPos = (x.readPos + 1) % len(x.key)
 	}
 
 	return n, nil
@@ -50,10 +52,10 @@ func (x *XorReaderWriter) Write(p []byte) (n int, err error) {
 	// Apply XOR encoding
 	for i := 0; i < len(encoded); i++ {
 		// XOR the current byte with the current key byte
-		encoded[i] = encoded[i] ^ x.key[x.keyPos]
+		encoded[i] = encoded[i] ^ x.key[x.writePos]
 		
 		// Move to the next key byte, wrapping around if necessary
-		x.keyPos = (x.keyPos + 1) % len(x.key)
+		x.writePos = (x.writePos + 1) % len(x.key)
 	}
 
 	// Write the encoded data to the underlying writer
@@ -67,4 +69,71 @@ func (x *XorReaderWriter) Close() error {
 		return closer.Close()
 	}
 	return nil
-} 
\ No newline at end of file
+}
+
+// XorReadSeeker decodes an XOR encoded io.ReadSeeker. The key position
+// follows the offset in the stream, so reading can start anywhere, such as
+// at the start of a requested byte range.
+type XorReadSeeker struct {
+	rs  io.ReadSeeker // The underlying ReadSeeker
+	key []byte        // XOR key
+	pos int64         // Current offset in the stream
+}
+
+// NewXorReadSeeker creates a new XorReadSeeker with the given ReadSeeker and key
+func NewXorReadSeeker(rs io.ReadSeeker, key []byte) *XorReadSeeker {
+	return &XorReadSeeker{
+		rs:  rs,
+		key: key,
+	}
+}
+
+// Read reads data from the underlying reader and applies XOR decoding
+func (x *XorReadSeeker) Read(p []byte) (n int, err error) {
+	n, err = x.rs.Read(p)
+
+	// Decode whatever was read, even if an error came with it
+	keyLen := int64(len(x.key))
+	for i := 0; i < n; i++ {
+		p[i] = p[i] ^ x.key[(x.pos+int64(i))%keyLen]
+	}
+	x.pos += int64(n)
+
+	return n, err
+}
+
+// Seek moves to a new offset, positioning the key to match
+func (x *XorReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := x.rs.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	x.pos = pos
+	return pos, nil
+}
+
+// XorWriterAt XOR encodes data written at any offset of an io.WriterAt.
+// The key position follows the offset like XorReadSeeker's, so a file can
+// be written in pieces, in any order, and still decode as a whole.
+type XorWriterAt struct {
+	w   io.WriterAt // The underlying WriterAt
+	key []byte      // XOR key
+}
+
+// NewXorWriterAt creates a new XorWriterAt with the given WriterAt and key
+func NewXorWriterAt(w io.WriterAt, key []byte) *XorWriterAt {
+	return &XorWriterAt{
+		w:   w,
+		key: key,
+	}
+}
+
+// WriteAt encodes p as it lies at offset off and writes it there
+func (x *XorWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	encoded := make([]byte, len(p))
+	keyLen := int64(len(x.key))
+	for i := range p {
+		encoded[i] = p[i] ^ x.key[(off+int64(i))%keyLen]
+	}
+	return x.w.WriteAt(encoded, off)
+}
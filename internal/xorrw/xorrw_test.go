@@ -3,6 +3,7 @@ package xorrw
 import (
 	"bytes"
 	"io"
+	"os"
 	"testing"
 )
 
@@ -170,4 +171,92 @@ func TestXorReaderWriterClose(t *testing.T) {
 	if err != nil {
 		t.Errorf("Expected nil error for non-closer, got %v", err)
 	}
-} 
\ No newline at end of file
+}
+
+func TestXorReaderWriterDirectionsIndependent(t *testing.T) {
+	key := []byte("secretkey")
+	message := []byte("request")
+
+	// The peer encodes its reply from the start of the key
+	reply := []byte("response")
+	encodedReply := make([]byte, len(reply))
+	for i := range reply {
+		encodedReply[i] = reply[i] ^ key[i%len(key)]
+	}
+
+	mockRW := &MockReadWriter{ReadData: encodedReply}
+	xorRW := NewXorReaderWriter(mockRW, key)
+
+	// Writing first must not shift the key used for reading
+	if _, err := xorRW.Write(message); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	decoded := make([]byte, len(reply))
+	n, err := xorRW.Read(decoded)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if !bytes.Equal(decoded[:n], reply) {
+		t.Errorf("Expected %q, got %q", reply, decoded[:n])
+	}
+}
+
+func TestXorReadSeeker(t *testing.T) {
+	originalData := []byte("The quick brown fox jumps over the lazy dog")
+	key := []byte("secret")
+
+	// Encode the data as a stream would
+	encoded := &bytes.Buffer{}
+	NewXorReaderWriter(encoded, key).Write(originalData)
+
+	xorRS := NewXorReadSeeker(bytes.NewReader(encoded.Bytes()), key)
+
+	// Reading from any offset gives the original bytes
+	for _, offset := range []int64{0, 1, 5, 6, 17, 42} {
+		if _, err := xorRS.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("Seek to %d failed: %v", offset, err)
+		}
+		decoded, err := io.ReadAll(xorRS)
+		if err != nil {
+			t.Fatalf("Read at %d failed: %v", offset, err)
+		}
+		if !bytes.Equal(decoded, originalData[offset:]) {
+			t.Errorf("At offset %d expected %q, got %q", offset, originalData[offset:], decoded)
+		}
+	}
+
+	// Relative seeks keep the key in step too
+	xorRS.Seek(10, io.SeekStart)
+	xorRS.Seek(-4, io.SeekCurrent)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(xorRS, buf); err != nil || !bytes.Equal(buf, originalData[6:11]) {
+		t.Errorf("Expected %q after a relative seek, got %q (%v)", originalData[6:11], buf, err)
+	}
+}
+
+func TestXorWriterAt(t *testing.T) {
+	originalData := []byte("The quick brown fox jumps over the lazy dog")
+	key := []byte("secret")
+
+	expected := &bytes.Buffer{}
+	NewXorReaderWriter(expected, key).Write(originalData)
+
+	// Writing in pieces, out of order, encodes like one stream
+	file, err := os.CreateTemp(t.TempDir(), "xor")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	xorWA := NewXorWriterAt(file, key)
+	for _, piece := range [][2]int{{17, 30}, {0, 5}, {30, 43}, {5, 17}} {
+		if _, err := xorWA.WriteAt(originalData[piece[0]:piece[1]], int64(piece[0])); err != nil {
+			t.Fatalf("WriteAt %d failed: %v", piece[0], err)
+		}
+	}
+
+	encoded, _ := os.ReadFile(file.Name())
+	if !bytes.Equal(encoded, expected.Bytes()) {
+		t.Errorf("Expected %x, got %x", expected.Bytes(), encoded)
+	}
+}
@@ -0,0 +1,108 @@
+package yamux
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+// newBenchPair connects a client and server session over loopback TCP, so
+// vectored writes reach a real socket
+func newBenchPair(b *testing.B) (*Session, *Session) {
+	b.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatalf("Failed to dial: %v", err)
+	}
+	serverConn, ok := <-accepted
+	if !ok {
+		b.Fatal("Failed to accept")
+	}
+
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	config.Logger = nil
+
+	client, err := Client(clientConn, config)
+	if err != nil {
+		b.Fatalf("Failed to create client: %v", err)
+	}
+	server, err := Server(serverConn, config)
+	if err != nil {
+		b.Fatalf("Failed to create server: %v", err)
+	}
+	b.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// benchmarkStreamWrite pushes b.N writes of size bytes through one stream
+// and reports the allocations needed per megabyte moved
+func benchmarkStreamWrite(b *testing.B, size int) {
+	client, server := newBenchPair(b)
+
+	done := make(chan error, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			done <- err
+			return
+		}
+		_, err = io.CopyN(io.Discard, stream, int64(b.N)*int64(size))
+		done <- err
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		b.Fatalf("Failed to open stream: %v", err)
+	}
+	defer stream.Close()
+
+	payload := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := stream.Write(payload); err != nil {
+			b.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatalf("Read failed: %v", err)
+	}
+	b.StopTimer()
+
+	// Both sessions live in this process, so this covers sending and
+	// receiving
+	runtime.ReadMemStats(&after)
+	megabytes := float64(b.N) * float64(size) / (1 << 20)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/megabytes, "allocs/MB")
+}
+
+func BenchmarkStreamWrite4K(b *testing.B)  { benchmarkStreamWrite(b, 4*1024) }
+func BenchmarkStreamWrite64K(b *testing.B) { benchmarkStreamWrite(b, 64*1024) }
+func BenchmarkStreamWrite1M(b *testing.B)  { benchmarkStreamWrite(b, 1024*1024) }
@@ -0,0 +1,318 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	hashicorp "github.com/hashicorp/yamux"
+)
+
+// muxStream is the subset of a stream both implementations provide
+type muxStream interface {
+	io.ReadWriteCloser
+}
+
+// interopPair is one side opening streams and the other accepting them
+type interopPair struct {
+	open   func() (muxStream, error)
+	accept func() (muxStream, error)
+}
+
+// hashicorpConfig returns a hashicorp config with logging silenced
+func hashicorpConfig() *hashicorp.Config {
+	config := hashicorp.DefaultConfig()
+	config.EnableKeepAlive = false
+	config.LogOutput = io.Discard
+	return config
+}
+
+// newInteropPairs builds both directions of interop over net.Pipe:
+// our client against a hashicorp server, and a hashicorp client against
+// our server.
+func newInteropPairs(t *testing.T) map[string]func(t *testing.T) interopPair {
+	config := NewConfig()
+	config.EnableKeepAlive = false
+
+	return map[string]func(t *testing.T) interopPair{
+		"ClientToHashicorpServer": func(t *testing.T) interopPair {
+			clientConn, serverConn := net.Pipe()
+			client, err := Client(clientConn, config)
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			server, err := hashicorp.Server(serverConn, hashicorpConfig())
+			if err != nil {
+				t.Fatalf("Failed to create hashicorp server: %v", err)
+			}
+			t.Cleanup(func() {
+				client.Close()
+				server.Close()
+			})
+			return interopPair{
+				open:   func() (muxStream, error) { return client.OpenStream() },
+				accept: func() (muxStream, error) { return server.AcceptStream() },
+			}
+		},
+		"HashicorpClientToServer": func(t *testing.T) interopPair {
+			clientConn, serverConn := net.Pipe()
+			client, err := hashicorp.Client(clientConn, hashicorpConfig())
+			if err != nil {
+				t.Fatalf("Failed to create hashicorp client: %v", err)
+			}
+			server, err := Server(serverConn, config)
+			if err != nil {
+				t.Fatalf("Failed to create server: %v", err)
+			}
+			t.Cleanup(func() {
+				client.Close()
+				server.Close()
+			})
+			return interopPair{
+				open:   func() (muxStream, error) { return client.OpenStream() },
+				accept: func() (muxStream, error) { return server.AcceptStream() },
+			}
+		},
+	}
+}
+
+// echo copies everything it reads on a stream back to the sender
+func echo(stream muxStream, size int) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return
+	}
+	stream.Write(buf)
+}
+
+func TestInteropEcho(t *testing.T) {
+	for name, newPair := range newInteropPairs(t) {
+		t.Run(name, func(t *testing.T) {
+			pair := newPair(t)
+
+			// More than one window in each direction exercises window updates
+			payload := bytes.Repeat([]byte("interop"), int(initialStreamWindow))
+
+			go func() {
+				stream, err := pair.accept()
+				if err != nil {
+					return
+				}
+				echo(stream, len(payload))
+			}()
+
+			stream, err := pair.open()
+			if err != nil {
+				t.Fatalf("Failed to open stream: %v", err)
+			}
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := stream.Write(payload)
+				errCh <- err
+			}()
+
+			reply := make([]byte, len(payload))
+			if _, err := io.ReadFull(stream, reply); err != nil {
+				t.Fatalf("Failed to read echo: %v", err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("Failed to write payload: %v", err)
+			}
+			if !bytes.Equal(reply, payload) {
+				t.Error("Echoed data does not match")
+			}
+
+			stream.Close()
+		})
+	}
+}
+
+func TestInteropManyStreams(t *testing.T) {
+	for name, newPair := range newInteropPairs(t) {
+		t.Run(name, func(t *testing.T) {
+			pair := newPair(t)
+
+			const streams = 16
+			go func() {
+				for i := 0; i < streams; i++ {
+					stream, err := pair.accept()
+					if err != nil {
+						return
+					}
+					go echo(stream, 4)
+				}
+			}()
+
+			for i := 0; i < streams; i++ {
+				stream, err := pair.open()
+				if err != nil {
+					t.Fatalf("Failed to open stream %d: %v", i, err)
+				}
+				if _, err := stream.Write([]byte("ping")); err != nil {
+					t.Fatalf("Failed to write on stream %d: %v", i, err)
+				}
+				reply := make([]byte, 4)
+				if _, err := io.ReadFull(stream, reply); err != nil {
+					t.Fatalf("Failed to read on stream %d: %v", i, err)
+				}
+				if string(reply) != "ping" {
+					t.Errorf("Stream %d echoed %q", i, reply)
+				}
+				stream.Close()
+			}
+		})
+	}
+}
+
+func TestInteropCloseDeliversEOF(t *testing.T) {
+	for name, newPair := range newInteropPairs(t) {
+		t.Run(name, func(t *testing.T) {
+			pair := newPair(t)
+
+			go func() {
+				stream, err := pair.open()
+				if err != nil {
+					return
+				}
+				stream.Write([]byte("last words"))
+				stream.Close()
+			}()
+
+			stream, err := pair.accept()
+			if err != nil {
+				t.Fatalf("Failed to accept stream: %v", err)
+			}
+
+			done := make(chan []byte, 1)
+			go func() {
+				data, _ := io.ReadAll(stream)
+				done <- data
+			}()
+
+			select {
+			case data := <-done:
+				if string(data) != "last words" {
+					t.Errorf("Expected %q before EOF, got %q", "last words", data)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Read did not return EOF after the peer closed")
+			}
+		})
+	}
+}
+
+func TestInteropHashicorpPing(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client, err := hashicorp.Client(clientConn, hashicorpConfig())
+	if err != nil {
+		t.Fatalf("Failed to create hashicorp client: %v", err)
+	}
+	defer client.Close()
+
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	server, err := Server(serverConn, config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	defer server.Close()
+
+	if _, err := client.Ping(); err != nil {
+		t.Errorf("Ping through our server failed: %v", err)
+	}
+}
+
+func TestInteropHashicorpGoAway(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	client, err := Client(clientConn, config)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	server, err := hashicorp.Server(serverConn, hashicorpConfig())
+	if err != nil {
+		t.Fatalf("Failed to create hashicorp server: %v", err)
+	}
+	defer server.Close()
+
+	if err := server.GoAway(); err != nil {
+		t.Fatalf("GoAway failed: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := client.OpenStream(); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("OpenStream still succeeds after the peer sent go away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInteropResetReachesHashicorp(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	client, err := Client(clientConn, config)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	server, err := hashicorp.Server(serverConn, hashicorpConfig())
+	if err != nil {
+		t.Fatalf("Failed to create hashicorp server: %v", err)
+	}
+	defer server.Close()
+
+	accepted := make(chan *hashicorp.Stream, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err == nil {
+			accepted <- stream
+		}
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	remote := <-accepted
+
+	if err := stream.Reset(); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+
+	if _, err := remote.Read(make([]byte, 1)); err != hashicorp.ErrConnectionReset {
+		t.Errorf("Expected hashicorp to see a connection reset, got %v", err)
+	}
+}
+
+func TestInteropPingHashicorp(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	client, err := Client(clientConn, config)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	server, err := hashicorp.Server(serverConn, hashicorpConfig())
+	if err != nil {
+		t.Fatalf("Failed to create hashicorp server: %v", err)
+	}
+	defer server.Close()
+
+	if _, err := client.Ping(); err != nil {
+		t.Errorf("Ping to hashicorp server failed: %v", err)
+	}
+}
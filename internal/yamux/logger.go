@@ -0,0 +1,56 @@
+package yamux
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Logger receives diagnostics from a session. Each message comes with
+// alternating key/value pairs such as "session", 1, "stream", 3, so a
+// *slog.Logger can be used directly.
+type Logger interface {
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NewStdLogger returns a Logger that writes one line per message to w,
+// with the fields formatted as key=value
+func NewStdLogger(w io.Writer) Logger {
+	return &stdLogger{logger: log.New(w, "yamux: ", log.LstdFlags)}
+}
+
+// stdLogger formats messages through the standard log package
+type stdLogger struct {
+	logger *log.Logger
+}
+
+// Warn logs a recoverable problem
+func (l *stdLogger) Warn(msg string, args ...interface{}) {
+	l.output("WARN", msg, args)
+}
+
+// Error logs a problem that affects the session
+func (l *stdLogger) Error(msg string, args ...interface{}) {
+	l.output("ERROR", msg, args)
+}
+
+// output writes the level, message and fields on one line
+func (l *stdLogger) output(level, msg string, args []interface{}) {
+	var line strings.Builder
+	line.WriteString("[" + level + "] " + msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&line, " %v=%v", args[i], args[i+1])
+	}
+	if len(args)%2 == 1 {
+		fmt.Fprintf(&line, " %v", args[len(args)-1])
+	}
+	l.logger.Print(line.String())
+}
+
+// nopLogger discards everything. It is used when Config.Logger is nil.
+type nopLogger struct{}
+
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
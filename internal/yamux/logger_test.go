@@ -0,0 +1,183 @@
+package yamux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logEntry is one message captured by recordingLogger
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[interface{}]interface{}
+}
+
+// recordingLogger keeps every message for inspection
+type recordingLogger struct {
+	mutex   sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) Warn(msg string, args ...interface{}) {
+	l.record("WARN", msg, args)
+}
+
+func (l *recordingLogger) Error(msg string, args ...interface{}) {
+	l.record("ERROR", msg, args)
+}
+
+func (l *recordingLogger) record(level, msg string, args []interface{}) {
+	fields := make(map[interface{}]interface{})
+	for i := 0; i+1 < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, logEntry{level: level, msg: msg, fields: fields})
+}
+
+// find returns the first entry with the given message
+func (l *recordingLogger) find(msg string) (logEntry, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, entry := range l.entries {
+		if entry.msg == msg {
+			return entry, true
+		}
+	}
+	return logEntry{}, false
+}
+
+func TestLoggerReceivesStreamFields(t *testing.T) {
+	logger := &recordingLogger{}
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	config.AcceptBacklog = 1
+	config.Logger = logger
+	client, server := newSessionPair(t, config)
+
+	if _, err := client.OpenStream(); err != nil {
+		t.Fatalf("Failed to open first stream: %v", err)
+	}
+	if _, err := client.OpenStream(); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("Expected ErrStreamReset once the backlog is full, got %v", err)
+	}
+
+	entry, ok := logger.find("Accept backlog is full, resetting stream")
+	if !ok {
+		t.Fatal("Expected a warning about the full backlog")
+	}
+	if entry.level != "WARN" {
+		t.Errorf("Expected level WARN, got %s", entry.level)
+	}
+	if entry.fields["session"] != server.id {
+		t.Errorf("Expected session field %d, got %v", server.id, entry.fields["session"])
+	}
+	if entry.fields["stream"] != uint32(3) {
+		t.Errorf("Expected stream field 3, got %v", entry.fields["stream"])
+	}
+}
+
+func TestNilLoggerSilencesSession(t *testing.T) {
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	config.Logger = nil
+	client, server := newSessionPair(t, config)
+
+	if client.logger == nil || server.logger == nil {
+		t.Fatal("Expected a nil Logger to be replaced with a no-op logger")
+	}
+
+	// Failing the session must not panic without a logger
+	client.protocolError(ErrInvalidMsgType)
+	if !errors.Is(client.Err(), ErrInvalidMsgType) {
+		t.Errorf("Expected ErrInvalidMsgType, got %v", client.Err())
+	}
+}
+
+func TestStdLoggerFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(&buf)
+
+	logger.Warn("Received go away", "session", 1, "reason", GoAwayInternalError)
+
+	line := buf.String()
+	if !strings.HasPrefix(line, "yamux: ") {
+		t.Errorf("Expected yamux prefix, got %q", line)
+	}
+	if !strings.Contains(line, "[WARN] Received go away session=1 reason=internal error") {
+		t.Errorf("Unexpected log line %q", line)
+	}
+}
+
+func TestProtocolErrorIsReturnedToCallers(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	config.Logger = nil
+	client, err := Client(clientConn, config)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	// An unknown frame type fails the session; drain the go-away it sends
+	go io.Copy(io.Discard, peerConn)
+	peerConn.Write(createHeader(0, 0x7f, 0, 0))
+
+	err = waitForError(t, func() error {
+		_, err := client.OpenStream()
+		return err
+	})
+	if !errors.Is(err, ErrSessionShutdown) {
+		t.Errorf("Expected ErrSessionShutdown, got %v", err)
+	}
+	if !errors.Is(err, ErrInvalidMsgType) {
+		t.Errorf("Expected the cause ErrInvalidMsgType, got %v", err)
+	}
+}
+
+func TestKeepAliveTimeoutIsReturnedToCallers(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	// A peer that reads everything and never answers pings
+	go io.Copy(io.Discard, peerConn)
+
+	logger := &recordingLogger{}
+	config := NewConfig()
+	config.KeepAliveInterval = 20 * time.Millisecond
+	config.KeepAliveMaxMissed = 2
+	config.Logger = logger
+	client, err := Client(clientConn, config)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.AcceptStream()
+	if !errors.Is(err, ErrKeepAliveTimeout) {
+		t.Errorf("Expected AcceptStream to fail with ErrKeepAliveTimeout, got %v", err)
+	}
+	if client.Err() != ErrKeepAliveTimeout {
+		t.Errorf("Expected Err to be ErrKeepAliveTimeout, got %v", client.Err())
+	}
+
+	entry, ok := logger.find("Closing session")
+	if !ok {
+		t.Fatal("Expected the session failure to be logged")
+	}
+	if entry.level != "ERROR" || entry.fields["error"] != ErrKeepAliveTimeout {
+		t.Errorf("Unexpected log entry %+v", entry)
+	}
+}
@@ -0,0 +1,207 @@
+package yamux
+
+import "sync"
+
+const (
+	// DefaultPriority is the priority streams start with
+	DefaultPriority = 1
+
+	// MaxPriority is the highest priority a stream can be given
+	MaxPriority = 16
+
+	// streamQueueSize is the most frames a stream can have waiting for
+	// the writer before senders block
+	streamQueueSize = 16
+
+	// controlQueueSize is the most control frames that can wait for the
+	// writer before senders block
+	controlQueueSize = 256
+
+	// writeBatchBytes caps the payload gathered into one vectored write,
+	// so control frames queued meanwhile do not wait long
+	writeBatchBytes = 256 * 1024
+)
+
+// streamQueue holds the frames of one stream waiting for the writer
+type streamQueue struct {
+	frames []*frame
+
+	// weight is how many frames the stream sends per round and credit
+	// how many it has left in the current one
+	weight int
+	credit int
+}
+
+// scheduler decides the order frames reach the connection. Control frames
+// go first, then streams take turns round-robin, each sending as many
+// frames per turn as its priority. Frames of one stream keep their order,
+// so a FIN never overtakes the data before it.
+type scheduler struct {
+	mutex   sync.Mutex
+	control []*frame
+	streams map[uint32]*streamQueue
+	ready   []uint32       // streams with queued frames, in turn order
+	spare   []*streamQueue // emptied queues kept for reuse
+
+	// notify wakes the writer when frames are queued. space is closed
+	// when the writer frees room while senders are blocked on a full queue.
+	notify  chan struct{}
+	space   chan struct{}
+	blocked bool
+}
+
+// newScheduler creates an empty scheduler
+func newScheduler() *scheduler {
+	return &scheduler{
+		streams: make(map[uint32]*streamQueue),
+		notify:  make(chan struct{}, 1),
+		space:   make(chan struct{}),
+	}
+}
+
+// push queues a control frame, or a frame of the given stream if stream is
+// not nil. If the queue is full it returns false and a channel that is
+// closed once there may be room.
+func (q *scheduler) push(f *frame, stream *Stream) (bool, <-chan struct{}) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if stream == nil {
+		if len(q.control) >= controlQueueSize {
+			q.blocked = true
+			return false, q.space
+		}
+		q.control = append(q.control, f)
+	} else {
+		sq, ok := q.streams[stream.id]
+		if !ok {
+			sq = q.newStreamQueue(stream.Priority())
+			q.streams[stream.id] = sq
+			q.ready = append(q.ready, stream.id)
+		}
+		if len(sq.frames) >= streamQueueSize {
+			q.blocked = true
+			return false, q.space
+		}
+		sq.frames = append(sq.frames, f)
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// newStreamQueue returns an empty queue, reusing a spare one if possible.
+// The caller must hold the mutex.
+func (q *scheduler) newStreamQueue(weight int) *streamQueue {
+	var sq *streamQueue
+	if n := len(q.spare); n > 0 {
+		sq = q.spare[n-1]
+		q.spare = q.spare[:n-1]
+	} else {
+		sq = &streamQueue{frames: make([]*frame, 0, streamQueueSize)}
+	}
+	sq.weight = weight
+	sq.credit = weight
+	return sq
+}
+
+// pop appends the next frames to write to batch, up to max frames and
+// roughly writeBatchBytes of payload
+func (q *scheduler) pop(batch []*frame, max int) []*frame {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	start := len(batch)
+
+	// Control frames first, however large the batch gets
+	n := len(q.control)
+	if n > max-len(batch) {
+		n = max - len(batch)
+	}
+	batch = append(batch, q.control[:n]...)
+	q.control = shiftFrames(q.control, n)
+
+	bytes := 0
+	for len(q.ready) > 0 && len(batch) < max && bytes < writeBatchBytes {
+		id := q.ready[0]
+		sq := q.streams[id]
+
+		f := sq.frames[0]
+		sq.frames = shiftFrames(sq.frames, 1)
+		sq.credit--
+		batch = append(batch, f)
+		bytes += len(f.body)
+
+		switch {
+		case len(sq.frames) == 0:
+			// Nothing left, the stream rejoins at the back when it
+			// queues again
+			delete(q.streams, id)
+			q.spare = append(q.spare, sq)
+			q.ready = shiftIDs(q.ready)
+		case sq.credit == 0:
+			// Turn used up, move to the back of the line
+			sq.credit = sq.weight
+			q.ready = append(shiftIDs(q.ready), id)
+		}
+	}
+
+	if len(batch) > start && q.blocked {
+		close(q.space)
+		q.space = make(chan struct{})
+		q.blocked = false
+	}
+	return batch
+}
+
+// drain removes every queued frame
+func (q *scheduler) drain() []*frame {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	frames := append([]*frame(nil), q.control...)
+	for _, id := range q.ready {
+		frames = append(frames, q.streams[id].frames...)
+	}
+	q.control = nil
+	q.streams = make(map[uint32]*streamQueue)
+	q.ready = nil
+	return frames
+}
+
+// shiftFrames drops the first n frames, moving the rest to the front so
+// the backing array is reused
+func shiftFrames(frames []*frame, n int) []*frame {
+	m := copy(frames, frames[n:])
+	for i := m; i < len(frames); i++ {
+		frames[i] = nil
+	}
+	return frames[:m]
+}
+
+// shiftIDs drops the first stream ID, moving the rest to the front
+func shiftIDs(ids []uint32) []uint32 {
+	return ids[:copy(ids, ids[1:])]
+}
+
+// SetPriority sets the stream's share of the connection relative to other
+// streams with queued data. A stream with priority 4 sends four frames for
+// every frame of a stream with priority 1. It is clamped to 1..MaxPriority
+// and takes effect the next time the stream queues data.
+func (s *Stream) SetPriority(priority int) {
+	if priority < 1 {
+		priority = 1
+	}
+	if priority > MaxPriority {
+		priority = MaxPriority
+	}
+	s.priority.Store(int32(priority))
+}
+
+// Priority returns the stream's priority
+func (s *Stream) Priority() int {
+	return int(s.priority.Load())
+}
@@ -0,0 +1,193 @@
+package yamux
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// popStreamIDs pops everything queued and returns the stream ID of each
+// frame in write order
+func popStreamIDs(q *scheduler) []uint32 {
+	var ids []uint32
+	for {
+		batch := q.pop(nil, writeBatchSize)
+		if len(batch) == 0 {
+			return ids
+		}
+		for _, f := range batch {
+			ids = append(ids, header(f.hdr[:]).StreamID())
+		}
+	}
+}
+
+func TestSchedulerControlFramesFirst(t *testing.T) {
+	q := newScheduler()
+	stream := newStream(nil, 1, streamEstablished)
+
+	for i := 0; i < 3; i++ {
+		q.push(getFrame(typeData, 0, 1, 0), stream)
+	}
+	q.push(getFrame(typePing, flagSYN, 0, 0), nil)
+
+	ids := popStreamIDs(q)
+	if len(ids) != 4 || ids[0] != 0 {
+		t.Errorf("Expected the ping ahead of the data, got order %v", ids)
+	}
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	q := newScheduler()
+	first := newStream(nil, 1, streamEstablished)
+	second := newStream(nil, 3, streamEstablished)
+
+	for i := 0; i < 3; i++ {
+		q.push(getFrame(typeData, 0, 1, 0), first)
+	}
+	for i := 0; i < 3; i++ {
+		q.push(getFrame(typeData, 0, 3, 0), second)
+	}
+
+	expected := []uint32{1, 3, 1, 3, 1, 3}
+	if ids := popStreamIDs(q); !equalIDs(ids, expected) {
+		t.Errorf("Expected order %v, got %v", expected, ids)
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	q := newScheduler()
+	bulk := newStream(nil, 1, streamEstablished)
+	urgent := newStream(nil, 3, streamEstablished)
+	urgent.SetPriority(3)
+
+	for i := 0; i < 4; i++ {
+		q.push(getFrame(typeData, 0, 1, 0), bulk)
+		q.push(getFrame(typeData, 0, 3, 0), urgent)
+	}
+
+	// The bulk stream queued first but the urgent one sends three frames
+	// per turn
+	expected := []uint32{1, 3, 3, 3, 1, 3, 1, 1}
+	if ids := popStreamIDs(q); !equalIDs(ids, expected) {
+		t.Errorf("Expected order %v, got %v", expected, ids)
+	}
+}
+
+func TestSchedulerFullQueueBlocks(t *testing.T) {
+	q := newScheduler()
+	stream := newStream(nil, 1, streamEstablished)
+
+	for i := 0; i < streamQueueSize; i++ {
+		if ok, _ := q.push(getFrame(typeData, 0, 1, 0), stream); !ok {
+			t.Fatalf("Push %d was refused before the queue was full", i)
+		}
+	}
+
+	ok, space := q.push(getFrame(typeData, 0, 1, 0), stream)
+	if ok {
+		t.Fatal("Expected a full stream queue to refuse the frame")
+	}
+
+	q.pop(nil, 1)
+	select {
+	case <-space:
+	default:
+		t.Error("Expected blocked senders to be woken once room was freed")
+	}
+}
+
+func TestSetPriorityClamps(t *testing.T) {
+	stream := newStream(nil, 1, streamEstablished)
+	if stream.Priority() != DefaultPriority {
+		t.Errorf("Expected priority %d, got %d", DefaultPriority, stream.Priority())
+	}
+
+	stream.SetPriority(0)
+	if stream.Priority() != 1 {
+		t.Errorf("Expected priority 1, got %d", stream.Priority())
+	}
+	stream.SetPriority(MaxPriority + 1)
+	if stream.Priority() != MaxPriority {
+		t.Errorf("Expected priority %d, got %d", MaxPriority, stream.Priority())
+	}
+}
+
+func equalIDs(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// saturate keeps writing on the stream until it fails
+func saturate(stream *Stream) {
+	chunk := make([]byte, 1024*1024)
+	for {
+		if _, err := stream.Write(chunk); err != nil {
+			return
+		}
+	}
+}
+
+func TestKeepAliveWhileStreamSaturates(t *testing.T) {
+	config := NewConfig()
+	config.KeepAliveInterval = 50 * time.Millisecond
+	config.KeepAliveMaxMissed = 2
+	config.Logger = nil
+	client, server := newSessionPair(t, config)
+
+	bulk, remote := openAccepted(t, client, server)
+	go io.Copy(io.Discard, remote)
+	go saturate(bulk)
+
+	// Several keep-alive intervals with the link busy
+	time.Sleep(500 * time.Millisecond)
+
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatalf("Session closed while a stream saturated the link: %v / %v", client.Err(), server.Err())
+	}
+	if failures := client.Stats().KeepAliveFailures; failures != 0 {
+		t.Errorf("Expected no missed keep-alives, got %d", failures)
+	}
+	if rtt, err := client.Ping(); err != nil {
+		t.Errorf("Ping failed while the link was saturated: %v", err)
+	} else if rtt > config.KeepAliveInterval {
+		t.Errorf("Ping took %v behind bulk data", rtt)
+	}
+}
+
+func TestInteractiveStreamWhileStreamSaturates(t *testing.T) {
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	client, server := newSessionPair(t, config)
+
+	bulk, remote := openAccepted(t, client, server)
+	go io.Copy(io.Discard, remote)
+	go saturate(bulk)
+
+	stream, peer := openAccepted(t, client, server)
+	go io.Copy(peer, peer)
+
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		if _, err := stream.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(stream, reply); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(reply, []byte("ping")) {
+			t.Fatalf("Expected echo, got %q", reply)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("Round trip %d took %v behind bulk data", i, elapsed)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package yamux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// frameTypeNames names the frame types in statistics
+var frameTypeNames = [...]string{
+	typeData:         "data",
+	typeWindowUpdate: "window_update",
+	typePing:         "ping",
+	typeGoAway:       "go_away",
+}
+
+// SessionStats is a snapshot of the activity of a session
+type SessionStats struct {
+	// BytesSent and BytesReceived count everything on the wire, headers
+	// included
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+
+	// FramesSent and FramesReceived count frames by type name
+	FramesSent     map[string]uint64 `json:"frames_sent"`
+	FramesReceived map[string]uint64 `json:"frames_received"`
+
+	// OpenStreams is the number of streams currently open and
+	// TotalStreams the number opened by either side since the start
+	OpenStreams  int    `json:"open_streams"`
+	TotalStreams uint64 `json:"total_streams"`
+
+	// AcceptBacklogDrops counts streams reset because the accept backlog
+	// was full
+	AcceptBacklogDrops uint64 `json:"accept_backlog_drops"`
+
+	// KeepAliveFailures counts keep-alive pings that went unanswered
+	KeepAliveFailures uint64 `json:"keepalive_failures"`
+
+	// LastActivity is when a frame was last sent or received
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// StreamStats is a snapshot of the activity of a stream
+type StreamStats struct {
+	ID uint32 `json:"id"`
+
+	// BytesSent and BytesReceived count payload bytes
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+
+	// Opened is when the stream was created and Lifetime how long it has
+	// been, or was, open
+	Opened   time.Time     `json:"opened"`
+	Lifetime time.Duration `json:"lifetime"`
+}
+
+// sessionCounters holds the counters behind SessionStats
+type sessionCounters struct {
+	bytesSent          atomic.Uint64
+	bytesReceived      atomic.Uint64
+	framesSent         [len(frameTypeNames)]atomic.Uint64
+	framesReceived     [len(frameTypeNames)]atomic.Uint64
+	totalStreams       atomic.Uint64
+	acceptBacklogDrops atomic.Uint64
+	keepAliveFailures  atomic.Uint64
+	lastActivity       atomic.Int64 // unix nanoseconds
+}
+
+// frameSent records a frame written to the connection
+func (c *sessionCounters) frameSent(msgType byte, size int) {
+	c.bytesSent.Add(uint64(size))
+	if int(msgType) < len(c.framesSent) {
+		c.framesSent[msgType].Add(1)
+	}
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// frameReceived records a frame read from the connection
+func (c *sessionCounters) frameReceived(msgType byte, size int) {
+	c.bytesReceived.Add(uint64(size))
+	if int(msgType) < len(c.framesReceived) {
+		c.framesReceived[msgType].Add(1)
+	}
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Stats returns a snapshot of the session's counters
+func (s *Session) Stats() SessionStats {
+	stats := SessionStats{
+		BytesSent:          s.counters.bytesSent.Load(),
+		BytesReceived:      s.counters.bytesReceived.Load(),
+		FramesSent:         make(map[string]uint64, len(frameTypeNames)),
+		FramesReceived:     make(map[string]uint64, len(frameTypeNames)),
+		TotalStreams:       s.counters.totalStreams.Load(),
+		AcceptBacklogDrops: s.counters.acceptBacklogDrops.Load(),
+		KeepAliveFailures:  s.counters.keepAliveFailures.Load(),
+	}
+
+	for i, name := range frameTypeNames {
+		stats.FramesSent[name] = s.counters.framesSent[i].Load()
+		stats.FramesReceived[name] = s.counters.framesReceived[i].Load()
+	}
+
+	if last := s.counters.lastActivity.Load(); last != 0 {
+		stats.LastActivity = time.Unix(0, last)
+	}
+
+	s.streamLock.Lock()
+	stats.OpenStreams = len(s.streams)
+	s.streamLock.Unlock()
+
+	return stats
+}
+
+// Streams returns a snapshot of the statistics of every open stream
+func (s *Session) Streams() []StreamStats {
+	s.streamLock.Lock()
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.streamLock.Unlock()
+
+	stats := make([]StreamStats, 0, len(streams))
+	for _, stream := range streams {
+		stats = append(stats, stream.Stats())
+	}
+	return stats
+}
+
+// Stats returns a snapshot of the stream's counters
+func (s *Stream) Stats() StreamStats {
+	s.stateLock.Lock()
+	closedAt := s.closedAt
+	s.stateLock.Unlock()
+
+	end := time.Now()
+	if !closedAt.IsZero() {
+		end = closedAt
+	}
+
+	return StreamStats{
+		ID:            s.id,
+		BytesSent:     s.bytesSent.Load(),
+		BytesReceived: s.bytesReceived.Load(),
+		Opened:        s.opened,
+		Lifetime:      end.Sub(s.opened),
+	}
+}
@@ -0,0 +1,84 @@
+package yamux
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSessionStats(t *testing.T) {
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	client, server := newSessionPair(t, config)
+
+	stream, remote := openAccepted(t, client, server)
+
+	payload := make([]byte, 1000)
+	go stream.Write(payload)
+	if _, err := io.ReadFull(remote, make([]byte, len(payload))); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	stats := client.Stats()
+	if stats.OpenStreams != 1 || stats.TotalStreams != 1 {
+		t.Errorf("Expected 1 open and 1 total stream, got %d and %d", stats.OpenStreams, stats.TotalStreams)
+	}
+	if stats.FramesSent["data"] == 0 || stats.FramesSent["ping"] == 0 {
+		t.Errorf("Expected data and ping frames to be counted, got %v", stats.FramesSent)
+	}
+	if stats.FramesReceived["window_update"] == 0 {
+		t.Errorf("Expected the ACK window update to be counted, got %v", stats.FramesReceived)
+	}
+	if stats.BytesSent < uint64(len(payload)+headerSize) {
+		t.Errorf("Expected at least %d bytes sent, got %d", len(payload)+headerSize, stats.BytesSent)
+	}
+	if stats.LastActivity.IsZero() || time.Since(stats.LastActivity) > time.Second {
+		t.Errorf("Unexpected last activity %v", stats.LastActivity)
+	}
+
+	if got := server.Stats().BytesReceived; got != stats.BytesSent {
+		t.Errorf("Server received %d bytes, client sent %d", got, stats.BytesSent)
+	}
+
+	sent, received := stream.Stats(), remote.Stats()
+	if sent.BytesSent != uint64(len(payload)) || received.BytesReceived != uint64(len(payload)) {
+		t.Errorf("Expected %d payload bytes each way, got %d sent and %d received",
+			len(payload), sent.BytesSent, received.BytesReceived)
+	}
+	if sent.ID != stream.StreamID() {
+		t.Errorf("Expected stream ID %d, got %d", stream.StreamID(), sent.ID)
+	}
+
+	if streams := client.Streams(); len(streams) != 1 {
+		t.Errorf("Expected stats for 1 stream, got %d", len(streams))
+	}
+
+	// The lifetime stops growing once the stream is reset
+	stream.Reset()
+	lifetime := stream.Stats().Lifetime
+	time.Sleep(10 * time.Millisecond)
+	if stream.Stats().Lifetime != lifetime {
+		t.Error("Lifetime kept growing after the stream was reset")
+	}
+}
+
+func TestSessionStatsCountsBacklogDrops(t *testing.T) {
+	config := NewConfig()
+	config.EnableKeepAlive = false
+	config.AcceptBacklog = 1
+	client, server := newSessionPair(t, config)
+
+	client.OpenStream()
+	if _, err := client.OpenStream(); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("Expected ErrStreamReset, got %v", err)
+	}
+
+	if drops := server.Stats().AcceptBacklogDrops; drops != 1 {
+		t.Errorf("Expected 1 accept backlog drop, got %d", drops)
+	}
+}
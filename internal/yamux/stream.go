@@ -0,0 +1,677 @@
+package yamux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamState tracks the lifecycle of a stream
+type streamState int
+
+const (
+	// streamSYNSent is a locally opened stream waiting for the peer's ACK
+	streamSYNSent streamState = iota
+
+	// streamSYNReceived is a stream opened by the peer
+	streamSYNReceived
+
+	// streamEstablished is a stream the peer has acknowledged
+	streamEstablished
+
+	// streamLocalClose is a stream we sent FIN on; it can still be read
+	streamLocalClose
+
+	// streamRemoteClose is a stream the peer sent FIN on; it can still be
+	// written
+	streamRemoteClose
+
+	// streamClosed is a stream closed in both directions or with its session
+	streamClosed
+
+	// streamReset is a stream aborted by either side
+	streamReset
+)
+
+// Stream is a logical stream within a session. It implements net.Conn.
+type Stream struct {
+	session *Session
+	id      uint32
+	state   streamState
+
+	// readClosed is set by Close to reject further reads
+	readClosed bool
+
+	readBuf *buffer
+
+	// establishCh is closed once the peer answers the SYN with ACK or RST
+	establishCh   chan struct{}
+	establishOnce sync.Once
+
+	// Flow control
+	stateLock    sync.Mutex
+	sendWindow   uint32 // bytes the peer is willing to accept
+	recvWindow   uint32 // bytes we have granted the peer
+	sendNotifyCh chan struct{}
+
+	// priority weighs the stream against others when writing
+	priority atomic.Int32
+
+	// writeDeadline is guarded by stateLock; the read deadline lives in readBuf
+	writeDeadline time.Time
+
+	// Statistics. closedAt is guarded by stateLock.
+	opened        time.Time
+	closedAt      time.Time
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+}
+
+// StreamID returns the ID of the stream
+func (s *Stream) StreamID() uint32 {
+	return s.id
+}
+
+// newStream creates a new stream
+func newStream(session *Session, id uint32, state streamState) *Stream {
+	s := &Stream{
+		session:      session,
+		id:           id,
+		state:        state,
+		readBuf:      newBuffer(),
+		establishCh:  make(chan struct{}),
+		sendWindow:   initialStreamWindow,
+		recvWindow:   initialStreamWindow,
+		sendNotifyCh: make(chan struct{}, 1),
+		opened:       time.Now(),
+	}
+	s.priority.Store(DefaultPriority)
+	return s
+}
+
+// markClosed records when the stream stopped being usable. The caller
+// must hold stateLock.
+func (s *Stream) markClosed() {
+	if s.closedAt.IsZero() {
+		s.closedAt = time.Now()
+	}
+}
+
+// getState returns the current state of the stream
+func (s *Stream) getState() streamState {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.state
+}
+
+// Read reads data from the stream. Data the peer sent before its FIN is
+// delivered before io.EOF.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.stateLock.Lock()
+	state, readClosed := s.state, s.readClosed
+	s.stateLock.Unlock()
+
+	if state == streamReset {
+		return 0, ErrStreamReset
+	}
+	if readClosed {
+		return 0, ErrStreamClosed
+	}
+
+	n, err := s.readBuf.Read(p)
+	if err == io.EOF && s.getState() == streamReset {
+		return n, ErrStreamReset
+	}
+	if n > 0 {
+		// Reopen the window the peer used up once enough was drained
+		if werr := s.sendWindowUpdate(0); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// Write writes data to the stream, blocking while the peer's receive
+// window is exhausted. Large writes are queued as several frames at once
+// and Write returns when all of them have been written.
+func (s *Stream) Write(p []byte) (int, error) {
+	var pending [streamQueueSize]*frame
+	queued := 0
+	offset, written := 0, 0
+
+	var err error
+	for offset < len(p) && err == nil {
+		var n int
+		var f *frame
+		n, f, err = s.write(p[offset:])
+		offset += n
+		if f == nil {
+			written += n
+			continue
+		}
+
+		pending[queued] = f
+		queued++
+		if queued == len(pending) {
+			n, werr := s.session.waitFrames(pending[:queued])
+			written += n
+			queued = 0
+			if werr != nil {
+				return written, werr
+			}
+		}
+	}
+
+	// p must not be touched by the writer once we return
+	n, werr := s.session.waitFrames(pending[:queued])
+	written += n
+	if err == nil {
+		err = werr
+	}
+	return written, err
+}
+
+// writeErr returns the error a write in the given state fails with
+func writeErr(state streamState) error {
+	switch state {
+	case streamReset:
+		return ErrStreamReset
+	case streamLocalClose, streamClosed:
+		return ErrStreamClosed
+	}
+	return nil
+}
+
+// write queues as much of p as the send window and the maximum frame size
+// allow in a single frame. If the payload was not copied the frame is
+// returned and must be waited for before p is reused.
+func (s *Stream) write(p []byte) (int, *frame, error) {
+	// Check if there's data to write
+	if len(p) == 0 {
+		return 0, nil, nil
+	}
+
+	// Wait until the peer has room for at least one byte
+	s.stateLock.Lock()
+	for s.sendWindow == 0 || writeErr(s.state) != nil {
+		if err := writeErr(s.state); err != nil {
+			s.stateLock.Unlock()
+			return 0, nil, err
+		}
+		deadline := s.writeDeadline
+		s.stateLock.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, nil, ErrTimeout
+		}
+
+		// SetWriteDeadline also signals sendNotifyCh so a new deadline
+		// is picked up by the next iteration
+		timeout, stop := deadlineTimer(deadline)
+		select {
+		case <-s.sendNotifyCh:
+		case <-timeout:
+		case <-s.session.readerShutdown:
+			stop()
+			return 0, nil, s.session.shutdownErr()
+		}
+		stop()
+		s.stateLock.Lock()
+	}
+
+	n := uint32(len(p))
+	if n > s.sendWindow {
+		n = s.sendWindow
+	}
+	if max := s.session.config.MaxFrameSize; n > max {
+		n = max
+	}
+	s.sendWindow -= n
+	deadline := s.writeDeadline
+	s.stateLock.Unlock()
+
+	// Count before sending so the peer never reads bytes missing from
+	// our statistics
+	s.bytesSent.Add(uint64(n))
+	f, err := s.session.queueData(s, p[:n], deadline)
+	if err != nil {
+		// The frame was never queued, give the window back
+		s.bytesSent.Add(^uint64(n - 1))
+		s.incrSendWindow(n)
+		return 0, nil, err
+	}
+
+	return int(n), f, nil
+}
+
+// sendWindowUpdate grants the peer the space freed by reads. Updates are
+// batched until at least half the window can be reopened, unless flags
+// have to be delivered.
+func (s *Stream) sendWindowUpdate(flags uint16) error {
+	max := s.session.config.MaxStreamWindowSize
+
+	s.stateLock.Lock()
+	var delta uint32
+	if used := uint32(s.readBuf.Len()) + s.recvWindow; used < max {
+		// Data being buffered counts in both while handleData runs, so
+		// used can briefly exceed max
+		delta = max - used
+	}
+	if delta < max/2 && flags == 0 {
+		s.stateLock.Unlock()
+		return nil
+	}
+	s.recvWindow += delta
+	s.stateLock.Unlock()
+
+	return s.session.send(typeWindowUpdate, flags, s.id, delta)
+}
+
+// incrSendWindow extends the send window and wakes a blocked writer. It
+// returns false, leaving the window alone, if delta would overflow it.
+func (s *Stream) incrSendWindow(delta uint32) bool {
+	s.stateLock.Lock()
+	if s.sendWindow+delta < s.sendWindow {
+		s.stateLock.Unlock()
+		return false
+	}
+	s.sendWindow += delta
+	s.stateLock.Unlock()
+
+	s.notifyWriter()
+	return true
+}
+
+// notifyWriter wakes a writer waiting for window space
+func (s *Stream) notifyWriter() {
+	select {
+	case s.sendNotifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// notifyEstablished wakes OpenStream once the peer has answered the SYN
+func (s *Stream) notifyEstablished() {
+	s.establishOnce.Do(func() { close(s.establishCh) })
+}
+
+// processFlags applies the flags of a frame received for the stream
+func (s *Stream) processFlags(flags uint16) {
+	if flags&flagACK == flagACK {
+		s.stateLock.Lock()
+		if s.state == streamSYNSent {
+			s.state = streamEstablished
+		}
+		s.stateLock.Unlock()
+		s.notifyEstablished()
+	}
+
+	// A FIN lets the reader drain what is buffered before seeing EOF,
+	// while our side may keep writing
+	if flags&flagFIN == flagFIN {
+		s.stateLock.Lock()
+		closed := false
+		switch s.state {
+		case streamSYNSent, streamSYNReceived, streamEstablished:
+			s.state = streamRemoteClose
+		case streamLocalClose:
+			s.state = streamClosed
+			s.markClosed()
+			closed = true
+		}
+		s.stateLock.Unlock()
+
+		s.readBuf.Close()
+		if closed {
+			s.session.removeStream(s.id)
+		}
+	}
+
+	if flags&flagRST == flagRST {
+		s.abort()
+	}
+}
+
+// abort moves the stream to the reset state and wakes everyone waiting on it
+func (s *Stream) abort() bool {
+	s.stateLock.Lock()
+	if s.state == streamReset {
+		s.stateLock.Unlock()
+		return false
+	}
+	s.state = streamReset
+	s.markClosed()
+	s.stateLock.Unlock()
+
+	s.readBuf.Close()
+	s.notifyWriter()
+	s.notifyEstablished()
+	s.session.removeStream(s.id)
+	return true
+}
+
+// forceClose marks the stream closed when its session goes away
+func (s *Stream) forceClose() {
+	s.stateLock.Lock()
+	if s.state != streamReset {
+		s.state = streamClosed
+		s.markClosed()
+	}
+	s.stateLock.Unlock()
+
+	s.readBuf.Close()
+	s.notifyWriter()
+}
+
+// LocalAddr returns the local address of the session
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (s *Stream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for blocked and future reads. A zero
+// value disables it.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readBuf.SetDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for blocked and future writes. A zero
+// value disables it.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.stateLock.Lock()
+	s.writeDeadline = t
+	s.stateLock.Unlock()
+
+	s.notifyWriter()
+	return nil
+}
+
+// Reset aborts the stream. Pending data is discarded and both sides get
+// ErrStreamReset from further reads and writes.
+func (s *Stream) Reset() error {
+	if !s.abort() {
+		return nil
+	}
+	return s.session.send(typeWindowUpdate, flagRST, s.id, 0)
+}
+
+// CloseWrite half-closes the stream. The peer reads EOF once it has
+// drained what was sent, and we keep reading until the peer's FIN.
+func (s *Stream) CloseWrite() error {
+	s.stateLock.Lock()
+	closed := false
+	switch s.state {
+	case streamSYNSent, streamSYNReceived, streamEstablished:
+		s.state = streamLocalClose
+	case streamRemoteClose:
+		s.state = streamClosed
+		s.markClosed()
+		closed = true
+	default:
+		s.stateLock.Unlock()
+		return nil
+	}
+	s.stateLock.Unlock()
+
+	// Fail writers waiting for window space
+	s.notifyWriter()
+	if closed {
+		s.session.removeStream(s.id)
+	}
+
+	// Send a FIN message behind any data still queued
+	return s.session.sendOrdered(s, typeWindowUpdate, flagFIN, s.id, 0)
+}
+
+// Close closes the stream in both directions. Unread data is discarded
+// and further reads and writes fail with ErrStreamClosed.
+func (s *Stream) Close() error {
+	s.stateLock.Lock()
+	s.readClosed = true
+	state := s.state
+	s.stateLock.Unlock()
+
+	// Give back the window of the dropped data so a peer still writing is
+	// not stalled. The session reader does the same for data arriving
+	// from now on.
+	if s.readBuf.drop() > 0 {
+		switch state {
+		case streamSYNSent, streamSYNReceived, streamEstablished, streamLocalClose:
+			s.sendWindowUpdate(0)
+		}
+	}
+	return s.CloseWrite()
+}
+
+// minBufferSize is the capacity a receive buffer starts with once data
+// arrives
+const minBufferSize = 4 * 1024
+
+// buffer is a ring buffer holding received data until the stream is read.
+// It grows on demand; the receive window bounds how much it can hold.
+// The session reader is the only writer, which lets it fill the free
+// space straight from the connection without holding the lock.
+type buffer struct {
+	buf  []byte
+	head int // index of the first unread byte
+	size int // number of unread bytes
+
+	closed   bool
+	deadline time.Time
+	mutex    sync.Mutex
+	signal   chan struct{}
+}
+
+// newBuffer creates an empty buffer. Memory is only allocated once data
+// arrives.
+func newBuffer() *buffer {
+	return &buffer{
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// peek copies unread data into p without consuming it. The caller must
+// hold the mutex.
+func (b *buffer) peek(p []byte) int {
+	first := b.buf[b.head:]
+	if len(first) > b.size {
+		first = first[:b.size]
+	}
+	n := copy(p, first)
+	if n == len(first) && n < b.size {
+		n += copy(p[n:], b.buf[:b.size-n])
+	}
+	return n
+}
+
+// Read reads data from the buffer
+func (b *buffer) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+
+	for b.size == 0 {
+		// Buffer is empty
+		if b.closed {
+			b.mutex.Unlock()
+			return 0, io.EOF
+		}
+
+		deadline := b.deadline
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			b.mutex.Unlock()
+			return 0, ErrTimeout
+		}
+
+		// Wait for more data, the deadline or a new deadline
+		b.mutex.Unlock()
+		timeout, stop := deadlineTimer(deadline)
+		select {
+		case <-b.signal:
+		case <-timeout:
+		}
+		stop()
+		b.mutex.Lock()
+	}
+
+	// Consume the data. head is never rewound here since the session
+	// reader may be filling the space after the unread bytes.
+	n := b.peek(p)
+	b.head = (b.head + n) % len(b.buf)
+	b.size -= n
+
+	b.mutex.Unlock()
+	return n, nil
+}
+
+// grow makes room for n more bytes, doubling the capacity as needed. The
+// caller must hold the mutex.
+func (b *buffer) grow(n int) {
+	if len(b.buf)-b.size >= n {
+		return
+	}
+
+	newSize := len(b.buf) * 2
+	if newSize < minBufferSize {
+		newSize = minBufferSize
+	}
+	for newSize < b.size+n {
+		newSize *= 2
+	}
+
+	newBuf := make([]byte, newSize)
+	b.peek(newBuf)
+	b.buf = newBuf
+	b.head = 0
+}
+
+// free returns the space for the next n bytes, which may wrap around the
+// end of the ring. The caller must hold the mutex and have grown the
+// buffer to fit.
+func (b *buffer) free(n int) ([]byte, []byte) {
+	tail := (b.head + b.size) % len(b.buf)
+	first := b.buf[tail:]
+	if len(first) > n {
+		first = first[:n]
+	}
+	return first, b.buf[:n-len(first)]
+}
+
+// commit makes n bytes written into the free space readable. It reports
+// false and drops them if the buffer was closed while they were written.
+func (b *buffer) commit(n int) bool {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return false
+	}
+	b.size += n
+	b.mutex.Unlock()
+
+	// Signal that data is available
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// fill moves exactly n bytes from r into the buffer without an
+// intermediate copy. Data for a closed buffer is read and dropped, which
+// fill reports by returning false. That includes data arriving while the
+// buffer is closed, since the mutex is not held while reading r.
+func (b *buffer) fill(r io.Reader, n int) (bool, error) {
+	if n == 0 {
+		return true, nil
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		_, err := io.CopyN(io.Discard, r, int64(n))
+		return false, err
+	}
+	b.grow(n)
+	first, second := b.free(n)
+	b.mutex.Unlock()
+
+	if _, err := io.ReadFull(r, first); err != nil {
+		return false, err
+	}
+	if _, err := io.ReadFull(r, second); err != nil {
+		return false, err
+	}
+
+	return b.commit(n), nil
+}
+
+// drop closes the buffer and discards the unread data, returning how many
+// bytes were dropped
+func (b *buffer) drop() int {
+	b.Close()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Advance head like Read does, the session reader may still be
+	// filling the space after the unread bytes
+	n := b.size
+	if n > 0 {
+		b.head = (b.head + n) % len(b.buf)
+		b.size = 0
+	}
+	return n
+}
+
+// SetDeadline sets the read deadline and wakes a blocked reader so it
+// takes effect immediately
+func (b *buffer) SetDeadline(t time.Time) {
+	b.mutex.Lock()
+	b.deadline = t
+	b.mutex.Unlock()
+
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of unread bytes in the buffer
+func (b *buffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.size
+}
+
+// Close closes the buffer
+func (b *buffer) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil
+	}
+
+	b.closed = true
+
+	// Signal to unblock any waiting readers
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
@@ -4,43 +4,223 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Protocol constants
+// Protocol constants. The wire format follows the yamux specification used
+// by github.com/hashicorp/yamux, so sessions from either implementation can
+// talk to each other.
 const (
-	// Header byte size
-	headerSize = 10
+	// protoVersion is the only protocol version we speak
+	protoVersion byte = 0
 
-	// Message types
-	typeData byte = iota
-	typeSYN
-	typeFIN
-	typeACK
-	typePING
-	typePONG
+	// Header byte size: version(1) type(1) flags(2) stream ID(4) length(4)
+	headerSize = 12
+
+	// initialStreamWindow is the receive window every stream starts with.
+	// Both peers assume it without negotiation; larger windows are granted
+	// with window update frames.
+	initialStreamWindow uint32 = 256 * 1024
 
 	// Default settings
-	defaultAcceptBacklog         = 256
-	defaultEnableKeepAlive       = true
-	defaultKeepAliveInterval     = 30 * time.Second
+	defaultAcceptBacklog          = 256
+	defaultEnableKeepAlive        = true
+	defaultKeepAliveInterval      = 30 * time.Second
+	defaultKeepAliveMaxMissed     = 3
 	defaultConnectionWriteTimeout = 10 * time.Second
-	defaultStreamOpenTimeout     = 10 * time.Second
+	defaultStreamOpenTimeout      = 10 * time.Second
+	defaultMaxStreamWindowSize    = initialStreamWindow
+	defaultMaxFrameSize           = 64 * 1024
+
+	// smallWriteSize is the largest payload copied into the frame so the
+	// sender does not wait for the writer; larger payloads are not copied
+	smallWriteSize = 4 * 1024
+
+	// writeBatchSize is the most frames the writer hands to the
+	// connection in one vectored write
+	writeBatchSize = 64
+)
+
+// Message types
+const (
+	// typeData frames are followed by length bytes of payload
+	typeData byte = iota
+
+	// typeWindowUpdate grants the peer length more bytes of send window
+	typeWindowUpdate
+
+	// typePing carries an opaque ID in the length field that is echoed back
+	typePing
+
+	// typeGoAway terminates a session; the length field is a reason code
+	typeGoAway
+)
+
+// Header flags
+const (
+	// flagSYN opens a new stream
+	flagSYN uint16 = 1 << iota
+
+	// flagACK acknowledges a new stream or answers a ping
+	flagACK
+
+	// flagFIN half-closes a stream
+	flagFIN
+
+	// flagRST aborts a stream
+	flagRST
+)
+
+// GoAwayReason is the code carried by a go-away frame
+type GoAwayReason uint32
+
+// GoAway reason codes
+const (
+	// GoAwayNormal is sent when a session is shutting down cleanly
+	GoAwayNormal GoAwayReason = iota
+
+	// GoAwayProtocolError is sent when the peer violated the protocol
+	GoAwayProtocolError
+
+	// GoAwayInternalError is sent when the session failed locally
+	GoAwayInternalError
 )
 
+// String returns a readable name for the reason
+func (r GoAwayReason) String() string {
+	switch r {
+	case GoAwayNormal:
+		return "normal"
+	case GoAwayProtocolError:
+		return "protocol error"
+	case GoAwayInternalError:
+		return "internal error"
+	default:
+		return fmt.Sprintf("unknown reason %d", uint32(r))
+	}
+}
+
+var (
+	// ErrSessionShutdown is returned when the session has been closed. If
+	// the session failed, the cause is wrapped with it.
+	ErrSessionShutdown = fmt.Errorf("session shutdown")
+
+	// ErrInvalidVersion means the peer sent a frame with an unknown
+	// protocol version
+	ErrInvalidVersion = fmt.Errorf("invalid protocol version")
+
+	// ErrInvalidMsgType means the peer sent a frame with an unknown type
+	ErrInvalidMsgType = fmt.Errorf("invalid message type")
+
+	// ErrDuplicateStream means the peer opened a stream ID already in use
+	ErrDuplicateStream = fmt.Errorf("duplicate stream opened")
+
+	// ErrRecvWindowExceeded means the peer sent more than we granted
+	ErrRecvWindowExceeded = fmt.Errorf("receive window exceeded")
+
+	// ErrSendWindowOverflow means the peer granted more window than fits
+	// in a uint32
+	ErrSendWindowOverflow = fmt.Errorf("send window overflow")
+
+	// ErrStreamClosed is returned when writing to a closed stream
+	ErrStreamClosed = fmt.Errorf("stream closed")
+
+	// ErrStreamReset is returned when either side aborted the stream,
+	// including when the peer refused to accept it
+	ErrStreamReset = fmt.Errorf("stream reset")
+
+	// ErrRemoteGoAway is returned by OpenStream once the peer sent a go-away
+	ErrRemoteGoAway = fmt.Errorf("remote end is not accepting streams")
+
+	// ErrTimeout is returned when a read or write deadline passes. It
+	// satisfies net.Error so net/http and friends treat it as a timeout.
+	ErrTimeout net.Error = &timeoutError{}
+
+	// ErrKeepAliveTimeout is the cause of a session closed because the
+	// peer stopped answering keep-alive pings
+	ErrKeepAliveTimeout = fmt.Errorf("keepalive timeout")
+
+	// ErrStreamOpenTimeout is returned when the peer did not acknowledge a
+	// new stream within StreamOpenTimeout
+	ErrStreamOpenTimeout = fmt.Errorf("timeout waiting for stream acknowledgement")
+)
+
+// timeoutError is the net.Error returned when a deadline passes
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o deadline reached" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// Is lets errors.Is match os.ErrDeadlineExceeded like net.Conn errors do
+func (e *timeoutError) Is(target error) bool {
+	return target == os.ErrDeadlineExceeded
+}
+
+// deadlineTimer returns a channel that fires at the deadline, or a nil
+// channel if there is none, and a function to release the timer
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, func() { timer.Stop() }
+}
+
+// yamuxAddr is used when the underlying connection has no address
+type yamuxAddr struct {
+	addr string
+}
+
+func (a *yamuxAddr) Network() string { return "yamux" }
+func (a *yamuxAddr) String() string  { return "yamux:" + a.addr }
+
+// header is a frame header in wire format
+type header []byte
+
+// encodeHeader builds a frame header
+func encodeHeader(msgType byte, flags uint16, streamID uint32, length uint32) header {
+	h := header(make([]byte, headerSize))
+	h.encode(msgType, flags, streamID, length)
+	return h
+}
+
+// encode fills in the header in place
+func (h header) encode(msgType byte, flags uint16, streamID uint32, length uint32) {
+	h[0] = protoVersion
+	h[1] = msgType
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], streamID)
+	binary.BigEndian.PutUint32(h[8:12], length)
+}
+
+func (h header) Version() byte    { return h[0] }
+func (h header) MsgType() byte    { return h[1] }
+func (h header) Flags() uint16    { return binary.BigEndian.Uint16(h[2:4]) }
+func (h header) StreamID() uint32 { return binary.BigEndian.Uint32(h[4:8]) }
+func (h header) Length() uint32   { return binary.BigEndian.Uint32(h[8:12]) }
+
 // Config holds the configuration options used to initialize a Yamux session
 type Config struct {
-	// AcceptBacklog is the maximum number of streams that the 
+	// AcceptBacklog is the maximum number of streams that the
 	// accept channel can buffer
 	AcceptBacklog int
 
 	// EnableKeepAlive will periodically send pings to keep connections alive
 	EnableKeepAlive bool
 
-	// KeepAliveInterval is the duration between keep-alive pings
+	// KeepAliveInterval is the duration between keep-alive pings. A ping
+	// not answered within one interval counts as missed.
 	KeepAliveInterval time.Duration
 
+	// KeepAliveMaxMissed is the number of consecutive missed pings after
+	// which the session is considered dead and closed
+	KeepAliveMaxMissed int
+
 	// ConnectionWriteTimeout is the amount of time a write to the connection
 	// can block before timeout
 	ConnectionWriteTimeout time.Duration
@@ -48,108 +228,209 @@ type Config struct {
 	// StreamOpenTimeout is the amount of time a stream open can block
 	// before timeout
 	StreamOpenTimeout time.Duration
+
+	// MaxStreamWindowSize is the maximum number of unread bytes a stream
+	// will buffer. A writer blocks once the peer's window is used up and
+	// resumes when the peer reads. Must be at least 256KB.
+	MaxStreamWindowSize uint32
+
+	// MaxFrameSize is the largest payload sent in one data frame. Larger
+	// writes are split so other streams can interleave.
+	MaxFrameSize uint32
+
+	// Logger receives warnings and errors with the session and stream IDs
+	// as fields. NewConfig logs to stderr; set it to nil to silence the
+	// session. Errors are also returned to callers either way.
+	Logger Logger
 }
 
 // NewConfig creates a default configuration
 func NewConfig() *Config {
 	return &Config{
-		AcceptBacklog:         defaultAcceptBacklog,
-		EnableKeepAlive:       defaultEnableKeepAlive,
-		KeepAliveInterval:     defaultKeepAliveInterval,
+		AcceptBacklog:          defaultAcceptBacklog,
+		EnableKeepAlive:        defaultEnableKeepAlive,
+		KeepAliveInterval:      defaultKeepAliveInterval,
+		KeepAliveMaxMissed:     defaultKeepAliveMaxMissed,
 		ConnectionWriteTimeout: defaultConnectionWriteTimeout,
-		StreamOpenTimeout:     defaultStreamOpenTimeout,
+		StreamOpenTimeout:      defaultStreamOpenTimeout,
+		MaxStreamWindowSize:    defaultMaxStreamWindowSize,
+		MaxFrameSize:           defaultMaxFrameSize,
+		Logger:                 NewStdLogger(os.Stderr),
 	}
 }
 
-// Session is a Yamux session
+// VerifyConfig checks that the configuration is usable
+func VerifyConfig(config *Config) error {
+	if config.AcceptBacklog <= 0 {
+		return fmt.Errorf("backlog must be positive")
+	}
+	if config.EnableKeepAlive && config.KeepAliveInterval <= 0 {
+		return fmt.Errorf("keep-alive interval must be positive")
+	}
+	if config.EnableKeepAlive && config.KeepAliveMaxMissed <= 0 {
+		return fmt.Errorf("keep-alive max missed pings must be positive")
+	}
+	if config.MaxStreamWindowSize < initialStreamWindow {
+		return fmt.Errorf("MaxStreamWindowSize must be at least %d", initialStreamWindow)
+	}
+	if config.MaxFrameSize == 0 {
+		return fmt.Errorf("MaxFrameSize must be positive")
+	}
+	return nil
+}
+
+// sessionIDs numbers sessions for log fields
+var sessionIDs atomic.Uint64
+
+// Session is a Yamux session. It implements net.Listener so accepted
+// streams can be served by net/http and similar servers.
 type Session struct {
-	conn    io.ReadWriteCloser
-	config  *Config
-	
+	id     uint64
+	conn   io.ReadWriteCloser
+	config *Config
+	logger Logger
+
 	// Stream handling
-	streams    map[uint32]*Stream
+	streams      map[uint32]*Stream
 	nextStreamID uint32
-	streamLock sync.Mutex
-	acceptCh   chan *Stream
+	streamLock   sync.Mutex
+	acceptCh     chan *Stream
 
 	// Connection management
 	isRemoteClient bool // Is this a server or client
-	closed        bool
-	closeLock     sync.Mutex
-	
-	// Reader loop
+	closed         bool
+	closeErr       error // why the session was closed, nil if by Close
+	closeLock      sync.Mutex
+
+	// Go-away state. localGoAway rejects incoming streams, remoteGoAway
+	// rejects OpenStream.
+	localGoAway        bool
+	remoteGoAway       bool
+	remoteGoAwayReason GoAwayReason
+
+	// Ping handling. pings holds the channels of outstanding pings by ID
+	// and rtt the last measured round-trip time.
+	pingID   uint32
+	pings    map[uint32]chan struct{}
+	rtt      time.Duration
+	pingLock sync.Mutex
+
+	// Reader loop. recvHdr is reused for every frame header read.
 	readerShutdown chan struct{}
-	
-	// Writer loop
+	recvHdr        [headerSize]byte
+
+	// Statistics
+	counters sessionCounters
+
+	// Writer loop. sched orders the queued frames and writerDone is
+	// closed once the writer no longer touches them; batch, bufs and iov
+	// are only used by the writer.
 	writerLock     sync.Mutex
-	writeCh       chan []byte
+	sched          *scheduler
 	writerShutdown chan struct{}
-	
-	// Keep alive
-	keepaliveLock  sync.Mutex
-	keepaliveTimer *time.Timer
+	writerDone     chan struct{}
+	batch          []*frame
+	bufs           net.Buffers
+	iov            net.Buffers
 }
 
 // Server is used to initialize a server-side session
 func Server(conn io.ReadWriteCloser, config *Config) (*Session, error) {
-	if config == nil {
-		config = NewConfig()
-	}
-	
-	s := &Session{
-		conn:           conn,
-		config:         config,
-		streams:        make(map[uint32]*Stream),
-		nextStreamID:   1,
-		acceptCh:       make(chan *Stream, config.AcceptBacklog),
-		isRemoteClient: true,
-		readerShutdown: make(chan struct{}),
-		writeCh:        make(chan []byte, 16),
-		writerShutdown: make(chan struct{}),
-	}
-	
-	// Start the reader and writer
-	go s.reader()
-	go s.writer()
-	
-	// Start the keep-alive if enabled
-	if config.EnableKeepAlive {
-		go s.keepalive()
-	}
-	
-	return s, nil
+	return newSession(conn, config, false)
 }
 
 // Client is used to initialize a client-side session
 func Client(conn io.ReadWriteCloser, config *Config) (*Session, error) {
+	return newSession(conn, config, true)
+}
+
+// newSession starts the reader, writer and keep-alive loops for a session
+func newSession(conn io.ReadWriteCloser, config *Config, client bool) (*Session, error) {
 	if config == nil {
 		config = NewConfig()
 	}
-	
+	if err := VerifyConfig(config); err != nil {
+		return nil, err
+	}
+
 	s := &Session{
+		id:             sessionIDs.Add(1),
 		conn:           conn,
 		config:         config,
+		logger:         config.Logger,
 		streams:        make(map[uint32]*Stream),
-		nextStreamID:   2, // Client uses even stream IDs
 		acceptCh:       make(chan *Stream, config.AcceptBacklog),
-		isRemoteClient: false,
+		pings:          make(map[uint32]chan struct{}),
+		isRemoteClient: !client,
 		readerShutdown: make(chan struct{}),
-		writeCh:        make(chan []byte, 16),
+		sched:          newScheduler(),
 		writerShutdown: make(chan struct{}),
+		writerDone:     make(chan struct{}),
+		batch:          make([]*frame, 0, writeBatchSize),
+		bufs:           make(net.Buffers, 0, 2*writeBatchSize),
 	}
-	
+
+	if s.logger == nil {
+		s.logger = nopLogger{}
+	}
+
+	// Clients use odd stream IDs, servers use even ones
+	if client {
+		s.nextStreamID = 1
+	} else {
+		s.nextStreamID = 2
+	}
+
 	// Start the reader and writer
 	go s.reader()
 	go s.writer()
-	
+
 	// Start the keep-alive if enabled
 	if config.EnableKeepAlive {
 		go s.keepalive()
 	}
-	
+
 	return s, nil
 }
 
+// warn logs a recoverable problem with the session ID attached
+func (s *Session) warn(msg string, args ...interface{}) {
+	s.logger.Warn(msg, append([]interface{}{"session", s.id}, args...)...)
+}
+
+// shutdownErr returns the error operations fail with once the session has
+// closed, wrapping the cause if there was one
+func (s *Session) shutdownErr() error {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	if s.closeErr == nil {
+		return ErrSessionShutdown
+	}
+	return &shutdownError{cause: s.closeErr}
+}
+
+// shutdownError is ErrSessionShutdown carrying the reason the session
+// failed. errors.Is matches both ErrSessionShutdown and the cause.
+type shutdownError struct {
+	cause error
+}
+
+func (e *shutdownError) Error() string {
+	return ErrSessionShutdown.Error() + ": " + e.cause.Error()
+}
+
+func (e *shutdownError) Is(target error) bool { return target == ErrSessionShutdown }
+func (e *shutdownError) Unwrap() error        { return e.cause }
+
+// Err returns why the session was closed, or nil if it is open or was
+// closed with Close
+func (s *Session) Err() error {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.closeErr
+}
+
 // IsClosed checks if the session is closed
 func (s *Session) IsClosed() bool {
 	s.closeLock.Lock()
@@ -157,75 +438,161 @@ func (s *Session) IsClosed() bool {
 	return s.closed
 }
 
-// OpenStream creates a new stream
+// remoteGoAwayErr returns the error OpenStream fails with after the peer
+// sent a go-away, or nil if it has not
+func (s *Session) remoteGoAwayErr() error {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	if !s.remoteGoAway {
+		return nil
+	}
+	return fmt.Errorf("%w (%s)", ErrRemoteGoAway, s.remoteGoAwayReason)
+}
+
+// OpenStream creates a new stream and waits until the peer acknowledges it
 func (s *Session) OpenStream() (*Stream, error) {
 	// Check if the session is closed
 	if s.IsClosed() {
-		return nil, fmt.Errorf("session closed")
+		return nil, s.shutdownErr()
 	}
-	
+
+	// Check if the peer still accepts streams
+	if err := s.remoteGoAwayErr(); err != nil {
+		return nil, err
+	}
+
 	// Get a stream ID
 	s.streamLock.Lock()
 	streamID := s.nextStreamID
 	s.nextStreamID += 2 // Use odd/even IDs based on client/server
-	stream := newStream(s, streamID)
+	stream := newStream(s, streamID, streamSYNSent)
 	s.streams[streamID] = stream
 	s.streamLock.Unlock()
-	
-	// Send a SYN message
-	header := make([]byte, headerSize)
-	header[0] = typeSYN
-	header[1] = 0 // Flags
-	binary.BigEndian.PutUint32(header[2:6], streamID)
-	binary.BigEndian.PutUint32(header[6:10], 0) // Length is 0 for SYN
-	
-	// Write the header
-	if err := s.write(header); err != nil {
+	s.counters.totalStreams.Add(1)
+
+	// Send the SYN on a window update that also grants any window
+	// beyond the initial one
+	if err := stream.sendWindowUpdate(flagSYN); err != nil {
+		s.removeStream(streamID)
 		return nil, err
 	}
-	
+
+	// Wait for the peer to ACK or RST the stream
+	timer := time.NewTimer(s.config.StreamOpenTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-stream.establishCh:
+	case <-timer.C:
+		stream.Reset()
+		return nil, ErrStreamOpenTimeout
+	case <-s.readerShutdown:
+		return nil, s.shutdownErr()
+	}
+
+	if stream.getState() == streamReset {
+		if err := s.remoteGoAwayErr(); err != nil {
+			return nil, err
+		}
+		return nil, ErrStreamReset
+	}
+
 	return stream, nil
 }
 
-// AcceptStream accepts a new stream
+// AcceptStream blocks until the peer opens a new stream
 func (s *Session) AcceptStream() (*Stream, error) {
-	if s.IsClosed() {
-		return nil, fmt.Errorf("session closed")
-	}
-	
 	select {
 	case stream := <-s.acceptCh:
 		return stream, nil
-	case <-time.After(s.config.StreamOpenTimeout):
-		return nil, fmt.Errorf("timeout waiting for new stream")
+	case <-s.readerShutdown:
+		return nil, s.shutdownErr()
 	}
 }
 
+// Accept blocks until the peer opens a new stream. It implements
+// net.Listener.
+func (s *Session) Accept() (net.Conn, error) {
+	stream, err := s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Addr returns the local address of the session. It implements
+// net.Listener.
+func (s *Session) Addr() net.Addr {
+	return s.LocalAddr()
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (s *Session) LocalAddr() net.Addr {
+	if conn, ok := s.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return &yamuxAddr{"local"}
+}
+
+// RemoteAddr returns the remote address of the underlying connection
+func (s *Session) RemoteAddr() net.Addr {
+	if conn, ok := s.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
+	return &yamuxAddr{"remote"}
+}
+
+// GoAway tells the peer to stop opening streams. Streams already open keep
+// working, and streams the peer opens from now on are reset.
+func (s *Session) GoAway(reason GoAwayReason) error {
+	s.closeLock.Lock()
+	s.localGoAway = true
+	s.closeLock.Unlock()
+
+	return s.send(typeGoAway, 0, 0, uint32(reason))
+}
+
 // Close closes the session and all streams
 func (s *Session) Close() error {
+	return s.closeWithErr(nil)
+}
+
+// fail logs why the session is failing and closes it with err as the cause
+func (s *Session) fail(err error, args ...interface{}) {
+	s.logger.Error("Closing session", append([]interface{}{"session", s.id, "error", err}, args...)...)
+	s.closeWithErr(err)
+}
+
+// closeWithErr closes the session, recording why so that callers get the
+// cause instead of a bare ErrSessionShutdown
+func (s *Session) closeWithErr(cause error) error {
 	s.closeLock.Lock()
 	defer s.closeLock.Unlock()
-	
+
 	if s.closed {
 		return nil
 	}
-	
+
 	s.closed = true
-	
+	s.closeErr = cause
+
 	// Close all streams
 	s.streamLock.Lock()
+	streams := make([]*Stream, 0, len(s.streams))
 	for _, stream := range s.streams {
-		stream.closed = true
-		if stream.readBuf != nil {
-			stream.readBuf.Close()
-		}
+		streams = append(streams, stream)
 	}
 	s.streamLock.Unlock()
-	
+
+	for _, stream := range streams {
+		stream.forceClose()
+	}
+
 	// Stop the reader and writer
 	close(s.readerShutdown)
 	close(s.writerShutdown)
-	
+
 	// Close the underlying connection
 	return s.conn.Close()
 }
@@ -238,371 +605,542 @@ func (s *Session) reader() {
 			return
 		default:
 			// Read the header
-			header := make([]byte, headerSize)
-			if _, err := io.ReadFull(s.conn, header); err != nil {
-				if err != io.EOF {
-					fmt.Printf("Error reading header: %v\n", err)
+			hdr := header(s.recvHdr[:])
+			if _, err := io.ReadFull(s.conn, hdr); err != nil {
+				if err == io.EOF || s.IsClosed() {
+					s.Close()
+				} else {
+					s.fail(fmt.Errorf("reading header: %w", err))
 				}
-				s.Close()
 				return
 			}
-			
-			// Decode the header
-			msgType := header[0]
-			flags := header[1]
-			streamID := binary.BigEndian.Uint32(header[2:6])
-			length := binary.BigEndian.Uint32(header[6:10])
-			
+			s.counters.frameReceived(hdr.MsgType(), headerSize)
+
+			if hdr.Version() != protoVersion {
+				s.protocolError(ErrInvalidVersion, "version", hdr.Version())
+				return
+			}
+
 			// Handle the message based on type
-			switch msgType {
-			case typeData:
-				s.handleData(streamID, flags, length)
-			case typeSYN:
-				s.handleSYN(streamID)
-			case typeFIN:
-				s.handleFIN(streamID)
-			case typeACK:
-				s.handleACK(streamID)
-			case typePING:
-				s.handlePING(flags)
-			case typePONG:
-				// Nothing to do
+			switch hdr.MsgType() {
+			case typeData, typeWindowUpdate:
+				if !s.handleStreamMessage(hdr) {
+					return
+				}
+			case typePing:
+				s.handlePing(hdr.Flags(), hdr.Length())
+			case typeGoAway:
+				s.handleGoAway(GoAwayReason(hdr.Length()))
 			default:
-				fmt.Printf("Unknown message type: %d\n", msgType)
+				s.protocolError(ErrInvalidMsgType, "type", hdr.MsgType())
+				return
 			}
 		}
 	}
 }
 
-// handleData processes data frames
-func (s *Session) handleData(streamID uint32, flags byte, length uint32) {
+// handleStreamMessage processes data and window update frames. It returns
+// false once the session has been torn down.
+func (s *Session) handleStreamMessage(hdr header) bool {
+	streamID := hdr.StreamID()
+	flags := hdr.Flags()
+
+	// A SYN may arrive on either frame type
+	if flags&flagSYN == flagSYN {
+		if !s.handleSYN(streamID) {
+			return false
+		}
+	}
+
 	// Get the stream
 	s.streamLock.Lock()
 	stream, ok := s.streams[streamID]
 	s.streamLock.Unlock()
-	
+
 	if !ok {
-		// Stream doesn't exist, discard the data
-		if length > 0 {
-			discard := make([]byte, length)
-			io.ReadFull(s.conn, discard)
+		// Stream doesn't exist or was reset, discard the data
+		if hdr.MsgType() == typeData && hdr.Length() > 0 {
+			if _, err := io.CopyN(io.Discard, s.conn, int64(hdr.Length())); err != nil {
+				s.fail(fmt.Errorf("discarding data: %w", err))
+				return false
+			}
+			s.counters.bytesReceived.Add(uint64(hdr.Length()))
 		}
-		return
+		return true
 	}
-	
-	// Read the data
-	if length > 0 {
-		data := make([]byte, length)
-		if _, err := io.ReadFull(s.conn, data); err != nil {
-			fmt.Printf("Error reading data: %v\n", err)
-			s.Close()
-			return
+
+	if hdr.MsgType() == typeWindowUpdate {
+		if !stream.incrSendWindow(hdr.Length()) {
+			s.protocolError(ErrSendWindowOverflow, "stream", stream.id, "delta", hdr.Length())
+			return false
 		}
-		
-		// Give the data to the stream
-		stream.readBuf.Write(data)
+	} else if !s.handleData(stream, hdr.Length()) {
+		return false
 	}
+
+	// Flags apply after any payload has been delivered
+	stream.processFlags(flags)
+	return true
 }
 
-// handleSYN processes stream creation
-func (s *Session) handleSYN(streamID uint32) {
+// handleData reads the payload of a data frame into the stream buffer
+func (s *Session) handleData(stream *Stream, length uint32) bool {
+	if length == 0 {
+		return true
+	}
+
+	// Enforce the receive window we granted the peer
+	stream.stateLock.Lock()
+	window := stream.recvWindow
+	stream.stateLock.Unlock()
+	if length > window {
+		s.protocolError(ErrRecvWindowExceeded, "stream", stream.id, "length", length, "window", window)
+		return false
+	}
+
+	// Read the payload straight into the stream buffer
+	kept, err := stream.readBuf.fill(s.conn, int(length))
+	if err != nil {
+		s.fail(fmt.Errorf("reading data: %w", err))
+		return false
+	}
+	s.counters.bytesReceived.Add(uint64(length))
+	stream.bytesReceived.Add(uint64(length))
+	if !kept {
+		// The stream was closed for reading and the data dropped. Grant
+		// the window straight back, or a peer still writing stalls once
+		// it is used up.
+		if err := s.send(typeWindowUpdate, 0, stream.id, length); err != nil && !s.IsClosed() {
+			s.warn("Failed to return window of dropped data", "stream", stream.id, "error", err)
+		}
+		return true
+	}
+
+	// Shrink the window only once the data is buffered. Until then a
+	// concurrent window update sees the bytes in neither place and would
+	// grant them twice.
+	stream.stateLock.Lock()
+	stream.recvWindow -= length
+	stream.stateLock.Unlock()
+	return true
+}
+
+// handleSYN processes stream creation. It returns false once the session
+// has been torn down.
+func (s *Session) handleSYN(streamID uint32) bool {
+	// Read the go-away state first: closeWithErr takes closeLock before
+	// streamLock, so taking them the other way round could deadlock
+	s.closeLock.Lock()
+	goingAway := s.localGoAway
+	s.closeLock.Unlock()
+
 	s.streamLock.Lock()
-	defer s.streamLock.Unlock()
-	
+
 	// Check if the stream already exists
 	if _, ok := s.streams[streamID]; ok {
-		fmt.Printf("Stream %d already exists\n", streamID)
-		return
+		s.streamLock.Unlock()
+		s.protocolError(ErrDuplicateStream, "stream", streamID)
+		return false
 	}
-	
+
+	// Refuse new streams while going away
+	if goingAway {
+		s.streamLock.Unlock()
+		s.sendReset(streamID)
+		return true
+	}
+
 	// Create the stream
-	stream := newStream(s, streamID)
+	stream := newStream(s, streamID, streamSYNReceived)
 	s.streams[streamID] = stream
-	
-	// Send an ACK
-	header := make([]byte, headerSize)
-	header[0] = typeACK
-	header[1] = 0 // Flags
-	binary.BigEndian.PutUint32(header[2:6], streamID)
-	binary.BigEndian.PutUint32(header[6:10], 0) // Length is 0 for ACK
-	s.write(header)
-	
+	s.counters.totalStreams.Add(1)
+
 	// Add to the accept channel
 	select {
 	case s.acceptCh <- stream:
 	default:
-		// Accept channel is full
-		fmt.Println("Accept channel is full, dropping stream")
+		// Accept channel is full, tell the peer instead of leaving it hanging
+		s.warn("Accept backlog is full, resetting stream", "stream", streamID)
+		s.counters.acceptBacklogDrops.Add(1)
 		delete(s.streams, streamID)
+		s.streamLock.Unlock()
+		s.sendReset(streamID)
+		return true
 	}
+	s.streamLock.Unlock()
+
+	// Send an ACK along with any window beyond the initial one
+	stream.sendWindowUpdate(flagACK)
+	return true
 }
 
-// handleFIN processes stream closure
-func (s *Session) handleFIN(streamID uint32) {
+// sendReset refuses a stream the peer opened
+func (s *Session) sendReset(streamID uint32) {
+	s.send(typeWindowUpdate, flagRST, streamID, 0)
+}
+
+// removeStream forgets a stream that will not be used again
+func (s *Session) removeStream(streamID uint32) {
 	s.streamLock.Lock()
-	stream, ok := s.streams[streamID]
+	delete(s.streams, streamID)
 	s.streamLock.Unlock()
-	
-	if !ok {
+}
+
+// handlePing answers a ping request or completes one of our own pings
+func (s *Session) handlePing(flags uint16, pingID uint32) {
+	if flags&flagSYN == flagSYN {
+		// Reply from a separate goroutine so the reader never blocks on the writer
+		go s.send(typePing, flagACK, 0, pingID)
 		return
 	}
-	
-	// Close the stream
-	stream.closed = true
-	stream.readBuf.Close()
+
+	s.pingLock.Lock()
+	if ch, ok := s.pings[pingID]; ok {
+		delete(s.pings, pingID)
+		close(ch)
+	}
+	s.pingLock.Unlock()
 }
 
-// handleACK processes stream acknowledgment
-func (s *Session) handleACK(streamID uint32) {
-	// ACK is mainly for the SYN handshake, nothing to do here
+// Ping sends a ping to the peer and returns the round-trip time. It waits
+// up to ConnectionWriteTimeout for the reply.
+func (s *Session) Ping() (time.Duration, error) {
+	return s.ping(s.config.ConnectionWriteTimeout)
 }
 
-// handlePING sends a PONG response
-func (s *Session) handlePING(flags byte) {
-	header := make([]byte, headerSize)
-	header[0] = typePONG
-	header[1] = flags
-	header[2] = 0 // No stream ID for PING/PONG
-	header[6] = 0 // No length for PING/PONG
-	s.write(header)
+// RTT returns the round-trip time measured by the last answered ping, or
+// zero if no ping has been answered yet
+func (s *Session) RTT() time.Duration {
+	s.pingLock.Lock()
+	defer s.pingLock.Unlock()
+	return s.rtt
 }
 
-// write queues a write to the writer
-func (s *Session) write(data []byte) error {
-	// Check if the session is closed
-	if s.IsClosed() {
-		return fmt.Errorf("session closed")
+// ping sends a ping with a fresh opaque ID and waits for the matching reply
+func (s *Session) ping(timeout time.Duration) (time.Duration, error) {
+	ch := make(chan struct{})
+
+	s.pingLock.Lock()
+	id := s.pingID
+	s.pingID++
+	s.pings[id] = ch
+	s.pingLock.Unlock()
+
+	forget := func() {
+		s.pingLock.Lock()
+		delete(s.pings, id)
+		s.pingLock.Unlock()
 	}
-	
-	// Send the data to the writer
+
+	start := time.Now()
+	if err := s.send(typePing, flagSYN, 0, id); err != nil {
+		forget()
+		return 0, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	select {
-	case s.writeCh <- data:
-		return nil
-	case <-time.After(s.config.ConnectionWriteTimeout):
-		return fmt.Errorf("write timeout")
+	case <-ch:
+	case <-timer.C:
+		forget()
+		return 0, ErrTimeout
+	case <-s.readerShutdown:
+		forget()
+		return 0, s.shutdownErr()
 	}
+
+	rtt := time.Since(start)
+	s.pingLock.Lock()
+	s.rtt = rtt
+	s.pingLock.Unlock()
+
+	return rtt, nil
 }
 
-// writer is the main write loop
-func (s *Session) writer() {
-	for {
-		select {
-		case <-s.writerShutdown:
-			return
-		case data := <-s.writeCh:
-			s.writerLock.Lock()
-			_, err := s.conn.Write(data)
-			s.writerLock.Unlock()
-			
-			if err != nil {
-				fmt.Printf("Error writing: %v\n", err)
-				s.Close()
-				return
-			}
-		}
+// handleGoAway processes a go-away from the peer. New streams are refused
+// from now on while open streams are left to finish.
+func (s *Session) handleGoAway(reason GoAwayReason) {
+	if reason != GoAwayNormal {
+		s.warn("Received go away", "reason", reason)
 	}
+
+	s.closeLock.Lock()
+	s.remoteGoAway = true
+	s.remoteGoAwayReason = reason
+	s.closeLock.Unlock()
 }
 
-// keepalive sends periodic PING messages
-func (s *Session) keepalive() {
-	for {
-		select {
-		case <-s.readerShutdown:
-			return
-		case <-time.After(s.config.KeepAliveInterval):
-			// Send a PING
-			header := make([]byte, headerSize)
-			header[0] = typePING
-			header[1] = 0 // Flags
-			binary.BigEndian.PutUint32(header[2:6], 0) // No stream ID
-			binary.BigEndian.PutUint32(header[6:10], 0) // No length
-			
-			if err := s.write(header); err != nil {
-				fmt.Printf("Error sending keepalive: %v\n", err)
-				s.Close()
-				return
-			}
+// protocolError tells the peer why the session is being torn down and
+// closes it with err as the cause. The go-away is written ahead of
+// anything still queued, but the read loop waits at most
+// ConnectionWriteTimeout for it; closing the session then unblocks the
+// write.
+func (s *Session) protocolError(err error, args ...interface{}) {
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		s.writerLock.Lock()
+		defer s.writerLock.Unlock()
+		if conn, ok := s.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+			conn.SetWriteDeadline(time.Now().Add(s.config.ConnectionWriteTimeout))
 		}
+		s.counters.frameSent(typeGoAway, headerSize)
+		s.conn.Write(encodeHeader(typeGoAway, 0, 0, uint32(GoAwayProtocolError)))
+	}()
+
+	timer := time.NewTimer(s.config.ConnectionWriteTimeout)
+	defer timer.Stop()
+	select {
+	case <-sent:
+	case <-timer.C:
+		s.warn("Timed out sending protocol error go away")
 	}
+
+	s.fail(err, args...)
+}
+
+// frame is a queued write: a header and an optional payload that goes to
+// the connection without being copied
+type frame struct {
+	hdr    [headerSize]byte
+	body   []byte
+	small  []byte // owned buffer for payloads up to smallWriteSize
+	waiter bool   // someone waits on done, the writer must not recycle it
+	done   chan error
 }
 
-// Stream is a logical stream within a session
-type Stream struct {
-	session *Session
-	id      uint32
-	closed  bool
-	
-	readBuf *buffer
+// framePool recycles frames so steady traffic does not allocate
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return &frame{done: make(chan error, 1)}
+	},
 }
 
-// newStream creates a new stream
-func newStream(session *Session, id uint32) *Stream {
-	return &Stream{
-		session: session,
-		id:      id,
-		readBuf: newBuffer(),
+// getFrame returns a frame from the pool with the header filled in
+func getFrame(msgType byte, flags uint16, streamID uint32, length uint32) *frame {
+	f := framePool.Get().(*frame)
+	header(f.hdr[:]).encode(msgType, flags, streamID, length)
+	return f
+}
+
+// putFrame returns a frame to the pool
+func putFrame(f *frame) {
+	f.body = nil
+	f.waiter = false
+	framePool.Put(f)
+}
+
+// send queues a control frame. Control frames are written ahead of stream
+// data. It returns once the frame is queued, not written.
+func (s *Session) send(msgType byte, flags uint16, streamID uint32, length uint32) error {
+	return s.sendOrdered(nil, msgType, flags, streamID, length)
+}
+
+// sendOrdered queues a frame without payload behind the data already
+// queued for the stream, or as a control frame if stream is nil
+func (s *Session) sendOrdered(stream *Stream, msgType byte, flags uint16, streamID uint32, length uint32) error {
+	f := getFrame(msgType, flags, streamID, length)
+	if err := s.queue(f, stream, time.Time{}); err != nil {
+		putFrame(f)
+		return err
 	}
+	return nil
 }
 
-// Read reads data from the stream
-func (s *Stream) Read(p []byte) (int, error) {
-	if s.closed {
-		return 0, io.EOF
+// queueData queues a data frame for the stream. Small payloads are copied
+// into the frame and nil is returned. Larger ones are written in place,
+// and the returned frame must be passed to waitFrames before body is
+// reused. The deadline applies to queueing the frame; once queued it is
+// always written or failed.
+func (s *Session) queueData(stream *Stream, body []byte, deadline time.Time) (*frame, error) {
+	f := getFrame(typeData, 0, stream.id, uint32(len(body)))
+	wait := len(body) > smallWriteSize
+	if !wait {
+		if f.small == nil {
+			f.small = make([]byte, smallWriteSize)
+		}
+		f.body = f.small[:copy(f.small, body)]
+	} else {
+		f.body = body
+		f.waiter = true
+	}
+	if err := s.queue(f, stream, deadline); err != nil {
+		putFrame(f)
+		return nil, err
+	}
+	if !wait {
+		// The writer owns and recycles the frame from here
+		return nil, nil
 	}
-	
-	return s.readBuf.Read(p)
+	return f, nil
 }
 
-// Write writes data to the stream
-func (s *Stream) Write(p []byte) (int, error) {
-	if s.closed {
-		return 0, fmt.Errorf("stream closed")
-	}
-	
-	// Check if there's data to write
-	if len(p) == 0 {
-		return 0, nil
-	}
-	
-	// Create the header
-	header := make([]byte, headerSize)
-	header[0] = typeData
-	header[1] = 0 // Flags
-	binary.BigEndian.PutUint32(header[2:6], s.id)
-	binary.BigEndian.PutUint32(header[6:10], uint32(len(p)))
-	
-	// Write the header and data
-	data := append(header, p...)
-	err := s.session.write(data)
-	if err != nil {
-		return 0, err
+// waitFrames waits until the writer is done with frames returned by
+// queueData and recycles them. It returns the payload bytes written
+// before the first failure.
+func (s *Session) waitFrames(frames []*frame) (int, error) {
+	written := 0
+	var firstErr error
+	for i, f := range frames {
+		select {
+		case err := <-f.done:
+			if err == nil && firstErr == nil {
+				written += len(f.body)
+			} else if firstErr == nil {
+				firstErr = err
+			}
+			putFrame(f)
+		case <-s.writerDone:
+			// The frames may still sit in the queue; leave them to the GC
+			if firstErr == nil {
+				firstErr = s.shutdownErr()
+			}
+			return written, firstErr
+		}
+		frames[i] = nil
 	}
-	
-	return len(p), nil
+	return written, firstErr
 }
 
-// Close closes the stream
-func (s *Stream) Close() error {
-	if s.closed {
+// queue hands a frame to the scheduler, as a control frame if stream is
+// nil. If the queue is full it waits, giving up with ErrTimeout once the
+// deadline passes. A zero deadline waits for up to ConnectionWriteTimeout.
+func (s *Session) queue(f *frame, stream *Stream, deadline time.Time) error {
+	// Check if the session is closed
+	if s.IsClosed() {
+		return s.shutdownErr()
+	}
+
+	// Skip the timers when the queue has room
+	ok, space := s.sched.push(f, stream)
+	if ok {
 		return nil
 	}
-	
-	s.closed = true
-	
-	// Send a FIN message
-	header := make([]byte, headerSize)
-	header[0] = typeFIN
-	header[1] = 0 // Flags
-	binary.BigEndian.PutUint32(header[2:6], s.id)
-	binary.BigEndian.PutUint32(header[6:10], 0) // Length is 0 for FIN
-	
-	return s.session.write(header)
-}
-
-// buffer is a bytes buffer for the stream
-type buffer struct {
-	buf   []byte
-	rd, wr int
-	
-	closed bool
-	mutex  sync.Mutex
-	signal chan struct{}
-}
-
-// newBuffer creates a new buffer
-func newBuffer() *buffer {
-	return &buffer{
-		buf:    make([]byte, 0, 64),
-		signal: make(chan struct{}, 1),
-	}
-}
-
-// Read reads data from the buffer
-func (b *buffer) Read(p []byte) (int, error) {
-	b.mutex.Lock()
-	
-	for b.rd >= b.wr {
-		// Buffer is empty
-		if b.closed {
-			b.mutex.Unlock()
-			return 0, io.EOF
+
+	timeout, stop := deadlineTimer(deadline)
+	defer stop()
+	timer := time.NewTimer(s.config.ConnectionWriteTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-space:
+		case <-s.writerShutdown:
+			return s.shutdownErr()
+		case <-timeout:
+			return ErrTimeout
+		case <-timer.C:
+			return fmt.Errorf("write timeout")
 		}
-		
-		// Wait for more data
-		b.mutex.Unlock()
-		<-b.signal
-		b.mutex.Lock()
-	}
-	
-	// Read the data
-	n := copy(p, b.buf[b.rd:b.wr])
-	b.rd += n
-	
-	// Compact the buffer if it's getting full
-	if b.rd == b.wr {
-		b.rd = 0
-		b.wr = 0
-	}
-	
-	b.mutex.Unlock()
-	return n, nil
-}
-
-// Write writes data to the buffer
-func (b *buffer) Write(p []byte) (int, error) {
-	if len(p) == 0 {
-		return 0, nil
-	}
-	
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	
-	if b.closed {
-		return 0, fmt.Errorf("buffer closed")
-	}
-	
-	// Grow the buffer if needed
-	if b.wr+len(p) > len(b.buf) {
-		// Double the buffer size until it can fit the data
-		newSize := cap(b.buf) * 2
-		for newSize < b.wr+len(p) {
-			newSize *= 2
+
+		if ok, space = s.sched.push(f, stream); ok {
+			return nil
 		}
-		
-		newBuf := make([]byte, newSize)
-		copy(newBuf, b.buf[:b.wr])
-		b.buf = newBuf
-	}
-	
-	// Write the data
-	n := copy(b.buf[b.wr:], p)
-	b.wr += n
-	
-	// Signal that data is available
-	select {
-	case b.signal <- struct{}{}:
-	default:
 	}
-	
-	return n, nil
 }
 
-// Close closes the buffer
-func (b *buffer) Close() error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	
-	if b.closed {
-		return nil
+// writer is the main write loop. It takes frames from the scheduler and
+// writes their headers and payloads with one vectored write.
+func (s *Session) writer() {
+	defer s.drainWriter()
+
+	for {
+		s.batch = s.sched.pop(s.batch[:0], writeBatchSize)
+		if len(s.batch) == 0 {
+			select {
+			case <-s.writerShutdown:
+				return
+			case <-s.sched.notify:
+			}
+			continue
+		}
+
+		// Count before writing so the peer can never observe a frame
+		// that is not in our statistics yet
+		s.bufs = s.bufs[:0]
+		for _, f := range s.batch {
+			s.counters.frameSent(f.hdr[1], headerSize+len(f.body))
+			s.bufs = append(s.bufs, f.hdr[:])
+			if len(f.body) > 0 {
+				s.bufs = append(s.bufs, f.body)
+			}
+		}
+
+		// WriteTo consumes the slice it is called on, so keep bufs intact
+		s.iov = s.bufs
+		s.writerLock.Lock()
+		_, err := s.iov.WriteTo(s.conn)
+		s.writerLock.Unlock()
+
+		s.finishBatch(err)
+		if err != nil {
+			if !s.IsClosed() {
+				s.fail(fmt.Errorf("writing frame: %w", err))
+			}
+			return
+		}
 	}
-	
-	b.closed = true
-	
-	// Signal to unblock any waiting readers
-	select {
-	case b.signal <- struct{}{}:
-	default:
+}
+
+// finishBatch reports the result to waiting senders and recycles the rest
+func (s *Session) finishBatch(err error) {
+	for i, f := range s.batch {
+		if f.waiter {
+			f.done <- err
+		} else {
+			putFrame(f)
+		}
+		s.batch[i] = nil
 	}
-	
-	return nil
-} 
\ No newline at end of file
+	s.batch = s.batch[:0]
+}
+
+// drainWriter fails frames still queued when the writer stops, then lets
+// waiting senders return
+func (s *Session) drainWriter() {
+	s.batch = append(s.batch[:0], s.sched.drain()...)
+	s.finishBatch(s.shutdownErr())
+	close(s.writerDone)
+}
+
+// keepalive pings the peer every KeepAliveInterval, starting right away so
+// the RTT is known early, and closes the session once KeepAliveMaxMissed
+// pings in a row went unanswered
+func (s *Session) keepalive() {
+	missed := 0
+	for {
+		start := time.Now()
+
+		_, err := s.ping(s.config.KeepAliveInterval)
+		switch err {
+		case nil:
+			missed = 0
+		case ErrTimeout:
+			missed++
+			s.counters.keepAliveFailures.Add(1)
+			s.warn("Keep-alive ping missed", "missed", missed)
+			if missed >= s.config.KeepAliveMaxMissed {
+				s.fail(ErrKeepAliveTimeout, "missed", missed)
+				return
+			}
+		default:
+			if !s.IsClosed() {
+				s.fail(fmt.Errorf("sending keepalive: %w", err))
+			}
+			return
+		}
+
+		select {
+		case <-s.readerShutdown:
+			return
+		case <-time.After(s.config.KeepAliveInterval - time.Since(start)):
+		}
+	}
+}
+
+var (
+	_ net.Conn     = (*Stream)(nil)
+	_ net.Listener = (*Session)(nil)
+)